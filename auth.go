@@ -1,16 +1,20 @@
 package sshchat
 
 import (
+	"bufio"
 	"crypto/sha256"
 	"crypto/subtle"
-	"encoding/csv"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/shazow/ssh-chat/chat"
+	"github.com/shazow/ssh-chat/internal/sanitize"
 	"github.com/shazow/ssh-chat/set"
 	"github.com/shazow/ssh-chat/sshd"
 	"golang.org/x/crypto/ssh"
@@ -22,14 +26,30 @@ type KeyLoader func() ([]ssh.PublicKey, error)
 
 // ErrNotAllowed Is the error returned when a key is checked that is not allowlisted,
 // when allowlisting is enabled.
-var ErrNotAllowed = errors.New("not allowed")
+var ErrNotAllowed = errors.New("not on the allowlist")
 
-// ErrBanned is the error returned when a client is banned.
+// ErrBanned is the error returned when a client is banned. Temporary bans
+// wrap it with when they end.
 var ErrBanned = errors.New("banned")
 
+// timeformatBan is the format of the end of a ban in rejections.
+const timeformatBan = "2006-01-02 15:04 MST"
+
 // ErrIncorrectPassphrase is the error returned when a provided passphrase is incorrect.
 var ErrIncorrectPassphrase = errors.New("incorrect passphrase")
 
+// ErrUntrustedCert is the error returned when a certificate isn't signed by a
+// trusted certificate authority.
+var ErrUntrustedCert = errors.New("certificate signed by untrusted authority")
+
+// ErrSecurityKeyRequired is the error returned when making someone an op who
+// doesn't use a FIDO security key, while ops are required to.
+var ErrSecurityKeyRequired = errors.New("ops must use a security key")
+
+// principalPrefix marks entries in the ops, roles and allowlist sets which are
+// certificate principals rather than public key fingerprints.
+const principalPrefix = "principal:"
+
 // newAuthKey returns string from an ssh.PublicKey used to index the key in our lookup.
 func newAuthKey(key ssh.PublicKey) string {
 	if key == nil {
@@ -39,15 +59,30 @@ func newAuthKey(key ssh.PublicKey) string {
 	return sshd.Fingerprint(key)
 }
 
+// newAuthItem returns the item to store a key as, which keeps the key, and
+// its options if it's an AuthorizedKey, to write it back to its file.
 func newAuthItem(key ssh.PublicKey) set.Item {
-	return set.StringItem(newAuthKey(key))
+	return set.Itemize(newAuthKey(key), key)
 }
 
+// newPrincipalKey returns the string used to index a certificate principal in
+// our lookup.
+func newPrincipalKey(principal string) string {
+	return principalPrefix + principal
+}
+
+// unixAddr is the address of clients connected through a unix socket, which
+// don't have an IP. It's shared by all of them, so it isn't banned.
+const unixAddr = "unix"
+
 // newAuthAddr returns a string from a net.Addr used to index the address the key in our lookup.
 func newAuthAddr(addr net.Addr) string {
 	if addr == nil {
 		return ""
 	}
+	if addr.Network() == "unix" {
+		return unixAddr
+	}
 	host, _, _ := net.SplitHostPort(addr.String())
 	return host
 }
@@ -61,21 +96,50 @@ type Auth struct {
 	banned         *set.Set
 	allowlist      *set.Set
 	ops            *set.Set
+	roles          *set.Set       // Fingerprints to their assigned chat.Role.
+	totpSecrets    *set.Set       // Fingerprints and principals to their *totpSecret.
+	elevated       *set.Set       // Fingerprints elevated with a TOTP code.
+	totpThrottled  *set.Set       // Fingerprints refused codes after an incorrect one.
+	totpFailures   map[string]int // Fingerprints to their incorrect codes in a row.
+	totpMu         sync.Mutex
+
+	// OnRolesChange is called after a role is assigned.
+	OnRolesChange func()
+	// OnOpsChange and OnAllowlistChange are called after a key is added to
+	// or removed from the ops or allowlist, but not by their loaders.
+	OnOpsChange       func()
+	OnAllowlistChange func()
 
 	settingsMu      sync.RWMutex
 	allowlistMode   bool
 	opLoader        KeyLoader
 	allowlistLoader KeyLoader
+	opsLoaded       map[string]struct{} // Keys in the ops from opLoader.
+	allowlistLoaded map[string]struct{} // Keys in the allowlist from allowlistLoader.
+	caLoader        KeyLoader
+	authorities     []ssh.PublicKey // Trusted to sign user certificates.
+	keyPolicy       sshd.KeyPolicy
+	opsRequireSK    bool
+	banner          string
+	lobby           bool
+	opsRequireTOTP  bool
+	totpAtLogin     bool
+	elevation       time.Duration
 }
 
 // NewAuth creates a new empty Auth.
 func NewAuth() *Auth {
 	return &Auth{
-		bannedAddr:   set.New(),
-		bannedClient: set.New(),
-		banned:       set.New(),
-		allowlist:    set.New(),
-		ops:          set.New(),
+		bannedAddr:    set.New(),
+		bannedClient:  set.New(),
+		banned:        set.New(),
+		allowlist:     set.New(),
+		ops:           set.New(),
+		roles:         set.New(),
+		totpSecrets:   set.New(),
+		elevated:      set.New(),
+		totpThrottled: set.New(),
+		totpFailures:  map[string]int{},
 	}
 }
 
@@ -91,6 +155,121 @@ func (a *Auth) SetAllowlistMode(value bool) {
 	a.allowlistMode = value
 }
 
+// KeyPolicy returns the policy public keys must meet to connect.
+func (a *Auth) KeyPolicy() sshd.KeyPolicy {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.keyPolicy
+}
+
+// SetKeyPolicy sets the policy public keys must meet to connect.
+func (a *Auth) SetKeyPolicy(policy sshd.KeyPolicy) {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	a.keyPolicy = policy
+}
+
+// OpsRequireSecurityKey returns whether ops must use a FIDO security key to
+// have their role.
+func (a *Auth) OpsRequireSecurityKey() bool {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.opsRequireSK
+}
+
+// SetOpsRequireSecurityKey sets whether ops must use a FIDO security key to
+// have their role.
+func (a *Auth) SetOpsRequireSecurityKey(value bool) {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	a.opsRequireSK = value
+}
+
+// Banner returns the message shown to clients before they authenticate.
+func (a *Auth) Banner() string {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.banner
+}
+
+// SetBanner sets the message shown to clients before they authenticate, or
+// disables it if empty.
+func (a *Auth) SetBanner(banner string) {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	a.banner = banner
+}
+
+// Lobby returns whether keys which aren't on the allowlist can connect to wait
+// in a lobby for an op to approve them.
+func (a *Auth) Lobby() bool {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.lobby
+}
+
+// SetLobby sets whether keys which aren't on the allowlist can connect to
+// wait in a lobby for an op to approve them.
+func (a *Auth) SetLobby(value bool) {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	a.lobby = value
+}
+
+// OpsRequireTOTP returns whether ops only get their role after elevating
+// with a TOTP code.
+func (a *Auth) OpsRequireTOTP() bool {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.opsRequireTOTP
+}
+
+// SetOpsRequireTOTP sets whether ops only get their role after elevating
+// with a TOTP code.
+func (a *Auth) SetOpsRequireTOTP(value bool) {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	a.opsRequireTOTP = value
+}
+
+// TOTPAtLogin returns whether ops are asked for their TOTP code when they
+// connect, rather than only elevating when they choose to.
+func (a *Auth) TOTPAtLogin() bool {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.totpAtLogin
+}
+
+// SetTOTPAtLogin sets whether ops are asked for their TOTP code when they
+// connect.
+func (a *Auth) SetTOTPAtLogin(value bool) {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	a.totpAtLogin = value
+}
+
+// Elevation returns how long elevating with a TOTP code lasts, or 0 if it
+// doesn't expire.
+func (a *Auth) Elevation() time.Duration {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.elevation
+}
+
+// SetElevation sets how long elevating with a TOTP code lasts, or 0 for it
+// not to expire.
+func (a *Auth) SetElevation(d time.Duration) {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	a.elevation = d
+}
+
+// NeedsElevation returns whether a public key would be an op after elevating
+// with a TOTP code, but isn't elevated.
+func (a *Auth) NeedsElevation(key ssh.PublicKey) bool {
+	return a.OpsRequireTOTP() && !a.isElevated(key) && a.roleIfElevated(key) > chat.RoleVoice
+}
+
 // SetPassphrase enables passphrase authentication with the given passphrase.
 // If an empty passphrase is given, disable passphrase authentication.
 func (a *Auth) SetPassphrase(passphrase string) {
@@ -112,39 +291,174 @@ func (a *Auth) AcceptPassphrase() bool {
 	return a.passphraseHash != nil
 }
 
-// CheckBans checks IP, key and client bans.
+// CheckBans checks IP, key and client bans, and the addresses the key is
+// allowed from.
 func (a *Auth) CheckBans(addr net.Addr, key ssh.PublicKey, clientVersion string) error {
+	if authorized := a.AuthorizedKey(key); authorized != nil && !authorized.AllowedFrom(addr) {
+		return ErrNotAllowedFrom
+	}
+
 	authkey := newAuthKey(key)
 
-	var banned bool
+	var ban set.Item
 	if authkey != "" {
-		banned = a.banned.In(authkey)
+		ban = activeItem(a.banned, authkey)
+	}
+	if ban == nil {
+		ban = activeItem(a.bannedAddr, newAuthAddr(addr))
 	}
-	if !banned {
-		banned = a.bannedAddr.In(newAuthAddr(addr))
+	if ban == nil {
+		ban = activeItem(a.bannedClient, clientVersion)
 	}
-	if !banned {
-		banned = a.bannedClient.In(clientVersion)
+	if ban == nil {
+		return nil
 	}
 	// Ops can bypass bans, just in case we ban ourselves.
-	if banned && !a.IsOp(key) {
-		return ErrBanned
+	if a.IsOp(key) {
+		return nil
 	}
+	if expiring, ok := ban.(*set.ExpiringItem); ok {
+		return fmt.Errorf("%w until %s", ErrBanned, expiring.Time.UTC().Format(timeformatBan))
+	}
+	return ErrBanned
+}
 
-	return nil
+// activeItem returns the item for key in s, or nil if it's missing or expired.
+func activeItem(s *set.Set, key string) set.Item {
+	item, err := s.Get(key)
+	if err != nil || item.Value() == nil {
+		return nil
+	}
+	return item
 }
 
-// CheckPubkey determines if a pubkey fingerprint is permitted.
+// CheckPubkey determines if a pubkey fingerprint, or one of the principals of
+// a trusted certificate, is permitted. With the lobby and allowlist on, any
+// key is permitted to wait in the lobby.
 func (a *Auth) CheckPublicKey(key ssh.PublicKey) error {
-	authkey := newAuthKey(key)
-	allowlisted := a.allowlist.In(authkey)
-	if a.AllowAnonymous() || allowlisted || a.IsOp(key) {
+	if a.AllowAnonymous() || a.allowlisted(key) || a.IsOp(key) {
+		return nil
+	} else if key != nil && a.Lobby() && a.AllowlistMode() {
 		return nil
 	} else {
 		return ErrNotAllowed
 	}
 }
 
+func (a *Auth) allowlisted(key ssh.PublicKey) bool {
+	for _, authkey := range a.authKeys(key) {
+		if a.allowlist.In(authkey) {
+			return true
+		}
+	}
+	return false
+}
+
+// Quarantined returns whether a public key can only connect to the lobby,
+// because it's not on the allowlist while the allowlist is on.
+func (a *Auth) Quarantined(key ssh.PublicKey) bool {
+	return key != nil && a.Lobby() && a.AllowlistMode() && !a.allowlisted(key) && !a.IsOp(key)
+}
+
+// CheckCertificate checks that a certificate is signed by a trusted authority,
+// currently valid and permitted, and returns the principal to use as the
+// user's name: the requested name if it's one of the certificate's
+// principals, otherwise the first one. Without any trusted authorities,
+// certificates are checked like plain public keys instead.
+func (a *Auth) CheckCertificate(user string, cert *ssh.Certificate) (string, error) {
+	if !a.AcceptCertificates() {
+		return "", a.CheckPublicKey(cert)
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return "", errors.New("certificate has no principals")
+	}
+	principal := cert.ValidPrincipals[0]
+	name := strings.SplitN(user, inviteSeparator, 2)[0]
+	for _, p := range cert.ValidPrincipals {
+		if p == name {
+			principal = p
+			break
+		}
+	}
+	if err := a.checkCert(principal, cert); err != nil {
+		return "", err
+	}
+	return principal, a.CheckPublicKey(cert)
+}
+
+// checkCert checks that a user certificate for principal is signed by a
+// trusted authority and currently valid.
+func (a *Auth) checkCert(principal string, cert *ssh.Certificate) error {
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("certificate has type %d", cert.CertType)
+	}
+	checker := ssh.CertChecker{IsUserAuthority: a.isAuthority}
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return ErrUntrustedCert
+	}
+	return checker.CheckCert(principal, cert)
+}
+
+// principals returns the principals of a key if it's a valid certificate
+// signed by a trusted authority.
+func (a *Auth) principals(key ssh.PublicKey) []string {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || len(cert.ValidPrincipals) == 0 || !a.AcceptCertificates() {
+		return nil
+	}
+	if a.checkCert(cert.ValidPrincipals[0], cert) != nil {
+		return nil
+	}
+	return cert.ValidPrincipals
+}
+
+// authKeys returns the keys a public key is looked up by: its fingerprint, and
+// its principals if it's a trusted certificate.
+func (a *Auth) authKeys(key ssh.PublicKey) []string {
+	if key == nil {
+		return nil
+	}
+	keys := []string{newAuthKey(key)}
+	for _, principal := range a.principals(key) {
+		keys = append(keys, newPrincipalKey(principal))
+	}
+	return keys
+}
+
+// AuthorizedKey returns the options and comment a public key was loaded with
+// into the ops or allowlist, or nil if it was added without them.
+func (a *Auth) AuthorizedKey(key ssh.PublicKey) *AuthorizedKey {
+	authkey := newAuthKey(key)
+	if authkey == "" {
+		return nil
+	}
+	for _, s := range []*set.Set{a.ops, a.allowlist} {
+		if item, err := s.Get(authkey); err == nil {
+			if authorized, ok := item.Value().(*AuthorizedKey); ok {
+				return authorized
+			}
+		}
+	}
+	return nil
+}
+
+// NameReserved returns whether a name is forced by the name= option of a
+// loaded key other than key, so that nobody else can take it.
+func (a *Auth) NameReserved(name string, key ssh.PublicKey) bool {
+	authkey := newAuthKey(key)
+	reserved := false
+	for _, s := range []*set.Set{a.ops, a.allowlist} {
+		s.Each(func(_ string, item set.Item) error {
+			authorized, ok := item.Value().(*AuthorizedKey)
+			if ok && authorized.Name != "" && newAuthKey(authorized) != authkey && strings.EqualFold(sanitize.Name(authorized.Name), name) {
+				reserved = true
+			}
+			return nil
+		})
+	}
+	return reserved
+}
+
 // CheckPassphrase determines if a passphrase is permitted.
 func (a *Auth) CheckPassphrase(passphrase string) error {
 	if !a.AcceptPassphrase() {
@@ -162,6 +476,25 @@ func (a *Auth) Op(key ssh.PublicKey, d time.Duration) {
 	if key == nil {
 		return
 	}
+	a.addOp(key, d)
+	if a.OnOpsChange != nil {
+		a.OnOpsChange()
+	}
+}
+
+// Deop removes a public key from the known operators.
+func (a *Auth) Deop(key ssh.PublicKey) {
+	if key == nil {
+		return
+	}
+	a.ops.Remove(newAuthKey(key))
+	logger.Debugf("Removed from ops: %q", newAuthKey(key))
+	if a.OnOpsChange != nil {
+		a.OnOpsChange()
+	}
+}
+
+func (a *Auth) addOp(key ssh.PublicKey, d time.Duration) {
 	authItem := newAuthItem(key)
 	if d != 0 {
 		a.ops.Set(set.Expire(authItem, d))
@@ -171,10 +504,171 @@ func (a *Auth) Op(key ssh.PublicKey, d time.Duration) {
 	logger.Debugf("Added to ops: %q (for %s)", authItem.Key(), d)
 }
 
-// IsOp checks if a public key is an op.
+// OpPrincipal sets a certificate principal as a known operator.
+func (a *Auth) OpPrincipal(principal string, d time.Duration) {
+	item := set.Item(set.StringItem(newPrincipalKey(principal)))
+	if d != 0 {
+		item = set.Expire(item, d)
+	}
+	a.ops.Set(item)
+	logger.Debugf("Added to ops: %q (for %s)", item.Key(), d)
+}
+
+// IsOp checks if a public key is an op, either from the ops list or by
+// being assigned a moderator or owner role.
 func (a *Auth) IsOp(key ssh.PublicKey) bool {
-	authkey := newAuthKey(key)
-	return a.ops.In(authkey)
+	return a.KeyRole(key) >= chat.RoleModerator
+}
+
+// KeyRole returns the highest role of a public key's fingerprint and, if
+// it's a trusted certificate, its principals. If ops must use security keys,
+// other keys are at most voiced, as are keys which haven't elevated with a
+// TOTP code if ops must.
+func (a *Auth) KeyRole(key ssh.PublicKey) chat.Role {
+	role := a.roleIfElevated(key)
+	if role > chat.RoleVoice && a.OpsRequireTOTP() && !a.isElevated(key) {
+		logger.Debugf("Not an op without elevating: %q", newAuthKey(key))
+		role = chat.RoleVoice
+	}
+	return role
+}
+
+// roleIfElevated returns the role of a public key like KeyRole, but as if it
+// had elevated with a TOTP code.
+func (a *Auth) roleIfElevated(key ssh.PublicKey) chat.Role {
+	role := chat.RoleGuest
+	for _, authkey := range a.authKeys(key) {
+		if r := a.Role(authkey); r > role {
+			role = r
+		}
+	}
+	if role > chat.RoleVoice && a.OpsRequireSecurityKey() && !sshd.IsSecurityKey(key) {
+		logger.Debugf("Not an op without a security key: %q", newAuthKey(key))
+		role = chat.RoleVoice
+	}
+	return role
+}
+
+// Role returns the role of a public key fingerprint, or of a certificate
+// principal given as "principal:NAME". Roles assigned with SetRole take
+// precedence, otherwise ops are owners and everyone else is a guest.
+func (a *Auth) Role(fingerprint string) chat.Role {
+	if fingerprint == "" {
+		return chat.RoleGuest
+	}
+	if item, err := a.roles.Get(fingerprint); err == nil {
+		if role, ok := item.Value().(chat.Role); ok {
+			return role
+		}
+	}
+	if a.ops.In(fingerprint) {
+		return chat.RoleOwner
+	}
+	return chat.RoleGuest
+}
+
+// SetRole assigns a role to a public key fingerprint, expiring after d
+// unless d is 0. Assigning RoleGuest to a fingerprint that isn't in the ops
+// list removes its role.
+func (a *Auth) SetRole(fingerprint string, role chat.Role, d time.Duration) {
+	if fingerprint == "" {
+		return
+	}
+	if role == chat.RoleGuest && !a.ops.In(fingerprint) {
+		a.roles.Remove(fingerprint)
+	} else {
+		item := set.Itemize(fingerprint, role)
+		if d != 0 {
+			item = set.Expire(item, d)
+		}
+		a.roles.Set(item)
+	}
+	logger.Debugf("Set role: %q to %s (for %s)", fingerprint, role, d)
+
+	if a.OnRolesChange != nil {
+		a.OnRolesChange()
+	}
+}
+
+// RemoveRole removes the role assigned to a public key fingerprint, so that
+// it has the role it would without one.
+func (a *Auth) RemoveRole(fingerprint string) {
+	if fingerprint == "" {
+		return
+	}
+	a.roles.Remove(fingerprint)
+	logger.Debugf("Removed role: %q", fingerprint)
+
+	if a.OnRolesChange != nil {
+		a.OnRolesChange()
+	}
+}
+
+// LoadRoles replaces the assigned roles with ones read from r, as written by
+// SaveRoles. Empty lines and lines starting with # are skipped.
+func (a *Auth) LoadRoles(r io.Reader) error {
+	var items []set.Item
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("invalid role line: %q", line)
+		}
+		role, err := chat.ParseRole(fields[1])
+		if err != nil {
+			return err
+		}
+		item := set.Itemize(fields[0], role)
+		if len(fields) == 3 {
+			until, err := time.Parse(time.RFC3339, fields[2])
+			if err != nil {
+				return err
+			}
+			if time.Now().After(until) {
+				continue
+			}
+			item = &set.ExpiringItem{Item: item, Time: until}
+		}
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.roles.Clear()
+	for _, item := range items {
+		a.roles.Set(item)
+	}
+	return nil
+}
+
+// SaveRoles writes the assigned roles to w, one per line as the fingerprint,
+// role and, if it expires, the expiry time.
+func (a *Auth) SaveRoles(w io.Writer) error {
+	var lines []string
+	a.roles.Each(func(_ string, item set.Item) error {
+		role, ok := item.Value().(chat.Role)
+		if !ok {
+			return nil
+		}
+		line := item.Key() + " " + role.String()
+		if expiring, ok := item.(*set.ExpiringItem); ok {
+			line += " " + expiring.Time.UTC().Format(time.RFC3339)
+		}
+		lines = append(lines, line)
+		return nil
+	})
+	sort.Strings(lines)
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // LoadOps sets the public keys form loader to operators and saves the loader for later use
@@ -185,11 +679,23 @@ func (a *Auth) LoadOps(loader KeyLoader) error {
 	return a.ReloadOps()
 }
 
-// ReloadOps sets the public keys from a loader saved in the last call to operators
+// ReloadOps sets the public keys from a loader saved in the last call to
+// operators, and removes the ones it loaded before which are gone. Nothing is
+// removed if the loader fails.
 func (a *Auth) ReloadOps() error {
-	a.settingsMu.RLock()
-	defer a.settingsMu.RUnlock()
-	return addFromLoader(a.opLoader, a.Op)
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	return reloadFromLoader(a.opLoader, a.ops, &a.opsLoaded, a.addOp, true)
+}
+
+// AllowlistPrincipal will set a certificate principal as allowlisted.
+func (a *Auth) AllowlistPrincipal(principal string, d time.Duration) {
+	item := set.Item(set.StringItem(newPrincipalKey(principal)))
+	if d != 0 {
+		item = set.Expire(item, d)
+	}
+	a.allowlist.Set(item)
+	logger.Debugf("Added to allowlist: %q (for %s)", item.Key(), d)
 }
 
 // Allowlist will set a public key as a allowlisted user.
@@ -197,6 +703,13 @@ func (a *Auth) Allowlist(key ssh.PublicKey, d time.Duration) {
 	if key == nil {
 		return
 	}
+	a.addAllowlist(key, d)
+	if a.OnAllowlistChange != nil {
+		a.OnAllowlistChange()
+	}
+}
+
+func (a *Auth) addAllowlist(key ssh.PublicKey, d time.Duration) {
 	var err error
 	authItem := newAuthItem(key)
 	if d != 0 {
@@ -219,21 +732,140 @@ func (a *Auth) LoadAllowlist(loader KeyLoader) error {
 	return a.ReloadAllowlist()
 }
 
-//  LoadAllowlist adds the public keys from a loader saved in a previous call to the allowlist
+// ReloadAllowlist adds the public keys from a loader saved in a previous call
+// to the allowlist, and removes the ones it loaded before which are gone.
+// Nothing is removed if the loader fails.
 func (a *Auth) ReloadAllowlist() error {
+	return a.reloadAllowlist(true)
+}
+
+// reloadAllowlist is ReloadAllowlist, which only removes the keys gone from
+// the loader if revoke is set.
+func (a *Auth) reloadAllowlist(revoke bool) error {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	return reloadFromLoader(a.allowlistLoader, a.allowlist, &a.allowlistLoaded, a.addAllowlist, revoke)
+}
+
+// SaveOps writes the ops file read from r to w with the current ops, as
+// RewriteAuthorizedKeys does.
+func (a *Auth) SaveOps(r io.Reader, w io.Writer) error {
+	return RewriteAuthorizedKeys(r, w, authorizedKeys(a.ops))
+}
+
+// SaveAllowlist writes the allowlist file read from r to w with the current
+// allowlist, as RewriteAuthorizedKeys does.
+func (a *Auth) SaveAllowlist(r io.Reader, w io.Writer) error {
+	return RewriteAuthorizedKeys(r, w, authorizedKeys(a.allowlist))
+}
+
+// authorizedKeys returns the unexpired public keys in s, with the time they
+// expire. Certificate principals are skipped.
+func authorizedKeys(s *set.Set) []*AuthorizedKey {
+	var keys []*AuthorizedKey
+	s.Each(func(_ string, item set.Item) error {
+		var k AuthorizedKey
+		switch key := item.Value().(type) {
+		case *AuthorizedKey:
+			k = *key
+		case ssh.PublicKey:
+			k.PublicKey = key
+		default:
+			return nil
+		}
+		if expiring, ok := item.(*set.ExpiringItem); ok {
+			k.Expiry = expiring.Time
+		}
+		keys = append(keys, &k)
+		return nil
+	})
+	return keys
+}
+
+// AcceptCertificates determines if user certificates are checked against
+// trusted certificate authorities.
+func (a *Auth) AcceptCertificates() bool {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return len(a.authorities) != 0
+}
+
+// LoadCertAuthorities trusts the public keys from the loader to sign user
+// certificates, replacing any previously trusted, and saves the loader for
+// later use.
+func (a *Auth) LoadCertAuthorities(loader KeyLoader) error {
+	a.settingsMu.Lock()
+	a.caLoader = loader
+	a.settingsMu.Unlock()
+	return a.ReloadCertAuthorities()
+}
+
+// ReloadCertAuthorities trusts the public keys from a loader saved in the last
+// call to sign user certificates. The trusted keys are kept if it fails.
+func (a *Auth) ReloadCertAuthorities() error {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	if a.caLoader == nil {
+		return nil
+	}
+	keys, err := a.caLoader()
+	if err != nil {
+		return err
+	}
+	a.authorities = keys
+	return nil
+}
+
+// AddCertAuthority trusts a public key to sign user certificates.
+func (a *Auth) AddCertAuthority(key ssh.PublicKey) {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	a.authorities = append(a.authorities, key)
+}
+
+func (a *Auth) isAuthority(key ssh.PublicKey) bool {
+	fingerprint := newAuthKey(key)
 	a.settingsMu.RLock()
 	defer a.settingsMu.RUnlock()
-	return addFromLoader(a.allowlistLoader, a.Allowlist)
+	for _, authority := range a.authorities {
+		if newAuthKey(authority) == fingerprint {
+			return true
+		}
+	}
+	return false
 }
 
-func addFromLoader(loader KeyLoader, adder func(ssh.PublicKey, time.Duration)) error {
+// reloadFromLoader adds the keys from loader to s with adder. loaded holds the
+// keys in s which came from the loader, and if revoke is set, the ones which
+// are gone from a successful load are removed from s.
+func reloadFromLoader(loader KeyLoader, s *set.Set, loaded *map[string]struct{}, adder func(ssh.PublicKey, time.Duration), revoke bool) error {
 	if loader == nil {
 		return nil
 	}
 	keys, err := loader()
+	current := map[string]struct{}{}
 	for _, key := range keys {
-		adder(key, 0)
+		var d time.Duration
+		if authorized, ok := key.(*AuthorizedKey); ok && !authorized.Expiry.IsZero() {
+			if authorized.Expired() {
+				continue
+			}
+			d = time.Until(authorized.Expiry)
+		}
+		adder(key, d)
+		current[newAuthKey(key)] = struct{}{}
+	}
+	for authKey := range *loaded {
+		if err == nil && revoke {
+			if _, ok := current[authKey]; !ok {
+				s.Remove(authKey)
+				logger.Debugf("Removed %q, which is no longer loaded", authKey)
+			}
+			continue
+		}
+		current[authKey] = struct{}{}
 	}
+	*loaded = current
 	return err
 }
 
@@ -285,9 +917,14 @@ func (a *Auth) Banned() (ip []string, fingerprint []string, client []string) {
 	return
 }
 
-// BanAddr will set an IP address as banned.
+// BanAddr will set an IP address as banned. Clients on a unix socket, or
+// without an address, can't be banned by address.
 func (a *Auth) BanAddr(addr net.Addr, d time.Duration) {
 	authItem := set.StringItem(newAuthAddr(addr))
+	if authItem == "" || authItem == unixAddr {
+		logger.Debugf("Not banning address %q, which isn't an IP", authItem.Key())
+		return
+	}
 	if d != 0 {
 		a.bannedAddr.Set(set.Expire(authItem, d))
 	} else {
@@ -297,45 +934,23 @@ func (a *Auth) BanAddr(addr net.Addr, d time.Duration) {
 }
 
 // BanQuery takes space-separated key="value" pairs to ban, including ip, fingerprint, client.
-// Fields without an = will be treated as a duration, applied to the next field.
-// For example: 5s client=foo 10min ip=1.1.1.1
-// Will ban client foo for 5 seconds, and ip 1.1.1.1 for 10min.
+// A trailing field without an = is treated as a duration, applied to all the fields.
+// For example: client=foo ip=1.1.1.1 10m
+// Will ban client foo and ip 1.1.1.1 for 10min. See chat.ParseQuery.
 func (a *Auth) BanQuery(q string) error {
-	r := csv.NewReader(strings.NewReader(q))
-	r.Comma = ' '
-	fields, err := r.Read()
+	fields, d, err := chat.ParseQuery(q)
 	if err != nil {
 		return err
 	}
-
-	var d time.Duration
-	if last := fields[len(fields)-1]; !strings.Contains(last, "=") {
-		d, err = time.ParseDuration(last)
-		if err != nil {
-			return err
-		}
-		fields = fields[:len(fields)-1]
-	}
 	for _, field := range fields {
-		parts := strings.SplitN(field, "=", 2)
-		if len(parts) != 2 {
-			return fmt.Errorf("invalid query: %q", q)
-		}
-		key, value := parts[0], parts[1]
-		switch key {
+		switch field.Key {
 		case "client":
-			a.BanClient(value, d)
+			a.BanClient(field.Value, d)
 		case "fingerprint":
 			// TODO: Add a validity check?
-			a.BanFingerprint(value, d)
+			a.BanFingerprint(field.Value, d)
 		case "ip":
-			ip := net.ParseIP(value)
-			if ip.String() == "" {
-				return fmt.Errorf("invalid ip value: %q", ip)
-			}
-			a.BanAddr(&net.TCPAddr{IP: ip}, d)
-		default:
-			return fmt.Errorf("unknown query field: %q", field)
+			a.BanAddr(&net.TCPAddr{IP: net.ParseIP(field.Value)}, d)
 		}
 	}
 
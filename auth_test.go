@@ -1,10 +1,17 @@
 package sshchat
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/shazow/ssh-chat/chat"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -94,3 +101,228 @@ func TestAuthPassphrases(t *testing.T) {
 		t.Error("Didn't clear passphrase.")
 	}
 }
+
+func TestAuthRoles(t *testing.T) {
+	key, err := NewRandomPublicKey(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := newAuthKey(key)
+
+	auth := NewAuth()
+	if role := auth.Role(fingerprint); role != chat.RoleGuest {
+		t.Errorf("got: %s; want: guest", role)
+	}
+
+	auth.Op(key, 0)
+	if role := auth.Role(fingerprint); role != chat.RoleOwner {
+		t.Errorf("got: %s; want: owner", role)
+	}
+
+	changed := 0
+	auth.OnRolesChange = func() { changed++ }
+	auth.SetRole(fingerprint, chat.RoleModerator, 0)
+	auth.SetRole("SHA256:voiced", chat.RoleVoice, time.Hour)
+	if changed != 2 {
+		t.Errorf("OnRolesChange called %d times, want 2", changed)
+	}
+	if role := auth.Role(fingerprint); role != chat.RoleModerator {
+		t.Errorf("got: %s; want: moderator", role)
+	}
+	if !auth.IsOp(key) {
+		t.Error("moderator should be op")
+	}
+
+	// Removing the role leaves no override, so the op is an owner again.
+	auth.RemoveRole(fingerprint)
+	if role := auth.Role(fingerprint); role != chat.RoleOwner {
+		t.Errorf("got: %s; want: owner", role)
+	}
+	auth.SetRole(fingerprint, chat.RoleModerator, 0)
+
+	var buf bytes.Buffer
+	if err := auth.SaveRoles(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewAuth()
+	if err := loaded.LoadRoles(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if role := loaded.Role(fingerprint); role != chat.RoleModerator {
+		t.Errorf("got: %s; want: moderator", role)
+	}
+	if role := loaded.Role("SHA256:voiced"); role != chat.RoleVoice {
+		t.Errorf("got: %s; want: voice", role)
+	}
+
+	if err := loaded.LoadRoles(strings.NewReader("SHA256:old voice 2000-01-01T00:00:00Z\n")); err != nil {
+		t.Fatal(err)
+	}
+	if role := loaded.Role("SHA256:old"); role != chat.RoleGuest {
+		t.Errorf("expired role was loaded: %s", role)
+	}
+}
+
+// newTestCert returns a user certificate signed by ca, and a signer to
+// authenticate with it.
+func newTestCert(t *testing.T, ca ssh.Signer, principals []string, validFor time.Duration) (*ssh.Certificate, ssh.Signer) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(validFor).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certSigner
+}
+
+// newTestCA returns a new certificate authority signer.
+func newTestCA(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func TestAuthCertificates(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+
+	auth := NewAuth()
+	cert, _ := newTestCert(t, ca, []string{"alice", "admins"}, time.Hour)
+	if principal, err := auth.CheckCertificate("alice", cert); err != nil || principal != "" {
+		t.Errorf("without authorities: got: %q, %v; want: \"\", nil", principal, err)
+	}
+
+	auth.AddCertAuthority(ca.PublicKey())
+	if principal, err := auth.CheckCertificate("admins", cert); err != nil || principal != "admins" {
+		t.Errorf("got: %q, %v; want: \"admins\", nil", principal, err)
+	}
+	// Names that aren't principals map to the first one.
+	if principal, err := auth.CheckCertificate("mallory+token", cert); err != nil || principal != "alice" {
+		t.Errorf("got: %q, %v; want: \"alice\", nil", principal, err)
+	}
+
+	expired, _ := newTestCert(t, ca, []string{"alice"}, -time.Second)
+	if _, err := auth.CheckCertificate("alice", expired); err == nil {
+		t.Error("expired certificate was accepted")
+	}
+	untrusted, _ := newTestCert(t, other, []string{"alice"}, time.Hour)
+	if _, err := auth.CheckCertificate("alice", untrusted); err != ErrUntrustedCert {
+		t.Errorf("got: %v; want: %v", err, ErrUntrustedCert)
+	}
+
+	if auth.IsOp(cert) {
+		t.Error("certificate is op before its principal was")
+	}
+	auth.OpPrincipal("admins", 0)
+	if !auth.IsOp(cert) {
+		t.Error("certificate with an op principal is not op")
+	}
+	// Principals of untrusted certificates don't count.
+	untrustedAdmin, _ := newTestCert(t, other, []string{"admins"}, time.Hour)
+	if auth.IsOp(untrustedAdmin) {
+		t.Error("untrusted certificate with an op principal is op")
+	}
+
+	auth.SetAllowlistMode(true)
+	bob, _ := newTestCert(t, ca, []string{"bob"}, time.Hour)
+	if _, err := auth.CheckCertificate("bob", bob); err != ErrNotAllowed {
+		t.Errorf("got: %v; want: %v", err, ErrNotAllowed)
+	}
+	auth.AllowlistPrincipal("bob", 0)
+	if _, err := auth.CheckCertificate("bob", bob); err != nil {
+		t.Errorf("failed to permit allowlisted principal: %v", err)
+	}
+}
+
+func TestAuthOpsRequireSecurityKey(t *testing.T) {
+	key, err := NewRandomPublicKey(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skKey, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Name        string
+		KeyBytes    []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, make([]byte, ed25519.PublicKeySize), "ssh:"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := NewAuth()
+	auth.Op(key, 0)
+	auth.Op(skKey, 0)
+	auth.SetOpsRequireSecurityKey(true)
+	if role := auth.KeyRole(key); role != chat.RoleVoice {
+		t.Errorf("got: %s; want: %s", role, chat.RoleVoice)
+	}
+	if role := auth.KeyRole(skKey); role != chat.RoleOwner {
+		t.Errorf("got: %s; want: %s", role, chat.RoleOwner)
+	}
+}
+
+func TestAuthBanReasons(t *testing.T) {
+	auth := NewAuth()
+	key, err := NewRandomPublicKey(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("1.2.3.4")}
+
+	auth.BanClient("bot", 0)
+	if err := auth.CheckBans(addr, key, "bot"); err != ErrBanned {
+		t.Errorf("got: %v; want: %v", err, ErrBanned)
+	}
+
+	auth.Ban(key, time.Hour)
+	err = auth.CheckBans(addr, key, "ssh")
+	if !errors.Is(err, ErrBanned) || !strings.HasPrefix(err.Error(), "banned until ") {
+		t.Errorf("got: %v; want: banned until ...", err)
+	}
+
+	auth.BanAddr(addr, -time.Second)
+	if err := auth.CheckBans(addr, nil, "ssh"); err != nil {
+		t.Errorf("expired ban: got: %v; want: nil", err)
+	}
+}
+
+func TestAuthUnixAddr(t *testing.T) {
+	auth := NewAuth()
+	addr := &net.UnixAddr{Net: "unix"}
+	if got := newAuthAddr(addr); got != unixAddr {
+		t.Errorf("got: %q; want: %q", got, unixAddr)
+	}
+
+	// Everyone on the socket shares the address, so it isn't banned.
+	auth.BanAddr(addr, 0)
+	if err := auth.CheckBans(addr, nil, "ssh"); err != nil {
+		t.Errorf("got: %v; want: nil", err)
+	}
+	if err := auth.BanQuery("ip=unix"); err == nil {
+		t.Error("banned ip=unix")
+	}
+	if banned := auth.bannedAddr.Len(); banned != 0 {
+		t.Errorf("got %d banned addresses; want 0", banned)
+	}
+}
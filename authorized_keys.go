@@ -0,0 +1,211 @@
+package sshchat
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNotAllowedFrom is the error returned when a key is used from an address
+// its from= option doesn't allow.
+var ErrNotAllowedFrom = errors.New("key not allowed from this address")
+
+// AuthorizedKey is a public key with the options and comment of its
+// authorized_keys line. It can be returned by a KeyLoader in place of the
+// plain key.
+type AuthorizedKey struct {
+	ssh.PublicKey
+	Comment string
+	// From are the address patterns of the from= option, or nil to allow any
+	// address.
+	From []string
+	// Expiry is when the key stops being authorized, from the expiry-time=
+	// option, or zero if it doesn't.
+	Expiry time.Time
+	// Name is the nickname forced on users of the key by the name= option.
+	Name string
+}
+
+// expiryTimeFormats are the formats of the expiry-time= option, as in
+// sshd(8): YYYYMMDD[HHMM[SS]] in local time, or UTC with a Z suffix.
+var expiryTimeFormats = []string{"20060102150405", "200601021504", "20060102"}
+
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") {
+		value, loc = strings.TrimSuffix(value, "Z"), time.UTC
+	}
+	for _, format := range expiryTimeFormats {
+		if len(value) == len(format) {
+			return time.ParseInLocation(format, value, loc)
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time: %q", value)
+}
+
+// ParseAuthorizedKey parses a line in the authorized_keys format, keeping the
+// from=, expiry-time= and name= options. Other options are ignored.
+func ParseAuthorizedKey(line []byte) (*AuthorizedKey, error) {
+	key, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return nil, err
+	}
+	k := &AuthorizedKey{PublicKey: key, Comment: comment}
+	for _, option := range options {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name, value := strings.ToLower(parts[0]), strings.Trim(parts[1], `"`)
+		switch name {
+		case "from":
+			k.From = strings.Split(value, ",")
+		case "expiry-time":
+			if k.Expiry, err = parseExpiryTime(value); err != nil {
+				return nil, err
+			}
+		case "name":
+			k.Name = value
+		}
+	}
+	return k, nil
+}
+
+// ParseAuthorizedKeys reads keys in the authorized_keys format from r,
+// skipping empty lines and comments.
+func ParseAuthorizedKeys(r io.Reader) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, err := ParseAuthorizedKey(scanner.Bytes())
+		if err != nil {
+			if err.Error() == "ssh: no key found" {
+				continue // Skip line
+			}
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// String returns the key as a line in the authorized_keys format, with its
+// from=, expiry-time= and name= options and its comment. The expiry time is
+// written in UTC.
+func (k *AuthorizedKey) String() string {
+	var options []string
+	if len(k.From) != 0 {
+		options = append(options, fmt.Sprintf("from=%q", strings.Join(k.From, ",")))
+	}
+	if !k.Expiry.IsZero() {
+		options = append(options, fmt.Sprintf("expiry-time=%q", k.Expiry.UTC().Format(expiryTimeFormats[0])+"Z"))
+	}
+	if k.Name != "" {
+		options = append(options, fmt.Sprintf("name=%q", k.Name))
+	}
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k.PublicKey)))
+	if len(options) != 0 {
+		line = strings.Join(options, ",") + " " + line
+	}
+	if k.Comment != "" {
+		line += " " + k.Comment
+	}
+	return line
+}
+
+// RewriteAuthorizedKeys writes the authorized_keys file read from r to w with
+// only keys. Comments, empty lines and lines which can't be parsed are kept,
+// as are the lines of keys which are still in keys, unless their expiry time
+// changed. Keys which weren't in r are appended.
+func RewriteAuthorizedKeys(r io.Reader, w io.Writer, keys []*AuthorizedKey) error {
+	pending := map[string]*AuthorizedKey{}
+	for _, key := range keys {
+		pending[newAuthKey(key)] = key
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			if old, err := ParseAuthorizedKey([]byte(line)); err == nil {
+				key, ok := pending[newAuthKey(old)]
+				if !ok {
+					// Removed, or a duplicate of a line already written.
+					continue
+				}
+				delete(pending, newAuthKey(old))
+				if !sameExpiry(old.Expiry, key.Expiry) {
+					old.Expiry = key.Expiry
+					line = old.String()
+				}
+			}
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var added []string
+	for _, key := range pending {
+		added = append(added, key.String())
+	}
+	sort.Strings(added)
+	for _, line := range added {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameExpiry returns whether expiry times are the same to the second, which
+// is the precision they're written with.
+func sameExpiry(a, b time.Time) bool {
+	return a.Truncate(time.Second).Equal(b.Truncate(time.Second))
+}
+
+// Expired returns whether the key's expiry time has passed.
+func (k *AuthorizedKey) Expired() bool {
+	return !k.Expiry.IsZero() && time.Now().After(k.Expiry)
+}
+
+// AllowedFrom returns whether the key can be used from an address. Patterns
+// can be addresses, CIDR ranges or wildcards like 10.0.*, and are negated by
+// a leading !. Clients on a unix socket have the address unix.
+func (k *AuthorizedKey) AllowedFrom(addr net.Addr) bool {
+	if len(k.From) == 0 {
+		return true
+	}
+	ip := newAuthAddr(addr)
+	allowed := false
+	for _, pattern := range k.From {
+		negated := strings.HasPrefix(pattern, "!")
+		if matchAddr(strings.TrimPrefix(pattern, "!"), ip) {
+			if negated {
+				return false
+			}
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+func matchAddr(pattern, ip string) bool {
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		parsed := net.ParseIP(ip)
+		return parsed != nil && network.Contains(parsed)
+	}
+	matched, _ := path.Match(pattern, ip)
+	return matched
+}
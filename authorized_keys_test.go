@@ -0,0 +1,144 @@
+package sshchat
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const testAuthorizedKey = "AAAAC3NzaC1lZDI1NTE5AAAAIPUiNw0nQku4pcUCbZcJlIEAIf5bXJYTy/DKI1vh5b+P"
+
+func TestParseAuthorizedKey(t *testing.T) {
+	line := `from="10.0.0.0/8,!10.0.0.1",expiry-time="20300102Z",name="alice",no-pty ssh-ed25519 ` + testAuthorizedKey + " alice@laptop"
+	key, err := ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Comment != "alice@laptop" || key.Name != "alice" {
+		t.Errorf("unexpected comment or name: %q, %q", key.Comment, key.Name)
+	}
+	if want := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC); !key.Expiry.Equal(want) {
+		t.Errorf("got: %s; want: %s", key.Expiry, want)
+	}
+	if key.Expired() {
+		t.Error("key expired early")
+	}
+
+	for addr, want := range map[string]bool{
+		"10.1.2.3:22":    true,
+		"10.0.0.1:22":    false,
+		"192.168.0.1:22": false,
+	} {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := key.AllowedFrom(tcpAddr); got != want {
+			t.Errorf("%s: got: %v; want: %v", addr, got, want)
+		}
+	}
+
+	if _, err := ParseAuthorizedKey([]byte(`expiry-time="tomorrow" ssh-ed25519 ` + testAuthorizedKey)); err == nil {
+		t.Error("expected error for invalid expiry-time")
+	}
+}
+
+func TestAuthAuthorizedKeyOptions(t *testing.T) {
+	keys, err := ParseAuthorizedKeys(strings.NewReader(strings.Join([]string{
+		"# comment",
+		`from="127.0.0.*" ssh-ed25519 ` + testAuthorizedKey + " laptop",
+		`expiry-time="20000101" ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHz7l5wmTC8cEMK5AKU8wpgsEDM3Jo6gGAsBZGgkZ3u+`,
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys; want 2", len(keys))
+	}
+
+	auth := NewAuth()
+	auth.SetAllowlistMode(true)
+	if err := auth.LoadAllowlist(func() ([]ssh.PublicKey, error) { return keys, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := auth.CheckPublicKey(keys[0]); err != nil {
+		t.Error("failed to permit allowlisted key:", err)
+	}
+	if err := auth.CheckPublicKey(keys[1]); err != ErrNotAllowed {
+		t.Errorf("expired key: got: %v; want: %v", err, ErrNotAllowed)
+	}
+	if comment := auth.AuthorizedKey(keys[0]).Comment; comment != "laptop" {
+		t.Errorf("got: %q; want: %q", comment, "laptop")
+	}
+
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.0.1")}
+	if err := auth.CheckBans(local, keys[0], "ssh"); err != nil {
+		t.Errorf("got: %v; want: nil", err)
+	}
+	if err := auth.CheckBans(remote, keys[0], "ssh"); err != ErrNotAllowedFrom {
+		t.Errorf("got: %v; want: %v", err, ErrNotAllowedFrom)
+	}
+}
+
+func TestAuthSaveAllowlist(t *testing.T) {
+	const otherKey = "AAAAC3NzaC1lZDI1NTE5AAAAIHz7l5wmTC8cEMK5AKU8wpgsEDM3Jo6gGAsBZGgkZ3u+"
+	file := strings.Join([]string{
+		"# The allowlist",
+		"ssh-ed25519 " + testAuthorizedKey + " alice",
+		"",
+		"# Removed below",
+		"ssh-ed25519 " + otherKey + " bob",
+	}, "\n")
+	keys, err := ParseAuthorizedKeys(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := NewAuth()
+	var changes int
+	auth.OnAllowlistChange = func() { changes++ }
+	auth.LoadAllowlist(func() ([]ssh.PublicKey, error) { return keys, nil })
+	if changes != 0 {
+		t.Errorf("loading the allowlist called OnAllowlistChange %d times", changes)
+	}
+
+	auth.Allowlist(keys[1], 1)
+	added, err := NewRandomPublicKey(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Allowlist(added, time.Hour)
+	if changes != 2 {
+		t.Errorf("got %d changes; want 2", changes)
+	}
+
+	var saved strings.Builder
+	if err := auth.SaveAllowlist(strings.NewReader(file), &saved); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(saved.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines; want 5: %q", len(lines), lines)
+	}
+	for i, want := range []string{"# The allowlist", "ssh-ed25519 " + testAuthorizedKey + " alice", "", "# Removed below"} {
+		if lines[i] != want {
+			t.Errorf("line %d: got %q; want %q", i, lines[i], want)
+		}
+	}
+
+	key, err := ParseAuthorizedKey([]byte(lines[4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newAuthKey(key) != newAuthKey(added) {
+		t.Errorf("appended the wrong key: %q", lines[4])
+	}
+	if until := time.Until(key.Expiry); until <= 59*time.Minute || until > time.Hour {
+		t.Errorf("appended key expires in %s; want an hour", until)
+	}
+}
@@ -0,0 +1,220 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shazow/ssh-chat/chat/message"
+	"github.com/shazow/ssh-chat/set"
+)
+
+// ErrRoomBanned is the error returned when a banned user joins a room.
+var ErrRoomBanned = errors.New("banned from room")
+
+// ErrRoomNotAllowed is the error returned when a user who isn't on a room's
+// allowlist joins it while the allowlist is on.
+var ErrRoomNotAllowed = errors.New("not allowed in room")
+
+// accessSource is implemented by identities which can be matched against a
+// room's bans and allowlist.
+type accessSource interface {
+	Fingerprint() string
+	IP() string
+	Client() string
+}
+
+// QueryField is one key=value condition of a ban or allowlist query, where
+// the key is one of ip, fingerprint or client.
+type QueryField struct {
+	Key   string
+	Value string
+}
+
+// String returns the field in the format it's parsed from.
+func (f QueryField) String() string {
+	return f.Key + "=" + f.Value
+}
+
+// ParseQuery parses space-separated key="value" pairs with keys like ip,
+// fingerprint and client. A trailing field without an = is a duration that
+// applies to all the fields. For example: client=foo ip=1.1.1.1 10m
+func ParseQuery(q string) ([]QueryField, time.Duration, error) {
+	return ParseQueryArgs(message.Tokenize(q))
+}
+
+// ParseQueryArgs parses a query already split into fields, like the arguments
+// of a command. See ParseQuery.
+func ParseQueryArgs(fields []string) ([]QueryField, time.Duration, error) {
+	if len(fields) == 0 {
+		return nil, 0, errors.New("empty query")
+	}
+
+	var d time.Duration
+	if last := fields[len(fields)-1]; !strings.Contains(last, "=") {
+		var err error
+		d, err = time.ParseDuration(last)
+		if err != nil {
+			return nil, 0, err
+		}
+		fields = fields[:len(fields)-1]
+	}
+
+	query := make([]QueryField, 0, len(fields))
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, 0, fmt.Errorf("invalid query field: %q", field)
+		}
+		key, value := parts[0], parts[1]
+		switch key {
+		case "client", "fingerprint":
+		case "ip":
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, 0, fmt.Errorf("invalid ip value: %q", value)
+			}
+			value = ip.String()
+		default:
+			return nil, 0, fmt.Errorf("unknown query field: %q", field)
+		}
+		query = append(query, QueryField{key, value})
+	}
+	return query, d, nil
+}
+
+// queryKeys are the keys of query fields, for completion.
+var queryKeys = []string{"client=", "fingerprint=", "ip="}
+
+// CompleteQuery returns the candidates to complete the last of args, which are
+// a member's name or a query, and an optional duration: the names of members
+// for the first argument, and the keys of query fields for any argument after
+// a query's first field.
+func CompleteQuery(room *Room, args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	if len(args) == 1 {
+		return append(room.NamesPrefix(args[0]), queryKeys...)
+	}
+	if !strings.Contains(args[0], "=") {
+		// A name, followed by a duration.
+		return nil
+	}
+	return append([]string(nil), queryKeys...)
+}
+
+// Access is a room's own bans and allowlist, checked when users join.
+type Access struct {
+	banned  *set.Set
+	allowed *set.Set
+
+	mu            sync.Mutex
+	allowlistMode bool
+}
+
+// NewAccess creates an Access without bans, and with the allowlist off.
+func NewAccess() *Access {
+	return &Access{
+		banned:  set.New(),
+		allowed: set.New(),
+	}
+}
+
+func addFields(s *set.Set, fields []QueryField, d time.Duration) {
+	for _, field := range fields {
+		item := set.Item(set.StringItem(field.String()))
+		if d != 0 {
+			item = set.Expire(item, d)
+		}
+		s.Set(item)
+	}
+}
+
+func removeFields(s *set.Set, fields []QueryField) {
+	for _, field := range fields {
+		s.Remove(field.String())
+	}
+}
+
+func listFields(s *set.Set) []string {
+	var keys []string
+	s.Each(func(_ string, item set.Item) error {
+		keys = append(keys, item.Key())
+		return nil
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// Ban bans users matching any of the fields, for d or forever if d is 0.
+func (a *Access) Ban(fields []QueryField, d time.Duration) {
+	addFields(a.banned, fields, d)
+}
+
+// Unban removes bans for the fields.
+func (a *Access) Unban(fields []QueryField) {
+	removeFields(a.banned, fields)
+}
+
+// Banned returns the bans as key=value strings.
+func (a *Access) Banned() []string {
+	return listFields(a.banned)
+}
+
+// Allow adds the fields to the allowlist, for d or forever if d is 0.
+func (a *Access) Allow(fields []QueryField, d time.Duration) {
+	addFields(a.allowed, fields, d)
+}
+
+// Disallow removes the fields from the allowlist.
+func (a *Access) Disallow(fields []QueryField) {
+	removeFields(a.allowed, fields)
+}
+
+// Allowed returns the allowlist as key=value strings.
+func (a *Access) Allowed() []string {
+	return listFields(a.allowed)
+}
+
+// AllowlistMode returns whether only users on the allowlist can join.
+func (a *Access) AllowlistMode() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.allowlistMode
+}
+
+// SetAllowlistMode turns the allowlist on or off.
+func (a *Access) SetAllowlistMode(on bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allowlistMode = on
+}
+
+// Check returns an error if the user is banned, or isn't on the allowlist
+// while it's on.
+func (a *Access) Check(u *message.User) error {
+	var fields []QueryField
+	if src, ok := u.Identifier.(accessSource); ok {
+		if fingerprint := src.Fingerprint(); fingerprint != "" {
+			fields = append(fields, QueryField{"fingerprint", fingerprint})
+		}
+		fields = append(fields, QueryField{"ip", src.IP()}, QueryField{"client", src.Client()})
+	}
+
+	allowed := false
+	for _, field := range fields {
+		if a.banned.In(field.String()) {
+			return ErrRoomBanned
+		}
+		allowed = allowed || a.allowed.In(field.String())
+	}
+	if a.AllowlistMode() && !allowed {
+		return ErrRoomNotAllowed
+	}
+	return nil
+}
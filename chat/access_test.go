@@ -0,0 +1,117 @@
+package chat
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shazow/ssh-chat/chat/message"
+)
+
+type accessID struct {
+	message.SimpleID
+	fingerprint, ip, client string
+}
+
+func (i accessID) Fingerprint() string { return i.fingerprint }
+func (i accessID) IP() string          { return i.ip }
+func (i accessID) Client() string      { return i.client }
+
+func TestParseQuery(t *testing.T) {
+	fields, d, err := ParseQuery(`"client=foo bar" ip=::ffff:1.2.3.4 10m`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []QueryField{{"client", "foo bar"}, {"ip", "1.2.3.4"}}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("got: %v; want: %v", fields, want)
+	}
+	if d != 10*time.Minute {
+		t.Errorf("got: %s; want: 10m", d)
+	}
+
+	fields, _, err = ParseQuery(`client="SSH-2.0-Go ssh"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []QueryField{{"client", "SSH-2.0-Go ssh"}}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("got: %v; want: %v", fields, want)
+	}
+
+	for _, q := range []string{"", "ip=nope", "user=foo", "foo=bar baz"} {
+		if _, _, err := ParseQuery(q); err == nil {
+			t.Errorf("expected error for %q", q)
+		}
+	}
+}
+
+func TestAccessCheck(t *testing.T) {
+	a := NewAccess()
+	foo := message.NewUser(accessID{"foo", "SHA256:foo", "1.2.3.4", "SSH-2.0-Go"})
+	bar := message.NewUser(accessID{"bar", "", "5.6.7.8", "SSH-2.0-OpenSSH"})
+
+	a.Ban([]QueryField{{"client", "SSH-2.0-OpenSSH"}}, 0)
+	if err := a.Check(bar); err != ErrRoomBanned {
+		t.Errorf("got: %v; want: %v", err, ErrRoomBanned)
+	}
+	if err := a.Check(foo); err != nil {
+		t.Errorf("got: %v; want: nil", err)
+	}
+
+	a.Unban([]QueryField{{"client", "SSH-2.0-OpenSSH"}})
+	a.Ban([]QueryField{{"ip", "5.6.7.8"}}, -time.Second)
+	if err := a.Check(bar); err != nil {
+		t.Errorf("expired ban: got: %v; want: nil", err)
+	}
+
+	a.SetAllowlistMode(true)
+	a.Allow([]QueryField{{"fingerprint", "SHA256:foo"}}, 0)
+	if err := a.Check(foo); err != nil {
+		t.Errorf("got: %v; want: nil", err)
+	}
+	if err := a.Check(bar); err != ErrRoomNotAllowed {
+		t.Errorf("got: %v; want: %v", err, ErrRoomNotAllowed)
+	}
+	if got, want := a.Allowed(), []string{"fingerprint=SHA256:foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v; want: %v", got, want)
+	}
+}
+
+func TestRoomJoinAccess(t *testing.T) {
+	r := NewRoom()
+	go r.Serve()
+	defer r.Close()
+
+	r.Access.Ban([]QueryField{{"ip", "1.2.3.4"}}, 0)
+	id := accessID{"foo", "SHA256:foo", "1.2.3.4", "SSH-2.0-Go"}
+
+	if _, err := r.Join(message.NewUser(id)); err != ErrRoomBanned {
+		t.Errorf("got: %v; want: %v", err, ErrRoomBanned)
+	}
+	// Ops aren't kept out of the room.
+	if _, err := r.JoinAs(message.NewUser(id), RoleModerator); err != nil {
+		t.Errorf("got: %v; want: nil", err)
+	}
+}
+
+func TestCompleteQuery(t *testing.T) {
+	r := NewRoom()
+	go r.Serve()
+	defer r.Close()
+
+	if _, err := r.Join(message.NewUser(message.SimpleID("foo"))); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"f"}, []string{"foo", "client=", "fingerprint=", "ip="}},
+		{[]string{"foo", "1"}, nil},
+		{[]string{"ip=1.2.3.4", "c"}, []string{"client=", "fingerprint=", "ip="}},
+	} {
+		if got := CompleteQuery(r, c.args); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got: %v; want: %v", c.args, got, c.want)
+		}
+	}
+}
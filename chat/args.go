@@ -0,0 +1,156 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shazow/ssh-chat/chat/message"
+)
+
+// ErrTooManyArgs is the error returned when a command with Args is given more
+// arguments than it takes.
+var ErrTooManyArgs = errors.New("too many arguments")
+
+// ArgType is the type a command argument is parsed as.
+type ArgType int
+
+const (
+	// ArgString is any word.
+	ArgString ArgType = iota
+	// ArgInt is an integer.
+	ArgInt
+	// ArgDuration is a duration like 10m, as parsed by time.ParseDuration.
+	ArgDuration
+	// ArgUser is the name of a member of the room, parsed as their *Member.
+	ArgUser
+	// ArgRest is the raw rest of the command, with its spacing and quotes,
+	// and can only be the last argument.
+	ArgRest
+)
+
+// Arg describes an argument of a command.
+type Arg struct {
+	Name     string // Shown in help, such as USER
+	Type     ArgType
+	Optional bool // Only the arguments after an optional one can be optional.
+}
+
+func (a Arg) help() string {
+	help := a.Name
+	if a.Type == ArgRest {
+		help += "..."
+	}
+	if a.Optional {
+		help = "[" + help + "]"
+	}
+	return help
+}
+
+// Args are the parsed arguments of a command, by name. Optional arguments
+// which weren't given are missing.
+type Args map[string]interface{}
+
+// Has returns whether an argument was given.
+func (a Args) Has(name string) bool {
+	_, ok := a[name]
+	return ok
+}
+
+// String returns an ArgString or ArgRest argument, or "" if it wasn't given.
+func (a Args) String(name string) string {
+	s, _ := a[name].(string)
+	return s
+}
+
+// Int returns an ArgInt argument, or 0 if it wasn't given.
+func (a Args) Int(name string) int {
+	i, _ := a[name].(int)
+	return i
+}
+
+// Duration returns an ArgDuration argument, or 0 if it wasn't given.
+func (a Args) Duration(name string) time.Duration {
+	d, _ := a[name].(time.Duration)
+	return d
+}
+
+// Member returns an ArgUser argument, or nil if it wasn't given.
+func (a Args) Member(name string) *Member {
+	m, _ := a[name].(*Member)
+	return m
+}
+
+// parseArgs parses the arguments of a command message by cmd's Args.
+func (cmd *Command) parseArgs(room *Room, msg message.CommandMsg) (Args, error) {
+	values := msg.Args()
+	args := Args{}
+	for i, arg := range cmd.Args {
+		if i >= len(values) {
+			if arg.Optional {
+				break
+			}
+			return nil, fmt.Errorf("%w: %s", ErrMissingArg, arg.Name)
+		}
+		value := values[i]
+		switch arg.Type {
+		case ArgString:
+			args[arg.Name] = value
+		case ArgInt:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q is not a number", arg.Name, value)
+			}
+			args[arg.Name] = n
+		case ArgDuration:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q is not a duration, like 10m", arg.Name, value)
+			}
+			args[arg.Name] = d
+		case ArgUser:
+			member, ok := room.MemberByID(value)
+			if !ok {
+				return nil, fmt.Errorf("user not found: %s", value)
+			}
+			args[arg.Name] = member
+		case ArgRest:
+			args[arg.Name] = msg.Rest(i)
+			return args, nil
+		}
+	}
+	if len(values) > len(cmd.Args) {
+		return nil, ErrTooManyArgs
+	}
+	return args, nil
+}
+
+// argsHelp returns the usage of cmd's Args, like "USER [DURATION]".
+func (cmd *Command) argsHelp() string {
+	parts := make([]string, 0, len(cmd.Args))
+	for _, arg := range cmd.Args {
+		parts = append(parts, arg.help())
+	}
+	return strings.Join(parts, " ")
+}
+
+// Completions returns the candidates to complete the last of args, which may
+// be partial, given to the command by from. They're from the command's
+// Complete callback or, without one, the names of members if the argument is
+// an ArgUser. The second result is false if the command doesn't know how to
+// complete the argument.
+func (cmd *Command) Completions(room *Room, from *message.User, args []string) ([]string, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	if cmd.Complete != nil {
+		return cmd.Complete(room, from, args), true
+	}
+	i := len(args) - 1
+	if i >= len(cmd.Args) || cmd.Args[i].Type != ArgUser {
+		return nil, false
+	}
+	return room.NamesPrefix(args[i]), true
+}
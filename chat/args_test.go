@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shazow/ssh-chat/chat/message"
+)
+
+func TestCommandArgs(t *testing.T) {
+	room := NewRoom()
+	defer room.Close()
+	u := message.NewUser(message.SimpleID("alice"))
+	if _, err := room.Join(u); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Args
+	cmds := Commands{}
+	err := cmds.Add(Command{
+		Prefix: "/slap",
+		Help:   "Slap USER.",
+		Args: []Arg{
+			{Name: "USER", Type: ArgUser},
+			{Name: "TIMES", Type: ArgInt},
+			{Name: "FOR", Type: ArgDuration, Optional: true},
+			{Name: "REASON", Type: ArgRest, Optional: true},
+		},
+		Run: func(room *Room, msg message.CommandMsg, args Args) error {
+			got = args
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if help := cmds["/slap"].PrefixHelp; help != "USER TIMES [FOR] [REASON...]" {
+		t.Errorf("got PrefixHelp %q", help)
+	}
+
+	run := func(line string) error {
+		msg, _ := message.NewPublicMsg(line, u).ParseCommand()
+		return cmds.Run(room, *msg)
+	}
+
+	if err := run("/slap alice 3 1m with a large trout"); err != nil {
+		t.Fatal(err)
+	}
+	if got.Member("USER").User != u || got.Int("TIMES") != 3 || got.Duration("FOR") != time.Minute || got.String("REASON") != "with a large trout" {
+		t.Errorf("unexpected args: %v", got)
+	}
+	if err := run(`/slap alice 3 1m with  a "large" trout`); err != nil {
+		t.Fatal(err)
+	}
+	if reason := got.String("REASON"); reason != `with  a "large" trout` {
+		t.Errorf("got REASON %q", reason)
+	}
+	if err := run("/slap alice 1"); err != nil {
+		t.Fatal(err)
+	}
+	if got.Has("FOR") || got.Has("REASON") {
+		t.Errorf("optional args were set: %v", got)
+	}
+
+	for line, want := range map[string]string{
+		"/slap":           "missing argument: USER, usage: /slap USER TIMES [FOR] [REASON...]",
+		"/slap bob 1":     "user not found: bob, usage: /slap USER TIMES [FOR] [REASON...]",
+		"/slap alice one": `invalid TIMES: "one" is not a number, usage: /slap USER TIMES [FOR] [REASON...]`,
+	} {
+		if err := run(line); err == nil || err.Error() != want {
+			t.Errorf("%s: got: %v; want: %s", line, err, want)
+		}
+	}
+	if err := run("/slap"); !errors.Is(err, ErrMissingArg) {
+		t.Errorf("got: %v; want ErrMissingArg", err)
+	}
+
+	if candidates, ok := cmds["/slap"].Completions(room, u, []string{"al"}); !ok || len(candidates) != 1 || candidates[0] != "alice" {
+		t.Errorf("user completions: got: %v, %v", candidates, ok)
+	}
+	if _, ok := cmds["/slap"].Completions(room, u, []string{"alice", "1"}); ok {
+		t.Error("completed an integer argument")
+	}
+}
+
+func TestCommandsHelpCategory(t *testing.T) {
+	cmds := Commands{}
+	cmds.Add(Command{
+		Prefix:   "/roll",
+		Help:     "Roll the dice.",
+		Category: "Game",
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			return nil
+		},
+	})
+	cmds.Add(Command{
+		Prefix:     "/rig",
+		Help:       "Rig the dice.",
+		Category:   "Game",
+		Capability: CapAdmin,
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			return nil
+		},
+	})
+	if err := cmds.Add(Command{Prefix: "/nothing"}); err != ErrMissingHandler {
+		t.Errorf("got: %v; want: %v", err, ErrMissingHandler)
+	}
+
+	help := cmds.Help(func(c Capability) bool { return c == CapNone })
+	if !strings.Contains(help, "-> Game commands:"+message.Newline+"/roll") || strings.Contains(help, "/rig") {
+		t.Errorf("unexpected help: %q", help)
+	}
+}
@@ -0,0 +1,144 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shazow/ssh-chat/chat/message"
+)
+
+// maxAuditEntries is the number of recent audit entries kept in memory for
+// querying, older entries are only kept by the sink.
+const maxAuditEntries = 1000
+
+// auditSource is implemented by identities which know where they connected
+// from, so it can be recorded with their actions.
+type auditSource interface {
+	Fingerprint() string
+	IP() string
+}
+
+// AuditEntry is a record of a moderation action taken by an op.
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	Actor       string    `json:"actor"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+	Action      string    `json:"action"`
+	Target      string    `json:"target,omitempty"`
+	Args        []string  `json:"args,omitempty"`
+}
+
+// String returns a one line description of the entry.
+func (e AuditEntry) String() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "%s %s %s", e.Time.UTC().Format("2006-01-02 15:04:05"), e.Actor, e.Action)
+	if e.Target != "" {
+		out.WriteString(" " + e.Target)
+	}
+	if len(e.Args) > 0 {
+		fmt.Fprintf(&out, " %q", e.Args)
+	}
+	var from []string
+	if e.IP != "" {
+		from = append(from, e.IP)
+	}
+	if e.Fingerprint != "" {
+		from = append(from, e.Fingerprint)
+	}
+	if len(from) > 0 {
+		out.WriteString(" (from " + strings.Join(from, " ") + ")")
+	}
+	return out.String()
+}
+
+// AuditLog is an append-only log of moderation actions.
+type AuditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+
+	// Sink, if set, receives each entry as a line of JSON.
+	Sink io.Writer
+}
+
+// Record adds an entry for an action taken by a user against a target, which
+// can be empty if the action has none.
+func (a *AuditLog) Record(from *message.User, action string, target string, args ...string) {
+	entry := AuditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  from.ID(),
+		Action: action,
+		Target: target,
+		Args:   args,
+	}
+	if src, ok := from.Identifier.(auditSource); ok {
+		entry.Fingerprint = src.Fingerprint()
+		entry.IP = src.IP()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.append(entry)
+	if a.Sink == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = a.Sink.Write(append(line, '\n'))
+	}
+	if err != nil {
+		logger.Printf("Failed to write audit entry: %s", err)
+	}
+}
+
+func (a *AuditLog) append(entry AuditEntry) {
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > maxAuditEntries {
+		a.entries = append([]AuditEntry{}, a.entries[len(a.entries)-maxAuditEntries:]...)
+	}
+}
+
+// Query returns up to the n most recent entries, oldest first. If user is not
+// empty, only entries where they are the actor or the target are returned.
+func (a *AuditLog) Query(n int, user string) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var entries []AuditEntry
+	for i := len(a.entries) - 1; i >= 0 && len(entries) < n; i-- {
+		e := a.entries[i]
+		if user != "" && !strings.EqualFold(e.Actor, user) && !strings.EqualFold(e.Target, user) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+// Load reads entries written by a previous sink, so they can be queried.
+// Entries are not written to the sink again.
+func (a *AuditLog) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		a.append(entry)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,103 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/shazow/ssh-chat/chat/message"
+)
+
+func TestAuditLog(t *testing.T) {
+	var sink bytes.Buffer
+	audit := AuditLog{Sink: &sink}
+	op := message.NewUser(message.SimpleID("op"))
+
+	audit.Record(op, "kick", "foo")
+	audit.Record(op, "ban", "bar", "1h")
+	audit.Record(op, "motd", "", "hello")
+
+	entries := audit.Query(10, "")
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	if got, want := entries[1].Action+" "+entries[1].Target, "ban bar"; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+
+	entries = audit.Query(1, "")
+	if len(entries) != 1 || entries[0].Action != "motd" {
+		t.Errorf("expected only the most recent entry, got: %v", entries)
+	}
+
+	entries = audit.Query(10, "FOO")
+	if len(entries) != 1 || entries[0].Action != "kick" {
+		t.Errorf("expected only entries for foo, got: %v", entries)
+	}
+	entries = audit.Query(10, "op")
+	if len(entries) != 3 {
+		t.Errorf("expected all entries by op, got: %v", entries)
+	}
+
+	var entry AuditEntry
+	line, _ := sink.ReadBytes('\n')
+	if err := json.Unmarshal(line, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Actor != "op" || entry.Action != "kick" || entry.Target != "foo" {
+		t.Errorf("unexpected entry in sink: %s", line)
+	}
+
+	loaded := AuditLog{}
+	if err := loaded.Load(&sink); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Query(10, ""); len(got) != 2 || got[1].Args[0] != "hello" {
+		t.Errorf("unexpected loaded entries: %v", got)
+	}
+}
+
+func TestAuditCommand(t *testing.T) {
+	var buffer []byte
+
+	room := NewRoom()
+	go room.Serve()
+	defer room.Close()
+
+	screen := &MockScreen{}
+	op := ScreenedUser{
+		user:   message.NewUserScreen(message.SimpleID("op"), screen),
+		screen: screen,
+	}
+	member, err := room.Join(op.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op.user.HandleMsg(op.user.ConsumeOne())
+	op.screen.Read(&buffer)
+
+	if err := sendCommand("/audit", op, room, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Err: must be op"+message.Newline)
+
+	member.SetRole(RoleModerator)
+	if err := sendCommand("/audit", op, room, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> No audit entries."+message.Newline)
+
+	if err := sendCommand("/slowmode 5s", op, room, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, " * Slow mode set to 5s by op."+message.Newline)
+
+	entries := room.Audit.Query(1, "")
+	if len(entries) != 1 || entries[0].Action != "slowmode" {
+		t.Fatalf("expected slow mode to be audited, got: %v", entries)
+	}
+	if err := sendCommand("/audit 5 op", op, room, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Audit log:"+message.Newline+"   "+entries[0].String()+message.Newline)
+}
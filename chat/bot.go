@@ -0,0 +1,196 @@
+package chat
+
+import (
+	"errors"
+
+	"github.com/shazow/ssh-chat/chat/message"
+)
+
+// ErrNotCommand is the error returned when a bot runs a line which isn't a
+// command.
+var ErrNotCommand = errors.New("not a command")
+
+// Bot is a member of a room which runs in-process, without an SSH connection.
+// It gets the messages sent to it as events, and responds through its
+// BotSession.
+type Bot interface {
+	// Name is the name the bot joins the room with.
+	Name() string
+
+	// Handle is called with each event, one at a time and in order. Events
+	// are dropped while it's too far behind, so it shouldn't block for long.
+	Handle(s *BotSession, event BotEvent)
+}
+
+// BotEvent is an event a bot handles: a MessageEvent, EmoteEvent,
+// AnnounceEvent or SystemEvent.
+type BotEvent interface {
+	botEvent()
+}
+
+// MessageEvent is a message sent to the room, or privately to the bot.
+type MessageEvent struct {
+	From    *message.User
+	Body    string
+	Private bool
+}
+
+// EmoteEvent is an emote in the room, like /me waves.
+type EmoteEvent struct {
+	From *message.User
+	Body string
+}
+
+// AnnounceEvent is an announcement to the room, like a user joining.
+type AnnounceEvent struct {
+	Body string
+}
+
+// SystemEvent is a response to the bot, like the error of a command it ran.
+type SystemEvent struct {
+	Body string
+}
+
+func (MessageEvent) botEvent()  {}
+func (EmoteEvent) botEvent()    {}
+func (AnnounceEvent) botEvent() {}
+func (SystemEvent) botEvent()   {}
+
+// BotSession is a bot's membership of a room, which it acts through.
+type BotSession struct {
+	Room *Room
+	User *message.User
+
+	done chan struct{}
+}
+
+// Done is closed once the bot has left the room, like when it's kicked or the
+// room is closed.
+func (s *BotSession) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *BotSession) send(m message.Message) {
+	select {
+	case <-s.done:
+	default:
+		s.Room.Send(m)
+	}
+}
+
+// Say sends a message to the room.
+func (s *BotSession) Say(body string) {
+	s.send(message.NewPublicMsg(body, s.User))
+}
+
+// Emote sends an emote to the room, like /me does.
+func (s *BotSession) Emote(body string) {
+	s.send(message.NewEmoteMsg(body, s.User))
+}
+
+// Reply sends a private message to a user.
+func (s *BotSession) Reply(to *message.User, body string) {
+	m := message.NewPrivateMsg(body, s.User, to)
+	s.send(&m)
+	to.SetReplyTo(s.User)
+}
+
+// Respond answers a message where it was sent: privately to its sender if it
+// was private, or to the room.
+func (s *BotSession) Respond(e MessageEvent, body string) {
+	if e.Private {
+		s.Reply(e.From, body)
+		return
+	}
+	s.Say(body)
+}
+
+// Command runs a command line like "/topic hello" as the bot. Its output and
+// errors come back as SystemEvents.
+func (s *BotSession) Command(line string) error {
+	cmd, ok := message.NewPublicMsg(line, s.User).ParseCommand()
+	if !ok {
+		return ErrNotCommand
+	}
+	s.send(cmd)
+	return nil
+}
+
+// JoinBot joins bot to the room as a guest with the identity id, usually
+// message.SimpleID(bot.Name()), and runs it in a goroutine until it leaves.
+func (r *Room) JoinBot(bot Bot, id message.Identifier) (*BotSession, error) {
+	u := message.NewUser(id)
+	if _, err := r.Join(u); err != nil {
+		return nil, err
+	}
+	s := &BotSession{Room: r, User: u, done: make(chan struct{})}
+	go s.run(bot)
+	return s, nil
+}
+
+// botQueueLen is how many events can wait for a bot to handle them, before
+// more are dropped.
+const botQueueLen = 100
+
+// run hands the events queued by receive to the bot, until it leaves.
+func (s *BotSession) run(bot Bot) {
+	events := make(chan BotEvent, botQueueLen)
+	go s.receive(events)
+	for event := range events {
+		select {
+		case <-s.done:
+			// Left with events still queued.
+			continue
+		default:
+		}
+		bot.Handle(s, event)
+	}
+}
+
+// receive queues the events for the messages the bot receives, skipping its
+// own and the history sent when it joined, until its user is closed. It
+// doesn't wait for the bot, which may be waiting on the room, so the room
+// isn't held up delivering to it: events are dropped while the queue is full.
+func (s *BotSession) receive(events chan<- BotEvent) {
+	defer close(events)
+	for {
+		m, ok := s.User.Receive()
+		if !ok {
+			s.Room.Leave(s.User)
+			close(s.done)
+			return
+		}
+		if m.Timestamp().Before(s.User.Joined()) {
+			continue
+		}
+		event := s.event(m)
+		if event == nil {
+			continue
+		}
+		select {
+		case events <- event:
+		default:
+			logger.Printf("Bot %s is behind, dropped an event", s.User.Name())
+		}
+	}
+}
+
+// event returns the event for a message, or nil if the bot doesn't handle it.
+func (s *BotSession) event(m message.Message) BotEvent {
+	if from, ok := m.(message.MessageFrom); ok && from.From() == s.User {
+		return nil
+	}
+	switch m := m.(type) {
+	case message.PublicMsg:
+		return MessageEvent{From: m.From(), Body: m.Body()}
+	case *message.PrivateMsg:
+		return MessageEvent{From: m.From(), Body: m.Body(), Private: true}
+	case *message.EmoteMsg:
+		return EmoteEvent{From: m.From(), Body: m.Body()}
+	case *message.AnnounceMsg:
+		return AnnounceEvent{Body: m.Body()}
+	case *message.SystemMsg:
+		return SystemEvent{Body: m.Body()}
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package chat
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shazow/ssh-chat/chat/message"
+)
+
+// receiveMsgs passes on the messages u receives, until it's closed.
+func receiveMsgs(u *message.User) <-chan message.Message {
+	msgs := make(chan message.Message, 100)
+	go func() {
+		defer close(msgs)
+		for {
+			m, ok := u.Receive()
+			if !ok {
+				return
+			}
+			msgs <- m
+		}
+	}()
+	return msgs
+}
+
+// expectMsg takes messages until one contains want.
+func expectMsg(t *testing.T, msgs <-chan message.Message, want string) {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case m := <-msgs:
+			if strings.Contains(m.String(), want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no message containing %q", want)
+		}
+	}
+}
+
+func TestBots(t *testing.T) {
+	r := NewRoom()
+	go r.Serve()
+	defer r.Close()
+
+	alice := message.NewUser(message.SimpleID("alice"))
+	if _, err := r.Join(alice); err != nil {
+		t.Fatal(err)
+	}
+	msgs := receiveMsgs(alice)
+	dice := &diceBot{intn: func(n int) int { return n - 1 }}
+	for _, bot := range []Bot{dice, NewKarmaBot(), NewRemindBot()} {
+		if _, err := r.JoinBot(bot, message.SimpleID(bot.Name())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r.Send(message.NewPublicMsg("!roll 2d6", alice))
+	expectMsg(t, msgs, "dicebot: alice rolled 2d6: 12 (6 + 6)")
+	r.Send(message.NewPublicMsg("!roll 0d6", alice))
+	expectMsg(t, msgs, "dicebot: alice: dice must be at most 100d1000, like 2d6")
+
+	r.Send(message.NewPublicMsg("go++ and go++", alice))
+	expectMsg(t, msgs, "karmabot: go has 1 karma.")
+	r.Send(message.NewPublicMsg("alice++", alice))
+	expectMsg(t, msgs, "karmabot: alice: You can't change your own karma.")
+	r.Send(message.NewPublicMsg("!karma GO", alice))
+	expectMsg(t, msgs, "karmabot: go has 1 karma.")
+	// One reply per message, for up to maxKarmaChanges things.
+	r.Send(message.NewPublicMsg("a++ b-- alice++ c++ d++ e++ f++", alice))
+	expectMsg(t, msgs, "karmabot: a has 1 karma, b has -1 karma, c has 1 karma, d has 1 karma. alice: You can't change your own karma.")
+	r.Send(message.NewPublicMsg("!karma f", alice))
+	expectMsg(t, msgs, "karmabot: f has 0 karma.")
+
+	remind, ok := r.MemberByID("remindbot")
+	if !ok {
+		t.Fatal("remindbot didn't join")
+	}
+	pm := message.NewPrivateMsg(`!remind 10ms "tea"  at 5`, alice, remind.User)
+	r.Send(&pm)
+	expectMsg(t, msgs, "[PM from remindbot] alice: I'll remind you in 10ms.")
+	expectMsg(t, msgs, `[PM from remindbot] Reminder: "tea"  at 5`)
+}
+
+func TestKarmaBotFull(t *testing.T) {
+	r := NewRoom()
+	go r.Serve()
+	defer r.Close()
+
+	alice := message.NewUser(message.SimpleID("alice"))
+	if _, err := r.Join(alice); err != nil {
+		t.Fatal(err)
+	}
+	msgs := receiveMsgs(alice)
+	karma := &karmaBot{karma: map[string]int{"old": 1}}
+	for i := len(karma.karma); i < maxKarmaThings; i++ {
+		karma.karma[strconv.Itoa(i)] = 1
+	}
+	if _, err := r.JoinBot(karma, message.SimpleID(karma.Name())); err != nil {
+		t.Fatal(err)
+	}
+
+	// New things aren't counted once it's full, but known ones are.
+	r.Send(message.NewPublicMsg("new++ old++", alice))
+	expectMsg(t, msgs, "karmabot: old has 2 karma.")
+	r.Send(message.NewPublicMsg("!karma new", alice))
+	expectMsg(t, msgs, "karmabot: new has 0 karma.")
+}
+
+// blockBot blocks handling events until it's closed.
+type blockBot chan struct{}
+
+func (b blockBot) Name() string                         { return "blockbot" }
+func (b blockBot) Handle(s *BotSession, event BotEvent) { <-b }
+
+func TestBotBehind(t *testing.T) {
+	r := NewRoom()
+	go r.Serve()
+	defer r.Close()
+
+	alice := message.NewUser(message.SimpleID("alice"))
+	if _, err := r.Join(alice); err != nil {
+		t.Fatal(err)
+	}
+	msgs := receiveMsgs(alice)
+	bot := make(blockBot)
+	s, err := r.JoinBot(bot, message.SimpleID(bot.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More than the bot's user and queue can hold, while it's stuck.
+	n := botQueueLen * 3
+	for i := 0; i < n; i++ {
+		r.Send(message.NewPublicMsg(strconv.Itoa(i), alice))
+	}
+	// Messages are delivered out of order, so they're only counted.
+	timeout := time.After(time.Second)
+	for received := 0; received < n; {
+		select {
+		case m := <-msgs:
+			if _, ok := m.(message.PublicMsg); ok {
+				received++
+			}
+		case <-timeout:
+			t.Fatalf("alice got %d of %d messages", received, n)
+		}
+	}
+	close(bot)
+
+	// It drops events rather than being closed for not keeping up.
+	select {
+	case <-s.Done():
+		t.Fatal("bot was closed")
+	default:
+	}
+	if _, ok := r.MemberByID(bot.Name()); !ok {
+		t.Error("bot left the room")
+	}
+}
+
+// recordBot passes on the events it handles.
+type recordBot chan BotEvent
+
+func (b recordBot) Name() string                         { return "recordbot" }
+func (b recordBot) Handle(s *BotSession, event BotEvent) { b <- event }
+
+func TestBotSession(t *testing.T) {
+	r := NewRoom()
+	go r.Serve()
+	defer r.Close()
+
+	alice := message.NewUser(message.SimpleID("alice"))
+	if _, err := r.Join(alice); err != nil {
+		t.Fatal(err)
+	}
+	msgs := receiveMsgs(alice)
+	// Said before the bot joined, so it's only in the history.
+	r.Send(message.NewPublicMsg("before", alice))
+	expectMsg(t, msgs, "alice: before")
+
+	events := make(recordBot, 10)
+	s, err := r.JoinBot(events, message.SimpleID("recordbot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Send(message.NewPublicMsg("after", alice))
+	timeout := time.After(time.Second)
+	for received := false; !received; {
+		select {
+		case event := <-events:
+			if _, ok := event.(AnnounceEvent); ok {
+				continue
+			}
+			want := MessageEvent{From: alice, Body: "after"}
+			if event != want {
+				t.Errorf("got: %#v; want: %#v", event, want)
+			}
+			received = true
+		case <-timeout:
+			t.Fatal("bot didn't get the message")
+		}
+	}
+
+	if err := s.Command("hello"); err != ErrNotCommand {
+		t.Errorf("got: %v; want: %v", err, ErrNotCommand)
+	}
+	if err := s.Command("/topic dice"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for r.Topic() != "dice" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := r.Topic(); got != "dice" {
+		t.Errorf("got topic: %q; want: %q", got, "dice")
+	}
+
+	// Closing the bot's user, like kicking it, makes it leave.
+	s.User.Close()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("bot didn't stop")
+	}
+	if _, ok := r.MemberByID("recordbot"); ok {
+		t.Error("bot didn't leave the room")
+	}
+}
@@ -0,0 +1,266 @@
+package chat
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/shazow/ssh-chat/chat/message"
+)
+
+const (
+	// maxReminders is how many reminders a user can have pending.
+	maxReminders = 5
+	// maxRemindDelay is how far ahead a reminder can be set.
+	maxRemindDelay = 24 * time.Hour
+
+	// maxDice and maxDieSides limit a roll of the dice.
+	maxDice     = 100
+	maxDieSides = 1000
+
+	// maxKarmaChanges is how many things one message can give karma to.
+	maxKarmaChanges = 5
+	// maxKarmaThings is how many things the karma bot keeps score of.
+	maxKarmaThings = 10000
+)
+
+// botCommand returns the arguments of a message like "!roll 2d6" to a bot,
+// and whether the message is that command.
+func botCommand(body, command string) ([]string, bool) {
+	fields := strings.Fields(body)
+	if len(fields) == 0 || fields[0] != command {
+		return nil, false
+	}
+	return fields[1:], true
+}
+
+// botRest returns the raw text of a message after its first n fields, like
+// CommandMsg.Rest, so that free text keeps its spacing and quotes.
+func botRest(body string, n int) string {
+	rest := strings.TrimLeftFunc(body, unicode.IsSpace)
+	for i := 0; i < n; i++ {
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			return ""
+		}
+		rest = strings.TrimLeftFunc(rest[end:], unicode.IsSpace)
+	}
+	return strings.TrimSpace(rest)
+}
+
+// remindBot privately reminds users of something after a while, when asked
+// with: !remind 10m stand up
+type remindBot struct {
+	mu      sync.Mutex
+	pending map[*message.User]int // Reminders pending by user
+}
+
+// NewRemindBot returns a bot which reminds users of something after a while,
+// when asked with: !remind DURATION MESSAGE
+func NewRemindBot() Bot {
+	return &remindBot{pending: map[*message.User]int{}}
+}
+
+func (b *remindBot) Name() string {
+	return "remindbot"
+}
+
+func (b *remindBot) Handle(s *BotSession, event BotEvent) {
+	e, ok := event.(MessageEvent)
+	if !ok {
+		return
+	}
+	args, ok := botCommand(e.Body, "!remind")
+	if !ok {
+		return
+	}
+	if len(args) < 2 {
+		s.Respond(e, "Usage: !remind DURATION MESSAGE, like !remind 10m stand up")
+		return
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil || d <= 0 || d > maxRemindDelay {
+		s.Respond(e, fmt.Sprintf("%s: DURATION must be like 10m, and at most %s.", e.From.Name(), maxRemindDelay))
+		return
+	}
+
+	b.mu.Lock()
+	if b.pending[e.From] >= maxReminders {
+		b.mu.Unlock()
+		s.Respond(e, fmt.Sprintf("%s: You already have %d reminders pending.", e.From.Name(), maxReminders))
+		return
+	}
+	b.pending[e.From]++
+	b.mu.Unlock()
+
+	// After !remind and the duration.
+	reminder := botRest(e.Body, 2)
+	time.AfterFunc(d, func() {
+		b.mu.Lock()
+		if b.pending[e.From]--; b.pending[e.From] <= 0 {
+			delete(b.pending, e.From)
+		}
+		b.mu.Unlock()
+		s.Reply(e.From, "Reminder: "+reminder)
+	})
+	s.Respond(e, fmt.Sprintf("%s: I'll remind you in %s.", e.From.Name(), d))
+}
+
+// diceBot rolls dice when asked with: !roll 2d6
+type diceBot struct {
+	intn func(n int) int // Returns a random number in [0, n)
+}
+
+// NewDiceBot returns a bot which rolls dice when asked with: !roll [NdM],
+// which defaults to one six-sided die.
+func NewDiceBot() Bot {
+	return &diceBot{intn: rand.Intn}
+}
+
+func (b *diceBot) Name() string {
+	return "dicebot"
+}
+
+// parseDice parses dice like 2d6, or d20 for one die.
+func parseDice(s string) (count, sides int, err error) {
+	parts := strings.SplitN(strings.ToLower(s), "d", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid dice: %q", s)
+	}
+	count = 1
+	if parts[0] != "" {
+		if count, err = strconv.Atoi(parts[0]); err != nil {
+			return 0, 0, fmt.Errorf("invalid dice: %q", s)
+		}
+	}
+	if sides, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, fmt.Errorf("invalid dice: %q", s)
+	}
+	if count < 1 || count > maxDice || sides < 2 || sides > maxDieSides {
+		return 0, 0, fmt.Errorf("dice must be at most %dd%d", maxDice, maxDieSides)
+	}
+	return count, sides, nil
+}
+
+func (b *diceBot) Handle(s *BotSession, event BotEvent) {
+	e, ok := event.(MessageEvent)
+	if !ok {
+		return
+	}
+	args, ok := botCommand(e.Body, "!roll")
+	if !ok {
+		return
+	}
+	dice := "1d6"
+	if len(args) > 0 {
+		dice = args[0]
+	}
+	count, sides, err := parseDice(dice)
+	if err != nil {
+		s.Respond(e, fmt.Sprintf("%s: %s, like 2d6", e.From.Name(), err))
+		return
+	}
+
+	rolls := make([]string, 0, count)
+	total := 0
+	for i := 0; i < count; i++ {
+		roll := b.intn(sides) + 1
+		total += roll
+		rolls = append(rolls, strconv.Itoa(roll))
+	}
+	body := fmt.Sprintf("%s rolled %dd%d: %d", e.From.Name(), count, sides, total)
+	if count > 1 {
+		body += " (" + strings.Join(rolls, " + ") + ")"
+	}
+	s.Respond(e, body)
+}
+
+// karmaBot keeps score of the karma users give to things with thing++ and
+// thing--, and tells it when asked with: !karma thing. It answers each
+// message once, for up to maxKarmaChanges things, and stops counting new
+// things once it has maxKarmaThings.
+type karmaBot struct {
+	karma map[string]int // Only used by Handle, which isn't concurrent.
+}
+
+// NewKarmaBot returns a bot which keeps score of karma given with thing++ and
+// thing--, and tells it when asked with: !karma THING
+func NewKarmaBot() Bot {
+	return &karmaBot{karma: map[string]int{}}
+}
+
+func (b *karmaBot) Name() string {
+	return "karmabot"
+}
+
+func (b *karmaBot) Handle(s *BotSession, event BotEvent) {
+	e, ok := event.(MessageEvent)
+	if !ok {
+		return
+	}
+	if args, ok := botCommand(e.Body, "!karma"); ok {
+		if len(args) != 1 {
+			s.Respond(e, "Usage: !karma THING")
+			return
+		}
+		thing := strings.ToLower(args[0])
+		s.Respond(e, fmt.Sprintf("%s has %d karma.", thing, b.karma[thing]))
+		return
+	}
+
+	// Changes are answered together, so a message can't make the bot flood
+	// the room.
+	var scores []string
+	var own bool
+	changed := map[string]bool{}
+	for _, field := range strings.Fields(e.Body) {
+		if len(changed) >= maxKarmaChanges {
+			break
+		}
+		if len(field) < 3 {
+			continue
+		}
+		var delta int
+		switch field[len(field)-2:] {
+		case "++":
+			delta = 1
+		case "--":
+			delta = -1
+		default:
+			continue
+		}
+		thing := strings.ToLower(field[:len(field)-2])
+		if changed[thing] {
+			continue
+		}
+		changed[thing] = true
+		if thing == strings.ToLower(e.From.ID()) {
+			own = true
+			continue
+		}
+		if _, ok := b.karma[thing]; !ok && len(b.karma) >= maxKarmaThings {
+			continue
+		}
+		b.karma[thing] += delta
+		scores = append(scores, fmt.Sprintf("%s has %d karma", thing, b.karma[thing]))
+		if b.karma[thing] == 0 {
+			// Back to where it started, so there's no need to remember it.
+			delete(b.karma, thing)
+		}
+	}
+
+	var reply []string
+	if len(scores) > 0 {
+		reply = append(reply, strings.Join(scores, ", ")+".")
+	}
+	if own {
+		reply = append(reply, fmt.Sprintf("%s: You can't change your own karma.", e.From.Name()))
+	}
+	if len(reply) > 0 {
+		s.Respond(e, strings.Join(reply, " "))
+	}
+}
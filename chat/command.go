@@ -1,11 +1,10 @@
 package chat
 
-// FIXME: Would be sweet if we could piggyback on a cli parser or something.
-
 import (
 	"errors"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,15 +26,55 @@ var ErrMissingArg = errors.New("missing argument")
 // ErrMissingPrefix is the error returned when a command is added without a prefix.
 var ErrMissingPrefix = errors.New("command missing prefix")
 
+// ErrMissingHandler is the error returned when a command is added without a
+// Handler or Run.
+var ErrMissingHandler = errors.New("command missing handler")
+
+// ErrFixedName is the error returned when a user whose name is forced by their
+// key tries to change it.
+var ErrFixedName = errors.New("name is set by your key and can't be changed")
+
+// ErrNameReserved is the error returned when a user tries to take a name
+// reserved for someone else.
+var ErrNameReserved = errors.New("name is reserved for someone else")
+
+// fixedNamer is implemented by identities whose name can be forced, so that
+// the user can't change it.
+type fixedNamer interface {
+	FixedName() bool
+}
+
 // Command is a definition of a handler for a command.
 type Command struct {
 	Prefix     string // The command's key, such as /foo
-	PrefixHelp string // Extra help regarding arguments
+	PrefixHelp string // Extra help regarding arguments, generated from Args if omitted
 	Help       string // help text, if omitted, command is hidden from /help
-	Op         bool   // does the command require Op permissions?
+
+	// Category groups the command in /help. Commands without one are listed
+	// as available or operator commands, by their Capability.
+	Category string
+
+	// Capability required to run the command, CapNone if anyone can.
+	Capability Capability
+
+	// Op requires the command to be run by an op.
+	//
+	// Deprecated: Use Capability, which Op sets to CapModerate if it's
+	// CapNone.
+	Op bool
 
 	// Handler for the command
 	Handler func(*Room, message.CommandMsg) error
+
+	// Args are parsed and checked before Run is called, which is used
+	// instead of Handler if it's set.
+	Args []Arg
+	Run  func(*Room, message.CommandMsg, Args) error
+
+	// Complete returns the candidates to complete the last of args, which
+	// may be partial, for tab completion. Without it, ArgUser arguments are
+	// completed with the names of members.
+	Complete func(room *Room, from *message.User, args []string) []string
 }
 
 // Commands is a registry of available commands.
@@ -47,6 +86,20 @@ func (c Commands) Add(cmd Command) error {
 	if cmd.Prefix == "" {
 		return ErrMissingPrefix
 	}
+	if cmd.Handler == nil && cmd.Run == nil {
+		return ErrMissingHandler
+	}
+	for i, arg := range cmd.Args {
+		if arg.Type == ArgRest && i != len(cmd.Args)-1 {
+			return fmt.Errorf("%s: only the last argument can be %s", cmd.Prefix, arg.Name+"...")
+		}
+	}
+	if cmd.PrefixHelp == "" {
+		cmd.PrefixHelp = cmd.argsHelp()
+	}
+	if cmd.Op && cmd.Capability == CapNone {
+		cmd.Capability = CapModerate
+	}
 
 	c[cmd.Prefix] = &cmd
 	return nil
@@ -72,26 +125,58 @@ func (c Commands) Run(room *Room, msg message.CommandMsg) error {
 	if !ok {
 		return ErrInvalidCommand
 	}
+	if !room.Can(msg.From(), cmd.Capability) {
+		var role Role
+		if m, ok := room.Member(msg.From()); ok {
+			role = m.Role()
+		}
+		return room.Permissions.required(role, cmd.Capability)
+	}
 
-	return cmd.Handler(room, msg)
+	if cmd.Run == nil {
+		return cmd.Handler(room, msg)
+	}
+	args, err := cmd.parseArgs(room, msg)
+	if err != nil {
+		if cmd.PrefixHelp != "" {
+			err = fmt.Errorf("%w, usage: %s %s", err, cmd.Prefix, cmd.PrefixHelp)
+		}
+		return err
+	}
+	return cmd.Run(room, msg, args)
 }
 
-// Help will return collated help text as one string.
-func (c Commands) Help(showOp bool) string {
-	// Filter by op
+// Help will return collated help text as one string, including only the
+// commands allowed by can.
+func (c Commands) Help(can func(Capability) bool) string {
+	// Filter by capability
 	op := []*Command{}
 	normal := []*Command{}
+	categories := map[string][]*Command{}
 	for _, cmd := range c {
-		if cmd.Op {
-			op = append(op, cmd)
-		} else {
+		if cmd.Capability != CapNone && !can(cmd.Capability) {
+			continue
+		}
+		if cmd.Category != "" {
+			categories[cmd.Category] = append(categories[cmd.Category], cmd)
+		} else if cmd.Capability == CapNone {
 			normal = append(normal, cmd)
+		} else {
+			op = append(op, cmd)
 		}
 	}
 	help := "Available commands:" + message.Newline + NewCommandsHelp(normal).String()
-	if showOp {
+	if len(op) > 0 {
 		help += message.Newline + "-> Operator commands:" + message.Newline + NewCommandsHelp(op).String()
 	}
+	names := make([]string, 0, len(categories))
+	for name := range categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		help += message.Newline + "-> " + name + " commands:" + message.Newline + NewCommandsHelp(categories[name]).String()
+	}
 	return help
 }
 
@@ -99,6 +184,8 @@ var timeformatDatetime = "2006-01-02 15:04:05"
 
 var timeformatTime = "15:04"
 
+var timeformatTopic = "2006-01-02 15:04 MST"
+
 var defaultCommands *Commands
 
 func init() {
@@ -111,8 +198,8 @@ func InitCommands(c *Commands) {
 	c.Add(Command{
 		Prefix: "/help",
 		Handler: func(room *Room, msg message.CommandMsg) error {
-			op := room.IsOp(msg.From())
-			room.Send(message.NewSystemMsg(room.commands.Help(op), msg.From()))
+			can := func(c Capability) bool { return room.Can(msg.From(), c) }
+			room.Send(message.NewSystemMsg(room.commands.Help(can), msg.From()))
 			return nil
 		},
 	})
@@ -120,11 +207,9 @@ func InitCommands(c *Commands) {
 	c.Add(Command{
 		Prefix: "/me",
 		Handler: func(room *Room, msg message.CommandMsg) error {
-			me := strings.TrimLeft(msg.Body(), "/me")
+			me := msg.Rest(0)
 			if me == "" {
 				me = "is at a loss for words."
-			} else {
-				me = me[1:]
 			}
 
 			room.Send(message.NewEmoteMsg(me, msg.From()))
@@ -152,6 +237,9 @@ func InitCommands(c *Commands) {
 				return ErrMissingArg
 			}
 			u := msg.From()
+			if fixed, ok := u.Identifier.(fixedNamer); ok && fixed.FixedName() {
+				return ErrFixedName
+			}
 
 			member, ok := room.MemberByID(u.ID())
 			if !ok {
@@ -163,6 +251,9 @@ func InitCommands(c *Commands) {
 			if newID == oldID {
 				return errors.New("new name is the same as the original")
 			}
+			if room.NameReserved != nil && room.NameReserved(newID, u) {
+				return ErrNameReserved
+			}
 			member.SetID(newID)
 			err := room.Rename(oldID, member)
 			if err != nil {
@@ -196,13 +287,74 @@ func InitCommands(c *Commands) {
 				colNames[i] = colorize(uname.Value().(*Member).User)
 			}
 
-			body := fmt.Sprintf("%d connected: %s", len(colNames), strings.Join(colNames, ", "))
+			mode := ""
+			if room.Moderated() {
+				mode = " (moderated)"
+			}
+			body := fmt.Sprintf("%d connected%s: %s", len(colNames), mode, strings.Join(colNames, ", "))
 			room.Send(message.NewSystemMsg(body, msg.From()))
 			return nil
 		},
 	})
 	c.Alias("/names", "/list")
 
+	c.Add(Command{
+		Prefix:     "/topic",
+		PrefixHelp: "[TEXT]",
+		Help:       "Set the room's topic to TEXT, or show it if no TEXT.",
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			args := msg.Args()
+			if len(args) == 0 {
+				body := room.TopicDescription()
+				if body == "" {
+					body = "No topic is set."
+				}
+				room.Send(message.NewSystemMsg(body, msg.From()))
+				return nil
+			}
+			if room.TopicOpsOnly() && !room.Can(msg.From(), CapModerate) {
+				return errors.New("must be op to change the topic")
+			}
+
+			topic := msg.Rest(0)
+			room.SetTopicBy(topic, msg.From().Name())
+			body := fmt.Sprintf("%s set the topic at %s: %s", msg.From().Name(), time.Now().UTC().Format(timeformatTopic), topic)
+			room.Send(message.NewAnnounceMsg(body))
+			return nil
+		},
+	})
+
+	c.Add(Command{
+		Capability: CapModerate,
+		Prefix:     "/topiclock",
+		PrefixHelp: "[on|off]",
+		Help:       "Show or set whether only ops can change the topic.",
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			args := msg.Args()
+			if len(args) == 0 {
+				body := "Anyone can change the topic."
+				if room.TopicOpsOnly() {
+					body = "Only ops can change the topic."
+				}
+				room.Send(message.NewSystemMsg(body, msg.From()))
+				return nil
+			}
+
+			switch args[0] {
+			case "on":
+				room.SetTopicOpsOnly(true)
+				room.Send(message.NewSystemMsg("Only ops can change the topic.", msg.From()))
+			case "off":
+				room.SetTopicOpsOnly(false)
+				room.Send(message.NewSystemMsg("Anyone can change the topic.", msg.From()))
+			default:
+				return errors.New("must be on or off")
+			}
+			room.Audit.Record(msg.From(), "topiclock", "", args[0])
+			return nil
+		},
+	})
+
 	c.Add(Command{
 		Prefix:     "/theme",
 		PrefixHelp: "[colors|...]",
@@ -242,6 +394,16 @@ func InitCommands(c *Commands) {
 			}
 			return errors.New("theme not found")
 		},
+		Complete: func(room *Room, from *message.User, args []string) []string {
+			if len(args) != 1 {
+				return nil
+			}
+			themes := make([]string, 0, len(message.Themes))
+			for _, t := range message.Themes {
+				themes = append(themes, t.ID())
+			}
+			return themes
+		},
 	})
 
 	c.Add(Command{
@@ -291,8 +453,8 @@ func InitCommands(c *Commands) {
 
 	c.Add(Command{
 		Prefix:     "/timestamp",
-		PrefixHelp: "[time|datetime]",
-		Help:       "Prefix messages with a timestamp. You can also provide the UTC offset: /timestamp time +5h45m",
+		PrefixHelp: "[time|datetime] [OFFSET|ZONE]",
+		Help:       "Prefix messages with a timestamp. You can also provide the UTC offset or time zone: /timestamp time +5h45m, /timestamp time Europe/Berlin",
 		Handler: func(room *Room, msg message.CommandMsg) error {
 			u := msg.From()
 			cfg := u.Config()
@@ -306,11 +468,13 @@ func InitCommands(c *Commands) {
 				// FIXME: This is an annoying format to demand from users, but
 				// hopefully we can make it a non-primary flow if we add GeoIP
 				// someday.
-				offset, err := time.ParseDuration(args[1])
-				if err != nil {
-					return err
+				if offset, err := time.ParseDuration(args[1]); err == nil {
+					cfg.Timezone = time.FixedZone("", int(offset.Seconds()))
+				} else if loc, err := time.LoadLocation(args[1]); err == nil && args[1] != "" && args[1] != "Local" {
+					cfg.Timezone = loc
+				} else {
+					return fmt.Errorf("invalid UTC offset or time zone: %q", args[1])
 				}
-				cfg.Timezone = time.FixedZone("", int(offset.Seconds()))
 			}
 
 			switch mode {
@@ -347,6 +511,15 @@ func InitCommands(c *Commands) {
 			room.Send(message.NewSystemMsg(body, u))
 			return nil
 		},
+		Complete: func(room *Room, from *message.User, args []string) []string {
+			switch len(args) {
+			case 1:
+				return []string{"time", "datetime", "off"}
+			case 2:
+				return Timezones()
+			}
+			return nil
+		},
 	})
 
 	c.Add(Command{
@@ -354,8 +527,8 @@ func InitCommands(c *Commands) {
 		PrefixHelp: "[USER]",
 		Help:       "Hide messages from USER, /unignore USER to stop hiding.",
 		Handler: func(room *Room, msg message.CommandMsg) error {
-			id := strings.TrimSpace(strings.TrimLeft(msg.Body(), "/ignore"))
-			if id == "" {
+			args := msg.Args()
+			if len(args) == 0 {
 				// Print ignored names, if any.
 				var names []string
 				msg.From().Ignored.Each(func(_ string, item set.Item) error {
@@ -374,6 +547,7 @@ func InitCommands(c *Commands) {
 				return nil
 			}
 
+			id := args[0]
 			if id == msg.From().ID() {
 				return errors.New("cannot ignore self")
 			}
@@ -398,10 +572,11 @@ func InitCommands(c *Commands) {
 		Prefix:     "/unignore",
 		PrefixHelp: "USER",
 		Handler: func(room *Room, msg message.CommandMsg) error {
-			id := strings.TrimSpace(strings.TrimLeft(msg.Body(), "/unignore"))
-			if id == "" {
+			args := msg.Args()
+			if len(args) == 0 {
 				return errors.New("must specify user")
 			}
+			id := args[0]
 
 			if err := msg.From().Ignored.Remove(id); err != nil {
 				return err
@@ -417,8 +592,8 @@ func InitCommands(c *Commands) {
 		PrefixHelp: "[USER ...]",
 		Help:       "Only show messages from focused users, or $ to reset.",
 		Handler: func(room *Room, msg message.CommandMsg) error {
-			ids := strings.TrimSpace(strings.TrimLeft(msg.Body(), "/focus"))
-			if ids == "" {
+			args := msg.Args()
+			if len(args) == 0 {
 				// Print focused names, if any.
 				var names []string
 				msg.From().Focused.Each(func(_ string, item set.Item) error {
@@ -438,13 +613,13 @@ func InitCommands(c *Commands) {
 			}
 
 			n := msg.From().Focused.Clear()
-			if ids == "$" {
+			if len(args) == 1 && args[0] == "$" {
 				room.Send(message.NewSystemMsg(fmt.Sprintf("Removed focus from %d users.", n), msg.From()))
 				return nil
 			}
 
 			var focused []string
-			for _, name := range strings.Split(ids, " ") {
+			for _, name := range args {
 				id := sanitize.Name(name)
 				if id == "" {
 					continue // Skip
@@ -464,7 +639,7 @@ func InitCommands(c *Commands) {
 		PrefixHelp: "[REASON]",
 		Help:       "Set away reason, or empty to unset.",
 		Handler: func(room *Room, msg message.CommandMsg) error {
-			awayMsg := strings.TrimSpace(strings.TrimLeft(msg.Body(), "/away"))
+			awayMsg := msg.Rest(0)
 			isAway, _, _ := msg.From().GetAway()
 			msg.From().SetAway(awayMsg)
 			if awayMsg != "" {
@@ -494,15 +669,11 @@ func InitCommands(c *Commands) {
 	})
 
 	c.Add(Command{
-		Op:         true,
+		Capability: CapModerate,
 		Prefix:     "/mute",
 		PrefixHelp: "USER",
 		Help:       "Toggle muting USER, preventing messages from broadcasting.",
 		Handler: func(room *Room, msg message.CommandMsg) error {
-			if !room.IsOp(msg.From()) {
-				return errors.New("must be op")
-			}
-
 			args := msg.Args()
 			if len(args) == 0 {
 				return errors.New("must specify user")
@@ -518,12 +689,260 @@ func InitCommands(c *Commands) {
 			id := member.ID()
 
 			if setMute {
+				room.Audit.Record(msg.From(), "mute", id)
 				room.Send(message.NewSystemMsg("Muted: "+id, msg.From()))
 			} else {
+				room.Audit.Record(msg.From(), "unmute", id)
 				room.Send(message.NewSystemMsg("Unmuted: "+id, msg.From()))
 			}
 
 			return nil
 		},
 	})
+
+	c.Add(Command{
+		Capability: CapModerate,
+		Prefix:     "/moderated",
+		PrefixHelp: "[on|off]",
+		Help:       "Show or set whether only ops and voiced users can speak.",
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			args := msg.Args()
+			if len(args) == 0 {
+				body := "Room is not moderated."
+				if room.Moderated() {
+					body = "Room is moderated."
+				}
+				room.Send(message.NewSystemMsg(body, msg.From()))
+				return nil
+			}
+
+			var moderated bool
+			switch args[0] {
+			case "on":
+				moderated = true
+			case "off":
+				moderated = false
+			default:
+				return errors.New("must be on or off")
+			}
+			room.SetModerated(moderated)
+			room.Audit.Record(msg.From(), "moderated", "", args[0])
+
+			body := fmt.Sprintf("Room is no longer moderated, turned off by %s.", msg.From().Name())
+			if moderated {
+				body = fmt.Sprintf("Room is now moderated by %s, only ops and voiced users can speak.", msg.From().Name())
+			}
+			room.Send(message.NewAnnounceMsg(body))
+			return nil
+		},
+	})
+
+	c.Add(Command{
+		Capability: CapModerate,
+		Prefix:     "/inviteonly",
+		PrefixHelp: "[on|off]",
+		Help:       "Show or set whether only ops and invited users can join.",
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			args := msg.Args()
+			if len(args) == 0 {
+				body := "Room is open to everyone."
+				if room.InviteOnly() {
+					body = "Room is invite-only."
+				}
+				room.Send(message.NewSystemMsg(body, msg.From()))
+				return nil
+			}
+
+			var inviteOnly bool
+			switch args[0] {
+			case "on":
+				inviteOnly = true
+			case "off":
+				inviteOnly = false
+			default:
+				return errors.New("must be on or off")
+			}
+			room.SetInviteOnly(inviteOnly)
+			room.Audit.Record(msg.From(), "inviteonly", "", args[0])
+
+			body := fmt.Sprintf("Room is now open to everyone, set by %s.", msg.From().Name())
+			if inviteOnly {
+				body = fmt.Sprintf("Room is now invite-only, set by %s.", msg.From().Name())
+			}
+			room.Send(message.NewAnnounceMsg(body))
+			return nil
+		},
+	})
+
+	c.Add(Command{
+		Capability: CapModerate,
+		Prefix:     "/voice",
+		PrefixHelp: "USER",
+		Help:       "Toggle allowing USER to speak while the room is moderated.",
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			args := msg.Args()
+			if len(args) == 0 {
+				return errors.New("must specify user")
+			}
+
+			member, ok := room.MemberByID(args[0])
+			if !ok {
+				return errors.New("user not found")
+			}
+
+			id := member.ID()
+			switch member.Role() {
+			case RoleGuest:
+				member.SetRole(RoleVoice)
+				room.Audit.Record(msg.From(), "voice", id)
+				room.Send(message.NewSystemMsg(fmt.Sprintf("Voiced by %s.", msg.From().Name()), member.User))
+				room.Send(message.NewSystemMsg("Voiced: "+id, msg.From()))
+			case RoleVoice:
+				member.SetRole(RoleGuest)
+				room.Audit.Record(msg.From(), "devoice", id)
+				room.Send(message.NewSystemMsg(fmt.Sprintf("Voice removed by %s.", msg.From().Name()), member.User))
+				room.Send(message.NewSystemMsg("Unvoiced: "+id, msg.From()))
+			default:
+				return fmt.Errorf("user is already %s", member.Role())
+			}
+			return nil
+		},
+	})
+
+	c.Add(Command{
+		Capability: CapModerate,
+		Prefix:     "/filter",
+		PrefixHelp: "[add ACTION PATTERN|remove N]",
+		Help:       "List content filters, or add and remove them. ACTION is one of drop, mask, warn or mute:DURATION, and PATTERN is a regular expression taken as typed.",
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			args := msg.Args()
+			if len(args) == 0 {
+				filters := room.Filters.List()
+				if len(filters) == 0 {
+					room.Send(message.NewSystemMsg("No content filters.", msg.From()))
+					return nil
+				}
+				var out strings.Builder
+				out.WriteString("Content filters:")
+				for i, filter := range filters {
+					fmt.Fprintf(&out, "%s   #%d %s", message.Newline, i+1, filter)
+				}
+				room.Send(message.NewSystemMsg(out.String(), msg.From()))
+				return nil
+			}
+
+			switch args[0] {
+			case "add":
+				if len(args) < 3 {
+					return ErrInvalidFilter
+				}
+				// The pattern is taken as typed, so escapes reach the regexp.
+				filter, err := ParseFilter(args[1], msg.Rest(2))
+				if err != nil {
+					return err
+				}
+				room.Filters.Add(filter)
+				room.Audit.Record(msg.From(), "filter", "", "add", filter.String())
+				room.Send(message.NewSystemMsg("Added filter: "+filter.String(), msg.From()))
+			case "remove":
+				if len(args) != 2 {
+					return ErrMissingArg
+				}
+				n, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+				if err != nil {
+					return fmt.Errorf("invalid filter number: %s", args[1])
+				}
+				if err := room.Filters.Remove(n); err != nil {
+					return err
+				}
+				room.Audit.Record(msg.From(), "filter", "", "remove", strconv.Itoa(n))
+				room.Send(message.NewSystemMsg(fmt.Sprintf("Removed filter #%d.", n), msg.From()))
+			default:
+				return errors.New("invalid subcommand: " + args[0])
+			}
+			return nil
+		},
+	})
+
+	c.Add(Command{
+		Capability: CapModerate,
+		Prefix:     "/slowmode",
+		PrefixHelp: "[DURATION|off]",
+		Help:       "Show or set the minimum time between messages from each user.",
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			args := msg.Args()
+			if len(args) == 0 {
+				body := "Slow mode is off."
+				if d := room.SlowMode(); d > 0 {
+					body = fmt.Sprintf("Slow mode is set to %s.", d)
+				}
+				room.Send(message.NewSystemMsg(body, msg.From()))
+				return nil
+			}
+			if len(args) != 1 {
+				return ErrMissingArg
+			}
+
+			var d time.Duration
+			if args[0] != "off" {
+				var err error
+				d, err = time.ParseDuration(args[0])
+				if err != nil {
+					return err
+				}
+				if d < 0 {
+					return errors.New("slow mode duration must be positive")
+				}
+			}
+			room.SetSlowMode(d)
+			room.Audit.Record(msg.From(), "slowmode", "", args[0])
+
+			body := fmt.Sprintf("Slow mode turned off by %s.", msg.From().Name())
+			if d > 0 {
+				body = fmt.Sprintf("Slow mode set to %s by %s.", d, msg.From().Name())
+			}
+			room.Send(message.NewAnnounceMsg(body))
+			return nil
+		},
+	})
+
+	c.Add(Command{
+		Capability: CapModerate,
+		Prefix:     "/audit",
+		PrefixHelp: "[N] [USER]",
+		Help:       "Show the last N moderation actions, optionally only those by or against USER.",
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			args := msg.Args()
+			n := 10
+			if len(args) > 0 {
+				if i, err := strconv.Atoi(args[0]); err == nil {
+					if i < 1 {
+						return errors.New("number of entries must be positive")
+					}
+					n = i
+					args = args[1:]
+				}
+			}
+			if len(args) > 1 {
+				return errors.New("too many arguments")
+			}
+			var user string
+			if len(args) == 1 {
+				user = args[0]
+			}
+
+			entries := room.Audit.Query(n, user)
+			if len(entries) == 0 {
+				room.Send(message.NewSystemMsg("No audit entries.", msg.From()))
+				return nil
+			}
+			var out strings.Builder
+			out.WriteString("Audit log:")
+			for _, entry := range entries {
+				out.WriteString(message.Newline + "   " + entry.String())
+			}
+			room.Send(message.NewSystemMsg(out.String(), msg.From()))
+			return nil
+		},
+	})
 }
@@ -0,0 +1,186 @@
+package chat
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrInvalidFilter is the error returned when a filter can't be parsed.
+var ErrInvalidFilter = errors.New("invalid filter, must be: ACTION PATTERN")
+
+// FilterAction is what happens to a message which matches a Filter.
+type FilterAction string
+
+const (
+	// FilterDrop drops the message.
+	FilterDrop FilterAction = "drop"
+	// FilterMask replaces the matched text with asterisks.
+	FilterMask FilterAction = "mask"
+	// FilterWarn delivers the message, but warns the sender.
+	FilterWarn FilterAction = "warn"
+	// FilterMute drops the message and mutes the sender for a duration.
+	FilterMute FilterAction = "mute"
+)
+
+// Filter is a pattern to check messages against, and the action to take when
+// a message matches.
+type Filter struct {
+	Pattern  *regexp.Regexp
+	Action   FilterAction
+	Duration time.Duration // How long to mute for, only used by FilterMute.
+}
+
+// ParseFilter parses a filter from an action and a regular expression
+// pattern. The action is one of drop, mask, warn or mute:DURATION.
+func ParseFilter(action string, pattern string) (*Filter, error) {
+	f := Filter{}
+	parts := strings.SplitN(action, ":", 2)
+	switch FilterAction(parts[0]) {
+	case FilterDrop, FilterMask, FilterWarn:
+		if len(parts) > 1 {
+			return nil, fmt.Errorf("unexpected duration for filter action: %s", parts[0])
+		}
+	case FilterMute:
+		if len(parts) < 2 {
+			return nil, errors.New("mute filter action requires a duration, like mute:10m")
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		f.Duration = d
+	default:
+		return nil, fmt.Errorf("unknown filter action: %s", parts[0])
+	}
+	f.Action = FilterAction(parts[0])
+
+	if pattern == "" {
+		return nil, ErrInvalidFilter
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	f.Pattern = re
+	return &f, nil
+}
+
+// Mask replaces each match of the filter in s with asterisks.
+func (f *Filter) Mask(s string) string {
+	return f.Pattern.ReplaceAllStringFunc(s, func(match string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(match))
+	})
+}
+
+// String returns the filter in the format accepted by ParseFilter, with the
+// action and pattern separated by a space.
+func (f *Filter) String() string {
+	action := string(f.Action)
+	if f.Action == FilterMute {
+		action += ":" + f.Duration.String()
+	}
+	return action + " " + f.Pattern.String()
+}
+
+// Filters is an ordered list of content filters.
+type Filters struct {
+	mu      sync.Mutex
+	filters []*Filter
+
+	// OnChange is called after filters are added or removed.
+	OnChange func()
+}
+
+// Add appends a filter to the list.
+func (f *Filters) Add(filter *Filter) {
+	f.mu.Lock()
+	f.filters = append(f.filters, filter)
+	f.mu.Unlock()
+
+	if f.OnChange != nil {
+		f.OnChange()
+	}
+}
+
+// Remove removes the filter at a 1-based index, as shown by List.
+func (f *Filters) Remove(n int) error {
+	f.mu.Lock()
+	if n < 1 || n > len(f.filters) {
+		f.mu.Unlock()
+		return fmt.Errorf("no filter #%d", n)
+	}
+	f.filters = append(f.filters[:n-1], f.filters[n:]...)
+	f.mu.Unlock()
+
+	if f.OnChange != nil {
+		f.OnChange()
+	}
+	return nil
+}
+
+// List returns a copy of the filters.
+func (f *Filters) List() []*Filter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*Filter{}, f.filters...)
+}
+
+// Match returns the first filter that matches s and its 1-based index, or
+// nil if none match.
+func (f *Filters) Match(s string) (*Filter, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, filter := range f.filters {
+		if filter.Pattern.MatchString(s) {
+			return filter, i + 1
+		}
+	}
+	return nil, 0
+}
+
+// Load replaces the filters with ones read from r, one per line. Empty lines
+// and lines starting with # are skipped.
+func (f *Filters) Load(r io.Reader) error {
+	var filters []*Filter
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return ErrInvalidFilter
+		}
+		filter, err := ParseFilter(parts[0], parts[1])
+		if err != nil {
+			return err
+		}
+		filters = append(filters, filter)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.filters = filters
+	f.mu.Unlock()
+	return nil
+}
+
+// Save writes the filters to w in the format read by Load.
+func (f *Filters) Save(w io.Writer) error {
+	for _, filter := range f.List() {
+		if _, err := fmt.Fprintln(w, filter.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
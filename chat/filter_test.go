@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		Action  string
+		Pattern string
+		Want    string
+		Err     bool
+	}{
+		{"drop", "foo", "drop foo", false},
+		{"mask", "(?i)bad word", "mask (?i)bad word", false},
+		{"mute:10m", "spam", "mute:10m0s spam", false},
+		{"mute", "spam", "", true},
+		{"drop:5m", "spam", "", true},
+		{"explode", "spam", "", true},
+		{"warn", "(unclosed", "", true},
+		{"warn", "", "", true},
+	}
+
+	for i, tc := range tests {
+		f, err := ParseFilter(tc.Action, tc.Pattern)
+		if tc.Err {
+			if err == nil {
+				t.Errorf("case #%d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case #%d: unexpected error: %s", i, err)
+			continue
+		}
+		if got, want := f.String(), tc.Want; got != want {
+			t.Errorf("case #%d:\n got: %q\nwant: %q", i, got, want)
+		}
+	}
+}
+
+func TestFilterMask(t *testing.T) {
+	f, err := ParseFilter("mask", "(?i)darn|héck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Mask("Darn it, what the héck"), "**** it, what the ****"; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+}
+
+func TestFiltersLoadSave(t *testing.T) {
+	in := "# Comment\n\ndrop foo\nmute:1h0m0s bar baz\n"
+	filters := &Filters{}
+	if err := filters.Load(strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+
+	if f, n := filters.Match("bar baz"); f == nil || n != 2 || f.Duration != time.Hour {
+		t.Errorf("wrong match: %v #%d", f, n)
+	}
+	if f, _ := filters.Match("quux"); f != nil {
+		t.Errorf("unexpected match: %v", f)
+	}
+
+	var out bytes.Buffer
+	if err := filters.Save(&out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "drop foo\nmute:1h0m0s bar baz\n"; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+
+	if err := filters.Load(strings.NewReader("drop\n")); err == nil {
+		t.Error("expected error for invalid filter")
+	}
+}
@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/shazow/ssh-chat/chat/message"
+)
+
+// floodWindow is the period that FloodControl limits apply to.
+const floodWindow = time.Minute
+
+// FloodControl configures a room's automatic flood protection. Ops are
+// exempt from it.
+type FloodControl struct {
+	// RepeatLimit is the number of identical messages in a row a member can
+	// send within a minute before being muted, 0 disables the limit.
+	RepeatLimit int
+	// JoinLimit is the number of joins per minute before guests are
+	// restricted from sending messages, 0 disables the limit.
+	JoinLimit int
+	// RestrictFor is how long mutes and guest restrictions last.
+	RestrictFor time.Duration
+}
+
+// DefaultFloodControl is the flood protection used by new rooms.
+var DefaultFloodControl = FloodControl{
+	RepeatLimit: 3,
+	JoinLimit:   20,
+	RestrictFor: 5 * time.Minute,
+}
+
+// SetFloodControl changes the room's flood protection.
+func (r *Room) SetFloodControl(flood FloodControl) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flood = flood
+}
+
+// SlowMode returns the minimum time between messages from each member, 0 if
+// slow mode is off.
+func (r *Room) SlowMode() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.slowMode
+}
+
+// SetSlowMode sets the minimum time between messages from each member, 0
+// turns slow mode off.
+func (r *Room) SetSlowMode(d time.Duration) {
+	r.mu.Lock()
+	r.slowMode = d
+	r.mu.Unlock()
+	r.stateChanged()
+}
+
+// recordJoin tracks joins to detect join floods. If this join started
+// restricting guests, it returns how long for, otherwise 0.
+func (r *Room) recordJoin() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.flood.JoinLimit <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	joins := r.joins[:0]
+	for _, t := range r.joins {
+		if now.Sub(t) < floodWindow {
+			joins = append(joins, t)
+		}
+	}
+	r.joins = append(joins, now)
+
+	if len(r.joins) <= r.flood.JoinLimit || now.Before(r.guestsUntil) {
+		return 0
+	}
+	r.guestsUntil = now.Add(r.flood.RestrictFor)
+	return r.flood.RestrictFor
+}
+
+// applyFloodControl checks a public message from a member against the slow
+// mode and flood limits, and returns the message to deliver or nil if it
+// should be dropped.
+func (r *Room) applyFloodControl(member *Member, m message.Message) message.Message {
+	var body string
+	switch msg := m.(type) {
+	case message.PublicMsg:
+		body = msg.Body()
+	case *message.EmoteMsg:
+		body = msg.Body()
+	default:
+		return m
+	}
+	if member.IsOp() {
+		return m
+	}
+
+	r.mu.Lock()
+	flood, slowMode, guestsUntil := r.flood, r.slowMode, r.guestsUntil
+	r.mu.Unlock()
+
+	now := time.Now()
+	if member.Guest && now.Before(guestsUntil) {
+		body := fmt.Sprintf("Message rejected: Guests without a public key are restricted during a join flood, try again in %s.", roundUp(guestsUntil.Sub(now)))
+		member.Send(message.NewSystemMsg(body, member.User))
+		return nil
+	}
+	if wait := member.LastPosted().Add(slowMode).Sub(now); slowMode > 0 && wait > 0 {
+		body := fmt.Sprintf("Message rejected: Slow mode is on, try again in %s.", roundUp(wait))
+		member.Send(message.NewSystemMsg(body, member.User))
+		return nil
+	}
+	repeats := member.trackPost(body, now)
+	if flood.RepeatLimit > 0 && repeats > flood.RepeatLimit {
+		member.MuteFor(flood.RestrictFor)
+		r.notifyOps(fmt.Sprintf("Muted %s for %s: Repeated message.", member.Name(), flood.RestrictFor))
+		body := fmt.Sprintf("Message rejected: Repeated message, you are muted for %s.", flood.RestrictFor)
+		member.Send(message.NewSystemMsg(body, member.User))
+		return nil
+	}
+	return m
+}
+
+// roundUp rounds a duration up to the second, for displaying waits.
+func roundUp(d time.Duration) time.Duration {
+	return time.Duration(math.Ceil(d.Seconds())) * time.Second
+}
@@ -0,0 +1,142 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shazow/ssh-chat/chat/message"
+)
+
+func newFloodMember(name string) *Member {
+	return &Member{User: message.NewUserScreen(message.SimpleID(name), &MockScreen{})}
+}
+
+func TestFloodRepeatLimit(t *testing.T) {
+	room := NewRoom()
+	room.SetFloodControl(FloodControl{RepeatLimit: 2, RestrictFor: time.Minute})
+	member := newFloodMember("foo")
+
+	for i := 0; i < 2; i++ {
+		if room.applyFloodControl(member, message.NewPublicMsg("hi", member.User)) == nil {
+			t.Fatalf("message #%d was dropped", i)
+		}
+	}
+	if room.applyFloodControl(member, message.NewPublicMsg("hi", member.User)) != nil {
+		t.Error("repeated message was delivered")
+	}
+	if !member.IsMuted() {
+		t.Error("member was not muted")
+	}
+	if got, want := member.User.ConsumeOne().String(), "-> Message rejected: Repeated message, you are muted for 1m0s."; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+
+	// Ops are exempt.
+	op := newFloodMember("op")
+	op.SetRole(RoleModerator)
+	for i := 0; i < 3; i++ {
+		if room.applyFloodControl(op, message.NewPublicMsg("hi", op.User)) == nil {
+			t.Fatalf("op message #%d was dropped", i)
+		}
+	}
+}
+
+func TestFloodSlowMode(t *testing.T) {
+	room := NewRoom()
+	room.SetSlowMode(time.Minute)
+	member := newFloodMember("foo")
+
+	if room.applyFloodControl(member, message.NewPublicMsg("one", member.User)) == nil {
+		t.Fatal("first message was dropped")
+	}
+	if room.applyFloodControl(member, message.NewPublicMsg("two", member.User)) != nil {
+		t.Error("message during slow mode was delivered")
+	}
+	if got, want := member.User.ConsumeOne().String(), "-> Message rejected: Slow mode is on, try again in 1m0s."; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+
+	// Commands aren't limited.
+	cmd, _ := message.NewPublicMsg("/names", member.User).ParseCommand()
+	if room.applyFloodControl(member, cmd) == nil {
+		t.Error("command was dropped")
+	}
+
+	room.SetSlowMode(0)
+	if room.applyFloodControl(member, message.NewPublicMsg("three", member.User)) == nil {
+		t.Error("message after slow mode was turned off was dropped")
+	}
+}
+
+func TestFloodJoinLimit(t *testing.T) {
+	room := NewRoom()
+	room.SetFloodControl(FloodControl{JoinLimit: 2, RestrictFor: time.Minute})
+
+	for i := 0; i < 2; i++ {
+		if d := room.recordJoin(); d != 0 {
+			t.Fatalf("join #%d started a restriction", i)
+		}
+	}
+	if d := room.recordJoin(); d != time.Minute {
+		t.Errorf("got: %s; want: %s", d, time.Minute)
+	}
+	if d := room.recordJoin(); d != 0 {
+		t.Error("join during a restriction started another one")
+	}
+
+	guest := newFloodMember("guest")
+	guest.Guest = true
+	if room.applyFloodControl(guest, message.NewPublicMsg("hi", guest.User)) != nil {
+		t.Error("guest message was delivered")
+	}
+	if got := guest.User.ConsumeOne().String(); !strings.HasPrefix(got, "-> Message rejected: Guests without a public key are restricted") {
+		t.Errorf("unexpected message: %q", got)
+	}
+
+	member := newFloodMember("member")
+	if room.applyFloodControl(member, message.NewPublicMsg("hi", member.User)) == nil {
+		t.Error("member message was dropped")
+	}
+}
+
+func TestSlowModeCommand(t *testing.T) {
+	var buffer []byte
+
+	room := NewRoom()
+	go room.Serve()
+	defer room.Close()
+
+	screen := &MockScreen{}
+	op := ScreenedUser{
+		user:   message.NewUserScreen(message.SimpleID("op"), screen),
+		screen: screen,
+	}
+	member, err := room.Join(op.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op.user.HandleMsg(op.user.ConsumeOne())
+	op.screen.Read(&buffer)
+
+	if err := sendCommand("/slowmode 10s", op, room, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Err: must be op"+message.Newline)
+
+	member.SetRole(RoleModerator)
+	if err := sendCommand("/slowmode 10s", op, room, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, " * Slow mode set to 10s by op."+message.Newline)
+
+	if err := sendCommand("/slowmode", op, room, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Slow mode is set to 10s."+message.Newline)
+
+	if err := sendCommand("/slowmode off", op, room, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, " * Slow mode turned off by op."+message.Newline)
+}
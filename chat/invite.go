@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/shazow/ssh-chat/set"
+)
+
+// DefaultTokenDuration is how long invite tokens last when no duration is
+// given.
+const DefaultTokenDuration = 24 * time.Hour
+
+// Invites are the public key fingerprints and one-time tokens that can join
+// an invite-only room. Both lapse automatically if given a duration.
+type Invites struct {
+	keys   *set.Set
+	tokens *set.Set
+
+	// onChange is called after an invite is added or used.
+	onChange func()
+}
+
+// InviteState is an invited fingerprint or token, as kept between restarts.
+type InviteState struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// NewInvites creates an empty set of invites.
+func NewInvites() *Invites {
+	return &Invites{
+		keys:   set.New(),
+		tokens: set.New(),
+	}
+}
+
+// Invite allows a public key fingerprint to join, for d or forever if d is 0.
+func (i *Invites) Invite(fingerprint string, d time.Duration) {
+	item := set.Item(set.StringItem(fingerprint))
+	if d != 0 {
+		item = set.Expire(item, d)
+	}
+	i.keys.Set(item)
+	i.changed()
+}
+
+// Invited returns whether a public key fingerprint was invited.
+func (i *Invites) Invited(fingerprint string) bool {
+	return fingerprint != "" && i.keys.In(fingerprint)
+}
+
+// NewToken generates a one-time token that expires after d.
+func (i *Invites) NewToken(d time.Duration) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	i.tokens.Set(set.Expire(set.StringItem(token), d))
+	i.changed()
+	return token, nil
+}
+
+// UseToken consumes a token, and returns whether it was valid.
+func (i *Invites) UseToken(token string) bool {
+	if token == "" || !i.tokens.In(token) {
+		return false
+	}
+	if i.tokens.Remove(token) != nil {
+		return false
+	}
+	i.changed()
+	return true
+}
+
+func (i *Invites) changed() {
+	if i.onChange != nil {
+		i.onChange()
+	}
+}
+
+// inviteStates returns the unexpired invites in s.
+func inviteStates(s *set.Set) []InviteState {
+	var states []InviteState
+	s.Each(func(_ string, item set.Item) error {
+		state := InviteState{Key: item.Key()}
+		if expiring, ok := item.(*set.ExpiringItem); ok {
+			state.Expires = expiring.Time
+		}
+		states = append(states, state)
+		return nil
+	})
+	sort.Slice(states, func(a, b int) bool { return states[a].Key < states[b].Key })
+	return states
+}
+
+// setInviteStates replaces the invites in s, skipping expired ones.
+func setInviteStates(s *set.Set, states []InviteState) {
+	s.Clear()
+	for _, state := range states {
+		item := set.Item(set.StringItem(state.Key))
+		if !state.Expires.IsZero() {
+			if !time.Now().Before(state.Expires) {
+				continue
+			}
+			item = &set.ExpiringItem{Item: item, Time: state.Expires}
+		}
+		s.Set(item)
+	}
+}
@@ -0,0 +1,38 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvites(t *testing.T) {
+	invites := NewInvites()
+
+	invites.Invite("SHA256:foo", 0)
+	invites.Invite("SHA256:expired", -time.Second)
+	if !invites.Invited("SHA256:foo") {
+		t.Error("fingerprint was not invited")
+	}
+	if invites.Invited("SHA256:expired") || invites.Invited("") {
+		t.Error("unexpected invite")
+	}
+
+	token, err := invites.NewToken(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !invites.UseToken(token) {
+		t.Error("valid token was rejected")
+	}
+	if invites.UseToken(token) {
+		t.Error("token was accepted twice")
+	}
+
+	expired, err := invites.NewToken(-time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invites.UseToken(expired) {
+		t.Error("expired token was accepted")
+	}
+}
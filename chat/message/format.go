@@ -0,0 +1,133 @@
+package message
+
+import (
+	"strings"
+	"unicode"
+)
+
+// toggle is a style which switches a single attribute on and back off, so it
+// can be nested inside of other styles without resetting them.
+type toggle struct {
+	on  string
+	off string
+}
+
+func (t toggle) String() string {
+	return t.on
+}
+
+func (t toggle) Format(s string) string {
+	return t.on + s + t.off
+}
+
+// Neutralize strips control characters from user-supplied text, so that
+// users can't inject their own escape sequences into other users' terminals.
+func Neutralize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// FormatBody neutralizes a user-supplied message body and renders inline
+// markup like *bold*, _italic_, `code` and ~strike~ with the theme's styles.
+// Themes without inline styles leave the markup as-is. Multi-line bodies are
+// rendered as an indented block instead.
+func (theme Theme) FormatBody(s string) string {
+	if strings.Contains(s, "\n") {
+		return formatBlock(s)
+	}
+	return theme.formatInline([]rune(Neutralize(s)))
+}
+
+// blockIndent is the prefix for each line of a multi-line body.
+const blockIndent = "  "
+
+// formatBlock renders a multi-line body as an indented block starting on the
+// next line. Like a code block, its contents are taken literally.
+func formatBlock(s string) string {
+	var out strings.Builder
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.Replace(line, "\t", "    ", -1)
+		out.WriteString(Newline + blockIndent + Neutralize(line))
+	}
+	return out.String()
+}
+
+// inlineStyle returns the style for an inline markup delimiter, or nil if
+// the rune is not a delimiter or the theme does not style it.
+func (theme Theme) inlineStyle(r rune) Style {
+	switch r {
+	case '*':
+		return theme.bold
+	case '_':
+		return theme.italic
+	case '`':
+		return theme.code
+	case '~':
+		return theme.strike
+	}
+	return nil
+}
+
+func (theme Theme) formatInline(runes []rune) string {
+	var out strings.Builder
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		style := theme.inlineStyle(r)
+		if style == nil || !canOpenInline(runes, i) {
+			out.WriteRune(r)
+			continue
+		}
+		end := closeInline(runes, i)
+		if end < 0 {
+			out.WriteRune(r)
+			continue
+		}
+
+		var inner string
+		if r == '`' {
+			// Code spans are taken literally.
+			inner = string(runes[i+1 : end])
+		} else {
+			inner = theme.formatInline(runes[i+1 : end])
+		}
+		out.WriteString(style.Format(inner))
+		i = end
+	}
+	return out.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// canOpenInline returns whether the delimiter at i can start a span: it must
+// not be inside a word (like snake_case) and must be followed by text.
+func canOpenInline(runes []rune, i int) bool {
+	if i > 0 && isWordRune(runes[i-1]) {
+		return false
+	}
+	if i+1 >= len(runes) {
+		return false
+	}
+	next := runes[i+1]
+	return !unicode.IsSpace(next) && next != runes[i]
+}
+
+// closeInline returns the index of the delimiter which closes the span opened
+// at i, or -1 if there isn't one.
+func closeInline(runes []rune, i int) int {
+	for j := i + 2; j < len(runes); j++ {
+		if runes[j] != runes[i] || unicode.IsSpace(runes[j-1]) {
+			continue
+		}
+		if j+1 < len(runes) && isWordRune(runes[j+1]) {
+			continue
+		}
+		return j
+	}
+	return -1
+}
@@ -0,0 +1,61 @@
+package message
+
+import "testing"
+
+func TestFormatBody(t *testing.T) {
+	theme := Themes[0]
+	tests := []struct {
+		Input string
+		Want  string
+	}{
+		{"hello", "hello"},
+		{"*bold*", Bold + "bold\033[22m"},
+		{"some _italic_ text", "some " + Italic + "italic\033[23m text"},
+		{"`*code*`", Invert + "*code*\033[27m"},
+		{"~gone~.", Strike + "gone\033[29m."},
+		{"*_both_*", Bold + Italic + "both\033[23m\033[22m"},
+		{"snake_case_name", "snake_case_name"},
+		{"2 * 3 * 4", "2 * 3 * 4"},
+		{"**", "**"},
+		{"*unclosed", "*unclosed"},
+		{"\033[31mred\033[0m", "[31mred[0m"},
+		{"*\033[2Jsneaky*", Bold + "[2Jsneaky\033[22m"},
+		{"panic: *oops*\n\tmain.go:12", Newline + "  panic: *oops*" + Newline + "      main.go:12"},
+		{"a\n\033[2Jb", Newline + "  a" + Newline + "  [2Jb"},
+	}
+
+	for i, tc := range tests {
+		if got, want := theme.FormatBody(tc.Input), tc.Want; got != want {
+			t.Errorf("case #%d:\n got: %q\nwant: %q", i, got, want)
+		}
+	}
+}
+
+func TestFormatBodyMono(t *testing.T) {
+	if got, want := MonoTheme.FormatBody("*bold* \033[1m_italic_"), "*bold* [1m_italic_"; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+}
+
+func TestRenderFormatted(t *testing.T) {
+	u := NewUser(SimpleID("foo"))
+	u.colorIdx = 4
+
+	colorTheme := Themes[0]
+	actual := NewPublicMsg("*hi*", u).Render(&colorTheme)
+	expected := "\033[38;05;5mfoo\033[0m: " + Bold + "hi\033[22m"
+	if actual != expected {
+		t.Errorf("Got: %q; Expected: %q", actual, expected)
+	}
+
+	actual = NewEmoteMsg("waves _slowly_", u).Render(MonoTheme)
+	expected = "** foo waves _slowly_"
+	if actual != expected {
+		t.Errorf("Got: %q; Expected: %q", actual, expected)
+	}
+
+	actual = NewEmoteMsg("waves _slowly_", u).String()
+	if actual != expected {
+		t.Errorf("Got: %q; Expected: %q", actual, expected)
+	}
+}
@@ -58,6 +58,11 @@ func (m Msg) String() string {
 	return m.body
 }
 
+// Body returns the message body without any rendering.
+func (m Msg) Body() string {
+	return m.body
+}
+
 func (m Msg) Command() string {
 	return ""
 }
@@ -93,13 +98,20 @@ func (m PublicMsg) ParseCommand() (*CommandMsg, bool) {
 	}
 
 	// Parse
-	// TODO: Handle quoted fields properly
-	fields := strings.Fields(m.body)
-	command, args := fields[0], fields[1:]
+	tokens := tokenize(m.body)
+	args := make([]string, 0, len(tokens)-1)
+	ends := make([]int, 0, len(tokens))
+	for i, t := range tokens {
+		if i > 0 {
+			args = append(args, t.value)
+		}
+		ends = append(ends, t.end)
+	}
 	msg := CommandMsg{
 		PublicMsg: m,
-		command:   command,
+		command:   tokens[0].value,
 		args:      args,
+		ends:      ends,
 	}
 	return &msg, true
 }
@@ -109,7 +121,7 @@ func (m PublicMsg) Render(t *Theme) string {
 		return m.String()
 	}
 
-	return fmt.Sprintf("%s: %s", t.ColorName(m.from), m.body)
+	return fmt.Sprintf("%s: %s", t.ColorName(m.from), t.FormatBody(m.body))
 }
 
 // RenderFor renders the message for other users to see.
@@ -122,7 +134,8 @@ func (m PublicMsg) RenderFor(cfg UserConfig) string {
 		return m.Render(cfg.Theme)
 	}
 
-	body := cfg.Highlight.ReplaceAllString(m.body, cfg.Theme.Highlight("${1}"))
+	body := cfg.Theme.FormatBody(m.body)
+	body = cfg.Highlight.ReplaceAllString(body, "${1}"+cfg.Theme.Highlight("${2}")+"${3}")
 	if cfg.Bell {
 		body += Bel
 	}
@@ -134,7 +147,7 @@ func (m PublicMsg) RenderSelf(cfg UserConfig) string {
 	if cfg.Theme == nil {
 		return fmt.Sprintf("[%s] %s", m.from.Name(), m.body)
 	}
-	return fmt.Sprintf("[%s] %s", cfg.Theme.ColorName(m.from), m.body)
+	return fmt.Sprintf("[%s] %s", cfg.Theme.ColorName(m.from), cfg.Theme.FormatBody(m.body))
 }
 
 func (m PublicMsg) String() string {
@@ -162,7 +175,10 @@ func (m EmoteMsg) From() *User {
 }
 
 func (m EmoteMsg) Render(t *Theme) string {
-	return fmt.Sprintf("** %s %s", m.from.Name(), m.body)
+	if t == nil {
+		return fmt.Sprintf("** %s %s", m.from.Name(), m.body)
+	}
+	return fmt.Sprintf("** %s %s", m.from.Name(), t.FormatBody(m.body))
 }
 
 func (m EmoteMsg) String() string {
@@ -193,9 +209,9 @@ func (m PrivateMsg) From() *User {
 func (m PrivateMsg) Render(t *Theme) string {
 	format := "[PM from %s] %s"
 	if t == nil {
-		return fmt.Sprintf(format, m.from.ID(), m.body) 
+		return fmt.Sprintf(format, m.from.ID(), m.body)
 	}
-	s := fmt.Sprintf(format, m.from.Name(), m.body)
+	s := fmt.Sprintf(format, m.from.Name(), t.FormatBody(m.body))
 	return t.ColorPM(s)
 }
 
@@ -265,16 +281,24 @@ type CommandMsg struct {
 	PublicMsg
 	command string
 	args    []string
+	ends    []int // Offsets of the ends of the command and args in the body.
 }
 
 func (m CommandMsg) Command() string {
 	return m.command
 }
 
+// Args returns the arguments of the command, split as by Tokenize.
 func (m CommandMsg) Args() []string {
 	return m.args
 }
 
-func (m CommandMsg) Body() string {
-	return m.body
+// Rest returns the raw text of the command after its first n arguments, with
+// quotes and escapes as they were typed, for free text like a reason or
+// message. Surrounding whitespace is trimmed.
+func (m CommandMsg) Rest(n int) string {
+	if n >= len(m.ends) {
+		return ""
+	}
+	return strings.TrimSpace(m.body[m.ends[n]:])
 }
@@ -26,6 +26,9 @@ const (
 	// Invert inverts the following text
 	Invert = "\033[7m"
 
+	// Strike crosses out the following text
+	Strike = "\033[9m"
+
 	// Newline
 	Newline = "\r\n"
 
@@ -123,6 +126,12 @@ type Theme struct {
 	highlight Style
 	names     *Palette
 	useID     bool
+
+	// Inline markup styles, markup is left as-is when nil.
+	bold   Style
+	italic Style
+	code   Style
+	strike Style
 }
 
 func (theme Theme) ID() string {
@@ -209,6 +218,14 @@ func readableColors256() *Palette {
 	return Color256Palette(colors...)
 }
 
+// Inline markup styles shared by the colored themes.
+var (
+	inlineBold   = toggle{Bold, "\033[22m"}
+	inlineItalic = toggle{Italic, "\033[23m"}
+	inlineCode   = toggle{Invert, "\033[27m"}
+	inlineStrike = toggle{Strike, "\033[29m"}
+)
+
 func init() {
 	Themes = []Theme{
 		{
@@ -217,6 +234,10 @@ func init() {
 			sys:       Color256(245),                              // Grey
 			pm:        Color256(7),                                // White
 			highlight: style(Bold + "\033[48;5;11m\033[38;5;16m"), // Yellow highlight
+			bold:      inlineBold,
+			italic:    inlineItalic,
+			code:      inlineCode,
+			strike:    inlineStrike,
 		},
 		{
 			id:        "solarized",
@@ -224,6 +245,10 @@ func init() {
 			sys:       Color256(11),                              // Yellow
 			pm:        Color256(15),                              // White
 			highlight: style(Bold + "\033[48;5;3m\033[38;5;94m"), // Orange highlight
+			bold:      inlineBold,
+			italic:    inlineItalic,
+			code:      inlineCode,
+			strike:    inlineStrike,
 		},
 		{
 			id:        "hacker",
@@ -231,6 +256,10 @@ func init() {
 			sys:       Color256(22),                               // Another green
 			pm:        Color256(28),                               // More green, slightly lighter
 			highlight: style(Bold + "\033[48;5;22m\033[38;5;46m"), // Green on dark green
+			bold:      inlineBold,
+			italic:    inlineItalic,
+			code:      inlineCode,
+			strike:    inlineStrike,
 		},
 		{
 			id:    "mono",
@@ -0,0 +1,90 @@
+package message
+
+import "strings"
+
+// token is an argument of a command line, and the offset of its end in the
+// line.
+type token struct {
+	value string
+	end   int
+}
+
+// Tokenize splits a command line into arguments at whitespace, like a shell.
+// A quote at the start of an argument, or after an = like key="value", groups
+// the words up to the matching quote at the end of an argument. Double quotes
+// allow \" and \\ escapes inside them, and a backslash escapes a following
+// space, quote or backslash outside of quotes. Quotes without a match are kept
+// as they are, so apostrophes in text don't need escaping.
+func Tokenize(line string) []string {
+	tokens := tokenize(line)
+	args := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		args = append(args, t.value)
+	}
+	return args
+}
+
+func tokenize(line string) []token {
+	var tokens []token
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return tokens
+		}
+
+		var value strings.Builder
+		start := i
+		for i < len(line) && !isSpace(line[i]) {
+			c := line[i]
+			switch {
+			case c == '\\' && i+1 < len(line) && isEscapable(line[i+1]):
+				value.WriteByte(line[i+1])
+				i += 2
+			case (c == '"' || c == '\'') && (i == start || line[i-1] == '='):
+				end := closingQuote(line, i)
+				if end < 0 {
+					value.WriteByte(c)
+					i++
+					continue
+				}
+				quoted := line[i+1 : end]
+				if c == '"' {
+					quoted = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(quoted)
+				}
+				value.WriteString(quoted)
+				i = end + 1
+			default:
+				value.WriteByte(c)
+				i++
+			}
+		}
+		tokens = append(tokens, token{value.String(), i})
+	}
+}
+
+// closingQuote returns the offset of the quote matching the one at open, which
+// ends an argument, or -1 if there isn't one.
+func closingQuote(line string, open int) int {
+	quote := line[open]
+	for i := open + 1; i < len(line); i++ {
+		if quote == '"' && line[i] == '\\' && i+1 < len(line) {
+			i++
+			continue
+		}
+		if line[i] == quote && (i+1 == len(line) || isSpace(line[i+1])) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func isEscapable(c byte) bool {
+	return isSpace(c) || c == '"' || c == '\'' || c == '\\'
+}
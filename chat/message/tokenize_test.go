@@ -0,0 +1,47 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		Input string
+		Want  []string
+	}{
+		{`/msg foo  hello world`, []string{"/msg", "foo", "hello", "world"}},
+		{`/ban "client=foo bar" 10m`, []string{"/ban", "client=foo bar", "10m"}},
+		{`/ban client="SSH-2.0-Go ssh" ip=1.2.3.4`, []string{"/ban", "client=SSH-2.0-Go ssh", "ip=1.2.3.4"}},
+		{`/away 'out for lunch'`, []string{"/away", "out for lunch"}},
+		{`/away don't wait, I can't come`, []string{"/away", "don't", "wait,", "I", "can't", "come"}},
+		{`/say "unterminated quote`, []string{"/say", `"unterminated`, "quote"}},
+		{`/say "she said \"hi\"" \\o/`, []string{"/say", `she said "hi"`, `\o/`}},
+		{`/say two\ words C:\path`, []string{"/say", "two words", `C:\path`}},
+		{`/say 'single \"kept\"'`, []string{"/say", `single \"kept\"`}},
+		{`/say ""`, []string{"/say", ""}},
+	}
+	for _, tc := range tests {
+		if got := Tokenize(tc.Input); !reflect.DeepEqual(got, tc.Want) {
+			t.Errorf("%s:\n got: %q\nwant: %q", tc.Input, got, tc.Want)
+		}
+	}
+}
+
+func TestCommandMsgRest(t *testing.T) {
+	cmd, ok := NewPublicMsg(`/msg "foo" hello,  "world"  `, nil).ParseCommand()
+	if !ok {
+		t.Fatal("not parsed as a command")
+	}
+	if got, want := cmd.Args(), []string{"foo", "hello,", "world"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("args: got: %q; want: %q", got, want)
+	}
+	for n, want := range []string{`"foo" hello,  "world"`, `hello,  "world"`, `"world"`, ""} {
+		if got := cmd.Rest(n); got != want {
+			t.Errorf("Rest(%d): got: %q; want: %q", n, got, want)
+		}
+	}
+	if got := cmd.Rest(10); got != "" {
+		t.Errorf("Rest past the args: got: %q", got)
+	}
+}
@@ -14,7 +14,11 @@ import (
 
 const messageBuffer = 5
 const messageTimeout = 5 * time.Second
-const reHighlight = `\b(%s)\b`
+
+// reHighlight matches a name surrounded by non-word characters. Unlike \b,
+// this also works for names in non-Latin scripts.
+const reHighlight = `(^|[^\pL\pN_])(%s)($|[^\pL\pN_])`
+
 const timestampTimeout = 30 * time.Minute
 
 var ErrUserClosed = errors.New("user closed")
@@ -168,6 +172,18 @@ func (u *User) Consume() {
 	}
 }
 
+// Receive returns the next message sent to the user, as it is rather than
+// rendered, or false once the user is closed. It's used instead of Consume by
+// users without a screen, like bots.
+func (u *User) Receive() (Message, bool) {
+	select {
+	case <-u.done:
+		return nil, false
+	case m := <-u.msg:
+		return m, true
+	}
+}
+
 // Consume one message and stop, mostly for testing
 func (u *User) ConsumeOne() Message {
 	return <-u.msg
@@ -3,6 +3,7 @@ package message
 import (
 	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -59,3 +60,23 @@ func TestRenderTimestamp(t *testing.T) {
 		t.Errorf("Wrong screen output:\n Got: `%q`;\nWant: `%q`", actual, expected)
 	}
 }
+
+func TestRenderHighlight(t *testing.T) {
+	u := NewUser(SimpleID("Иван"))
+	if err := u.SetHighlight(u.Name()); err != nil {
+		t.Fatal(err)
+	}
+	cfg := u.Config()
+	cfg.Theme = DefaultTheme
+	cfg.Bell = false
+
+	from := NewUser(SimpleID("foo"))
+	got := NewPublicMsg("hi Иван!", from).RenderFor(cfg)
+	if want := "hi " + DefaultTheme.Highlight("Иван") + "!"; !strings.HasSuffix(got, want) {
+		t.Errorf("got: %q; want suffix: %q", got, want)
+	}
+	got = NewPublicMsg("hi Иванов", from).RenderFor(cfg)
+	if want := "hi Иванов"; !strings.HasSuffix(got, want) {
+		t.Errorf("got: %q; want suffix: %q", got, want)
+	}
+}
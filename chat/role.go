@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrMustBeOp is the error returned when a command requires a capability that
+// only ops have.
+var ErrMustBeOp = errors.New("must be op")
+
+// Role is a member's level of permissions in a room.
+type Role int
+
+const (
+	// RoleGuest is the default role, with no capabilities.
+	RoleGuest Role = iota
+	// RoleVoice is a member trusted to speak.
+	RoleVoice
+	// RoleModerator is an op, who can moderate the room.
+	RoleModerator
+	// RoleOwner is an op who can also manage other members' roles.
+	RoleOwner
+)
+
+var roleNames = []string{"guest", "voice", "moderator", "owner"}
+
+// String returns the name of the role.
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// ParseRole returns the role with the given name.
+func ParseRole(s string) (Role, error) {
+	for i, name := range roleNames {
+		if strings.EqualFold(s, name) {
+			return Role(i), nil
+		}
+	}
+	return RoleGuest, fmt.Errorf("unknown role: %s", s)
+}
+
+// Capability is a permission required to run a command.
+type Capability string
+
+const (
+	// CapNone is required by commands anyone can run.
+	CapNone Capability = ""
+	// CapVoice is required to post public messages in a moderated room.
+	CapVoice Capability = "voice"
+	// CapModerate is required to act on other members and the room's
+	// content, like kicking, muting or filtering.
+	CapModerate Capability = "moderate"
+	// CapAdmin is required to change who can connect and members' roles.
+	CapAdmin Capability = "admin"
+)
+
+// Permissions is the matrix of capabilities granted to each role.
+type Permissions map[Role][]Capability
+
+// DefaultPermissions are the permissions used by new rooms.
+var DefaultPermissions = Permissions{
+	RoleVoice:     {CapVoice},
+	RoleModerator: {CapVoice, CapModerate},
+	RoleOwner:     {CapVoice, CapModerate, CapAdmin},
+}
+
+// Can returns whether a role has a capability.
+func (p Permissions) Can(role Role, c Capability) bool {
+	if c == CapNone {
+		return true
+	}
+	for _, granted := range p[role] {
+		if granted == c {
+			return true
+		}
+	}
+	return false
+}
+
+// required returns the error for a member with a role missing a capability,
+// naming the lowest role that has it. Members who aren't ops are told to be
+// op for capabilities only ops have.
+func (p Permissions) required(role Role, c Capability) error {
+	for r := RoleGuest; int(r) < len(roleNames); r++ {
+		if !p.Can(r, c) {
+			continue
+		}
+		if r == RoleModerator || (r > RoleModerator && role < RoleModerator) {
+			return ErrMustBeOp
+		}
+		return fmt.Errorf("must be %s", r)
+	}
+	return fmt.Errorf("no role can %s", c)
+}
@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shazow/ssh-chat/chat/message"
+)
+
+func TestParseRole(t *testing.T) {
+	for _, name := range []string{"guest", "voice", "moderator", "Owner"} {
+		role, err := ParseRole(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := role.String(), strings.ToLower(name); got != want {
+			t.Errorf("got: %q; want: %q", got, want)
+		}
+	}
+	if _, err := ParseRole("admin"); err == nil {
+		t.Error("expected error for unknown role")
+	}
+}
+
+func TestPermissionsRequired(t *testing.T) {
+	p := DefaultPermissions
+	tests := []struct {
+		Role Role
+		Cap  Capability
+		Want string
+	}{
+		{RoleGuest, CapModerate, "must be op"},
+		{RoleGuest, CapAdmin, "must be op"},
+		{RoleVoice, CapModerate, "must be op"},
+		{RoleModerator, CapAdmin, "must be owner"},
+	}
+	for i, tc := range tests {
+		if p.Can(tc.Role, tc.Cap) {
+			t.Errorf("case #%d: %s shouldn't be able to %s", i, tc.Role, tc.Cap)
+		}
+		if got := p.required(tc.Role, tc.Cap).Error(); got != tc.Want {
+			t.Errorf("case #%d:\n got: %q\nwant: %q", i, got, tc.Want)
+		}
+	}
+	if !p.Can(RoleOwner, CapAdmin) || !p.Can(RoleGuest, CapNone) {
+		t.Error("expected capabilities were not granted")
+	}
+}
+
+func TestCommandCapability(t *testing.T) {
+	cmds := Commands{}
+	cmds.Add(Command{
+		Prefix:     "/secret",
+		Help:       "Owners only.",
+		Capability: CapAdmin,
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			return nil
+		},
+	})
+	cmds.Add(Command{
+		Prefix: "/public",
+		Help:   "Anyone.",
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			return nil
+		},
+	})
+
+	room := NewRoom()
+	u := message.NewUser(message.SimpleID("foo"))
+	member, err := room.Join(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, _ := message.NewPublicMsg("/secret", u).ParseCommand()
+	if err := cmds.Run(room, *msg); err != ErrMustBeOp {
+		t.Errorf("got: %v; want: %v", err, ErrMustBeOp)
+	}
+	can := func(c Capability) bool { return room.Can(u, c) }
+	if help := cmds.Help(can); strings.Contains(help, "/secret") || !strings.Contains(help, "/public") {
+		t.Errorf("unexpected help for guest: %q", help)
+	}
+
+	member.SetRole(RoleModerator)
+	if err := cmds.Run(room, *msg); err == nil || err.Error() != "must be owner" {
+		t.Errorf("got: %v; want: must be owner", err)
+	}
+
+	member.SetRole(RoleOwner)
+	if err := cmds.Run(room, *msg); err != nil {
+		t.Error(err)
+	}
+	if help := cmds.Help(can); !strings.Contains(help, "Operator commands:") || !strings.Contains(help, "/secret") {
+		t.Errorf("unexpected help for owner: %q", help)
+	}
+}
+
+func TestCommandOp(t *testing.T) {
+	cmds := Commands{}
+	err := cmds.Add(Command{
+		Prefix: "/legacy",
+		Op:     true,
+		Handler: func(room *Room, msg message.CommandMsg) error {
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cmds["/legacy"].Capability; got != CapModerate {
+		t.Errorf("got: %q; want: %q", got, CapModerate)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/shazow/ssh-chat/chat/message"
 	"github.com/shazow/ssh-chat/internal/humantime"
@@ -26,17 +27,43 @@ var ErrInvalidName = errors.New("invalid name")
 // Member is a User with per-Room metadata attached to it.
 type Member struct {
 	*message.User
-	IsOp bool
+	Guest bool // Guests joined without a public key.
+
+	mu         sync.Mutex
+	role       Role
+	isMuted    bool      // When true, messages should not be broadcasted.
+	mutedUntil time.Time // When the mute expires, zero if it doesn't.
+	lastPosted time.Time // When the last public message was posted.
+	lastBody   string    // Body of the last public message.
+	repeats    int       // Number of times lastBody was posted in a row.
+}
 
-	// TODO: Move IsOp under mu?
+// Role returns the member's role in the room.
+func (m *Member) Role() Role {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.role
+}
 
-	mu      sync.Mutex
-	isMuted bool // When true, messages should not be broadcasted.
+// SetRole changes the member's role in the room.
+func (m *Member) SetRole(role Role) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.role = role
+}
+
+// IsOp returns whether the member is a moderator or owner.
+func (m *Member) IsOp() bool {
+	return m.Role() >= RoleModerator
 }
 
 func (m *Member) IsMuted() bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.isMuted && !m.mutedUntil.IsZero() && time.Now().After(m.mutedUntil) {
+		m.isMuted = false
+		m.mutedUntil = time.Time{}
+	}
 	return m.isMuted
 }
 
@@ -44,31 +71,96 @@ func (m *Member) SetMute(muted bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.isMuted = muted
+	m.mutedUntil = time.Time{}
+}
+
+// MuteFor mutes the member for a duration.
+func (m *Member) MuteFor(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.isMuted = true
+	m.mutedUntil = time.Now().Add(d)
+}
+
+// LastPosted returns when the member last posted a public message.
+func (m *Member) LastPosted() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastPosted
+}
+
+// trackPost records a public message posted by the member, and returns how
+// many times in a row it was posted within the flood window.
+func (m *Member) trackPost(body string, now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if body == m.lastBody && now.Sub(m.lastPosted) < floodWindow {
+		m.repeats++
+	} else {
+		m.repeats = 1
+	}
+	m.lastBody = body
+	m.lastPosted = now
+	return m.repeats
 }
 
 // Room definition, also a Set of User Items
 type Room struct {
-	topic     string
 	history   *message.History
 	broadcast chan message.Message
 	commands  Commands
 	closed    bool
 	closeOnce sync.Once
 
+	mu           sync.Mutex
+	topic        string
+	topicBy      string    // Name of who set the topic.
+	topicAt      time.Time // When the topic was set.
+	topicOpsOnly bool      // Only members with CapModerate can set the topic.
+	moderated    bool      // Only members with CapVoice can post publicly.
+	inviteOnly   bool      // Only invited users can join.
+	slowMode     time.Duration
+	flood        FloodControl
+	joins        []time.Time // Recent joins, for detecting join floods.
+	guestsUntil  time.Time   // Guests are restricted until then.
+
 	Members *set.Set
+	Filters *Filters
+	Audit   *AuditLog
+	Invites *Invites
+	Access  *Access
+
+	// Permissions are the capabilities of each role in the room.
+	Permissions Permissions
+
+	// OnStateChange is called after a setting in RoomState changes.
+	OnStateChange func()
+
+	// NameReserved, if set, returns whether a name is reserved for someone
+	// other than u, who can't take it with /nick.
+	NameReserved func(name string, u *message.User) bool
 }
 
 // NewRoom creates a new room.
 func NewRoom() *Room {
 	broadcast := make(chan message.Message, roomBuffer)
 
-	return &Room{
+	r := &Room{
 		broadcast: broadcast,
 		history:   message.NewHistory(historyLen),
 		commands:  *defaultCommands,
+		flood:     DefaultFloodControl,
 
 		Members: set.New(),
+		Filters: &Filters{},
+		Audit:   &AuditLog{},
+		Invites: NewInvites(),
+		Access:  NewAccess(),
+
+		Permissions: DefaultPermissions,
 	}
+	r.Invites.onChange = r.stateChanged
+	return r
 }
 
 // SetCommands sets the room's command handlers.
@@ -80,11 +172,17 @@ func (r *Room) SetCommands(commands Commands) {
 func (r *Room) Close() {
 	r.closeOnce.Do(func() {
 		r.closed = true
+		var members []*Member
 		r.Members.Each(func(_ string, item set.Item) error {
-			item.Value().(*Member).Close()
+			members = append(members, item.Value().(*Member))
 			return nil
 		})
+		// Cleared first, so members leaving as they're closed don't announce
+		// it to the closed room.
 		r.Members.Clear()
+		for _, member := range members {
+			member.Close()
+		}
 		close(r.broadcast)
 	})
 }
@@ -112,6 +210,16 @@ func (r *Room) HandleMsg(m message.Message) {
 				member.User.Send(m)
 			}
 			return
+		} else if ok {
+			if m = r.applyModeration(member, m); m == nil {
+				return
+			}
+			if m = r.applyFilters(member, m); m == nil {
+				return
+			}
+			if m = r.applyFloodControl(member, m); m == nil {
+				return
+			}
 		}
 	}
 
@@ -150,6 +258,80 @@ func (r *Room) HandleMsg(m message.Message) {
 	}
 }
 
+// applyModeration drops public messages from members without CapVoice while
+// the room is moderated, and returns the message to deliver or nil.
+func (r *Room) applyModeration(member *Member, m message.Message) message.Message {
+	switch m.(type) {
+	case message.PublicMsg, *message.EmoteMsg:
+	default:
+		return m
+	}
+	if !r.Moderated() || r.Permissions.Can(member.Role(), CapVoice) {
+		return m
+	}
+	member.Send(message.NewSystemMsg("Message rejected: The room is moderated, only ops and voiced users can speak.", member.User))
+	return nil
+}
+
+// applyFilters checks a message from a member against the room's filters,
+// and returns the message to deliver or nil if it should be dropped. Commands
+// and messages from ops are not filtered.
+func (r *Room) applyFilters(member *Member, m message.Message) message.Message {
+	if _, ok := m.(*message.CommandMsg); ok || member.IsOp() {
+		return m
+	}
+	msg, ok := m.(interface{ Body() string })
+	if !ok {
+		return m
+	}
+	body := msg.Body()
+	filter, n := r.Filters.Match(body)
+	if filter == nil {
+		return m
+	}
+
+	logger.Printf("Filter #%d (%s) matched message from %s: %q", n, filter.Action, member.ID(), body)
+	r.notifyOps(fmt.Sprintf("Filter #%d (%s) matched message from %s: %s", n, filter.Action, member.Name(), body))
+
+	switch filter.Action {
+	case FilterMask:
+		return withBody(m, filter.Mask(body))
+	case FilterWarn:
+		member.Send(message.NewSystemMsg("Warning: Your message matched a content filter.", member.User))
+		return m
+	case FilterMute:
+		member.MuteFor(filter.Duration)
+		member.Send(message.NewSystemMsg(fmt.Sprintf("Message rejected: Matched a content filter, you are muted for %s.", filter.Duration), member.User))
+		return nil
+	}
+	member.Send(message.NewSystemMsg("Message rejected: Matched a content filter.", member.User))
+	return nil
+}
+
+// withBody returns a copy of a user message with a different body.
+func withBody(m message.Message, body string) message.Message {
+	switch m := m.(type) {
+	case message.PublicMsg:
+		return message.NewPublicMsg(body, m.From())
+	case *message.EmoteMsg:
+		return message.NewEmoteMsg(body, m.From())
+	case *message.PrivateMsg:
+		pm := message.NewPrivateMsg(body, m.From(), m.To())
+		return &pm
+	}
+	return m
+}
+
+// notifyOps sends a system message to every op in the room.
+func (r *Room) notifyOps(body string) {
+	r.Members.Each(func(_ string, item set.Item) error {
+		if member := item.Value().(*Member); member.IsOp() {
+			member.Send(message.NewSystemMsg(body, member.User))
+		}
+		return nil
+	})
+}
+
 // Serve will consume the broadcast room and handle the messages, should be
 // run in a goroutine.
 func (r *Room) Serve() {
@@ -172,11 +354,22 @@ func (r *Room) History(u *message.User) {
 
 // Join the room as a user, will announce.
 func (r *Room) Join(u *message.User) (*Member, error) {
+	return r.JoinAs(u, RoleGuest)
+}
+
+// JoinAs joins the room as a member with a role. Unless the role is op, the
+// user is checked against the room's bans and allowlist first.
+func (r *Room) JoinAs(u *message.User, role Role) (*Member, error) {
 	// TODO: Check if closed
 	if u.ID() == "" {
 		return nil, ErrInvalidName
 	}
-	member := &Member{User: u}
+	if role < RoleModerator {
+		if err := r.Access.Check(u); err != nil {
+			return nil, err
+		}
+	}
+	member := &Member{User: u, role: role}
 	err := r.Members.Add(set.Itemize(u.ID(), member))
 	if err != nil {
 		return nil, err
@@ -185,6 +378,10 @@ func (r *Room) Join(u *message.User) (*Member, error) {
 	r.History(u)
 	s := fmt.Sprintf("%s joined. (Connected: %d)", u.Name(), r.Members.Len())
 	r.Send(message.NewAnnounceMsg(s))
+	if d := r.recordJoin(); d > 0 {
+		s := fmt.Sprintf("Join flood detected, guests without a public key are restricted for %s.", d)
+		r.Send(message.NewAnnounceMsg(s))
+	}
 	return member, nil
 }
 
@@ -243,17 +440,100 @@ func (r *Room) IsOp(u *message.User) bool {
 	if !ok {
 		return false
 	}
-	return m.IsOp
+	return m.IsOp()
+}
+
+// Can returns whether a user's role in this room has a capability.
+func (r *Room) Can(u *message.User, c Capability) bool {
+	if c == CapNone {
+		return true
+	}
+	m, ok := r.Member(u)
+	if !ok {
+		return false
+	}
+	return r.Permissions.Can(m.Role(), c)
+}
+
+// Moderated returns whether only members with CapVoice can post publicly.
+func (r *Room) Moderated() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.moderated
+}
+
+// SetModerated turns moderated mode on or off.
+func (r *Room) SetModerated(moderated bool) {
+	r.mu.Lock()
+	r.moderated = moderated
+	r.mu.Unlock()
+	r.stateChanged()
+}
+
+// InviteOnly returns whether only invited users can join.
+func (r *Room) InviteOnly() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.inviteOnly
+}
+
+// SetInviteOnly turns invite-only mode on or off.
+func (r *Room) SetInviteOnly(inviteOnly bool) {
+	r.mu.Lock()
+	r.inviteOnly = inviteOnly
+	r.mu.Unlock()
+	r.stateChanged()
 }
 
 // Topic of the room.
 func (r *Room) Topic() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	return r.topic
 }
 
 // SetTopic will set the topic of the room.
 func (r *Room) SetTopic(s string) {
+	r.SetTopicBy(s, "")
+}
+
+// SetTopicBy sets the topic of the room, recording who set it and when.
+func (r *Room) SetTopicBy(s string, name string) {
+	r.mu.Lock()
 	r.topic = s
+	r.topicBy = name
+	r.topicAt = time.Now()
+	r.mu.Unlock()
+	r.stateChanged()
+}
+
+// TopicDescription returns the topic with who set it and when, or an empty
+// string if there is no topic.
+func (r *Room) TopicDescription() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.topic == "" {
+		return ""
+	}
+	if r.topicBy == "" {
+		return "Topic: " + r.topic
+	}
+	return fmt.Sprintf("Topic: %s (set by %s at %s)", r.topic, r.topicBy, r.topicAt.UTC().Format(timeformatTopic))
+}
+
+// TopicOpsOnly returns whether only ops can set the topic.
+func (r *Room) TopicOpsOnly() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.topicOpsOnly
+}
+
+// SetTopicOpsOnly sets whether only ops can set the topic.
+func (r *Room) SetTopicOpsOnly(opsOnly bool) {
+	r.mu.Lock()
+	r.topicOpsOnly = opsOnly
+	r.mu.Unlock()
+	r.stateChanged()
 }
 
 // NamesPrefix lists all members' names with a given prefix, used to query
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/shazow/ssh-chat/chat/message"
 	"github.com/shazow/ssh-chat/set"
@@ -195,7 +197,7 @@ func TestMute(t *testing.T) {
 	muted := users[1]
 	other := users[2]
 
-	members[0].IsOp = true
+	members[0].SetRole(RoleModerator)
 
 	// test muting unexisting user
 	if err := sendCommand("/mute test", muter, ch, &buffer); err != nil {
@@ -504,3 +506,287 @@ func TestRoomNamesPrefix(t *testing.T) {
 		t.Errorf("got: %q; want: %q", got, want)
 	}
 }
+
+func TestRoomFilters(t *testing.T) {
+	var buffer []byte
+
+	ch := NewRoom()
+	go ch.Serve()
+	defer ch.Close()
+
+	users := make([]ScreenedUser, 2)
+	members := make([]*Member, 2)
+	for i := 0; i < 2; i++ {
+		screen := &MockScreen{}
+		user := message.NewUserScreen(message.SimpleID(fmt.Sprintf("user%d", i)), screen)
+		users[i] = ScreenedUser{
+			user:   user,
+			screen: screen,
+		}
+
+		member, err := ch.Join(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[i] = member
+	}
+
+	for _, u := range users {
+		for i := 0; i < 2; i++ {
+			u.user.HandleMsg(u.user.ConsumeOne())
+			u.screen.Read(&buffer)
+		}
+	}
+
+	op := users[0]
+	sender := users[1]
+	members[0].SetRole(RoleModerator)
+
+	if err := sendCommand("/filter add mask darn", op, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Added filter: mask darn"+message.Newline)
+
+	if err := sendCommand("/filter add mute:1m spam+", op, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Added filter: mute:1m0s spam+"+message.Newline)
+
+	if err := sendCommand("/filter", op, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Content filters:"+message.Newline+"   #1 mask darn"+message.Newline+"   #2 mute:1m0s spam+"+message.Newline)
+
+	if err := sendCommand("/filter add drop foo", sender, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Err: must be op"+message.Newline)
+
+	// Masked messages are delivered, ops are notified first.
+	ch.HandleMsg(message.NewPublicMsg("oh darn", sender.user))
+	op.user.HandleMsg(op.user.ConsumeOne())
+	op.screen.Read(&buffer)
+	expectOutput(t, buffer, "-> Filter #1 (mask) matched message from user1: oh darn"+message.Newline)
+	op.user.HandleMsg(op.user.ConsumeOne())
+	op.screen.Read(&buffer)
+	expectOutput(t, buffer, "user1: oh ****"+message.Newline)
+
+	// Muting drops the message and mutes the sender.
+	ch.HandleMsg(message.NewPublicMsg("spammm", sender.user))
+	op.user.HandleMsg(op.user.ConsumeOne())
+	op.screen.Read(&buffer)
+	expectOutput(t, buffer, "-> Filter #2 (mute) matched message from user1: spammm"+message.Newline)
+	sender.user.HandleMsg(sender.user.ConsumeOne()) // Own masked message
+	sender.screen.Read(&buffer)
+	sender.user.HandleMsg(sender.user.ConsumeOne())
+	sender.screen.Read(&buffer)
+	expectOutput(t, buffer, "-> Message rejected: Matched a content filter, you are muted for 1m0s."+message.Newline)
+	if !members[1].IsMuted() {
+		t.Error("sender was not muted")
+	}
+	if op.user.HasMessages() {
+		t.Error("op should not have messages")
+	}
+
+	// Ops are exempt.
+	ch.HandleMsg(message.NewPublicMsg("spammm", op.user))
+	sender.user.HandleMsg(sender.user.ConsumeOne())
+	sender.screen.Read(&buffer)
+	expectOutput(t, buffer, "user0: spammm"+message.Newline)
+	op.user.HandleMsg(op.user.ConsumeOne()) // Own message
+	op.screen.Read(&buffer)
+
+	if err := sendCommand("/filter remove 2", op, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Removed filter #2."+message.Newline)
+
+	if got := len(ch.Filters.List()); got != 1 {
+		t.Errorf("expected 1 filter, got %d", got)
+	}
+
+	// Patterns keep their escapes and quotes.
+	pattern := `\bfoo\\bar "quoted  words"`
+	if err := sendCommand("/filter add warn "+pattern, op, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Added filter: warn "+pattern+message.Newline)
+	if filters := ch.Filters.List(); len(filters) != 2 || filters[1].Pattern.String() != pattern {
+		t.Errorf("got filters: %v; want the pattern %q", filters, pattern)
+	}
+}
+
+func TestRoomModerated(t *testing.T) {
+	var buffer []byte
+
+	ch := NewRoom()
+	go ch.Serve()
+	defer ch.Close()
+
+	users := make([]ScreenedUser, 2)
+	members := make([]*Member, 2)
+	for i := 0; i < 2; i++ {
+		screen := &MockScreen{}
+		user := message.NewUserScreen(message.SimpleID(fmt.Sprintf("user%d", i)), screen)
+		users[i] = ScreenedUser{
+			user:   user,
+			screen: screen,
+		}
+
+		member, err := ch.Join(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[i] = member
+	}
+
+	for _, u := range users {
+		for i := 0; i < 2; i++ {
+			u.user.HandleMsg(u.user.ConsumeOne())
+			u.screen.Read(&buffer)
+		}
+	}
+
+	op := users[0]
+	sender := users[1]
+	members[0].SetRole(RoleModerator)
+
+	if err := sendCommand("/moderated on", op, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, " * Room is now moderated by user0, only ops and voiced users can speak."+message.Newline)
+	sender.user.HandleMsg(sender.user.ConsumeOne())
+	sender.screen.Read(&buffer)
+
+	ch.HandleMsg(message.NewPublicMsg("hello", sender.user))
+	sender.user.HandleMsg(sender.user.ConsumeOne())
+	sender.screen.Read(&buffer)
+	expectOutput(t, buffer, "-> Message rejected: The room is moderated, only ops and voiced users can speak."+message.Newline)
+	if op.user.HasMessages() {
+		t.Error("op should not have messages")
+	}
+
+	if err := sendCommand("/voice user1", op, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Voiced: user1"+message.Newline)
+	sender.user.HandleMsg(sender.user.ConsumeOne())
+	sender.screen.Read(&buffer)
+	expectOutput(t, buffer, "-> Voiced by user0."+message.Newline)
+
+	ch.HandleMsg(message.NewPublicMsg("hello", sender.user))
+	op.user.HandleMsg(op.user.ConsumeOne())
+	op.screen.Read(&buffer)
+	expectOutput(t, buffer, "user1: hello"+message.Newline)
+	sender.user.HandleMsg(sender.user.ConsumeOne()) // Own message
+	sender.screen.Read(&buffer)
+
+	if err := sendCommand("/names", op, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> 2 connected (moderated): user0, user1"+message.Newline)
+
+	if err := sendCommand("/moderated off", op, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, " * Room is no longer moderated, turned off by user0."+message.Newline)
+	if ch.Moderated() {
+		t.Error("room is still moderated")
+	}
+}
+
+func TestRoomTopic(t *testing.T) {
+	var buffer []byte
+
+	ch := NewRoom()
+	go ch.Serve()
+	defer ch.Close()
+
+	screen := &MockScreen{}
+	u := ScreenedUser{
+		user:   message.NewUserScreen(message.SimpleID("foo"), screen),
+		screen: screen,
+	}
+	member, err := ch.Join(u.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.user.HandleMsg(u.user.ConsumeOne())
+	u.screen.Read(&buffer)
+
+	if err := sendCommand("/topic", u, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> No topic is set."+message.Newline)
+
+	if err := sendCommand("/topic Release  day", u, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	if want := " * foo set the topic at "; !strings.HasPrefix(string(buffer), want) || !strings.HasSuffix(string(buffer), ": Release  day"+message.Newline) {
+		t.Errorf("unexpected announcement: %q", buffer)
+	}
+	if got, want := ch.Topic(), "Release  day"; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+
+	ch.SetTopicOpsOnly(true)
+	if err := sendCommand("/topic Hijacked", u, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Err: must be op to change the topic"+message.Newline)
+
+	member.SetRole(RoleModerator)
+	if err := sendCommand("/topic Hijacked", u, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ch.Topic(), "Hijacked"; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+}
+
+func TestMemberMuteFor(t *testing.T) {
+	m := &Member{User: message.NewUser(message.SimpleID("foo"))}
+	m.MuteFor(-time.Second)
+	if m.IsMuted() {
+		t.Error("mute did not expire")
+	}
+	m.MuteFor(time.Minute)
+	if !m.IsMuted() {
+		t.Error("not muted")
+	}
+	m.SetMute(false)
+	if m.IsMuted() {
+		t.Error("mute was not removed")
+	}
+}
+
+type fixedID struct {
+	message.SimpleID
+}
+
+func (fixedID) FixedName() bool { return true }
+
+func TestRoomNickFixed(t *testing.T) {
+	var buffer []byte
+
+	ch := NewRoom()
+	go ch.Serve()
+	defer ch.Close()
+
+	screen := &MockScreen{}
+	user := message.NewUserScreen(fixedID{"alice"}, screen)
+	mock := ScreenedUser{user: user, screen: screen}
+	if _, err := ch.Join(user); err != nil {
+		t.Fatal(err)
+	}
+	user.HandleMsg(user.ConsumeOne())
+	screen.Read(&buffer)
+
+	if err := sendCommand("/nick bob", mock, ch, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expectOutput(t, buffer, "-> Err: "+ErrFixedName.Error()+message.Newline)
+	if _, ok := ch.MemberByID("alice"); !ok {
+		t.Error("user was renamed")
+	}
+}
@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// RoomState is the part of a room's settings that is kept between restarts.
+type RoomState struct {
+	Topic        string        `json:"topic,omitempty"`
+	TopicBy      string        `json:"topic_by,omitempty"`
+	TopicAt      time.Time     `json:"topic_at,omitempty"`
+	TopicOpsOnly bool          `json:"topic_ops_only,omitempty"`
+	Moderated    bool          `json:"moderated,omitempty"`
+	InviteOnly   bool          `json:"invite_only,omitempty"`
+	SlowMode     time.Duration `json:"slow_mode,omitempty"`
+	// Invited and InviteTokens are kept with InviteOnly, so invited users
+	// can still join after a restart.
+	Invited      []InviteState `json:"invited,omitempty"`
+	InviteTokens []InviteState `json:"invite_tokens,omitempty"`
+}
+
+// State returns the room's current settings.
+func (r *Room) State() RoomState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return RoomState{
+		Topic:        r.topic,
+		TopicBy:      r.topicBy,
+		TopicAt:      r.topicAt,
+		TopicOpsOnly: r.topicOpsOnly,
+		Moderated:    r.moderated,
+		InviteOnly:   r.inviteOnly,
+		SlowMode:     r.slowMode,
+		Invited:      inviteStates(r.Invites.keys),
+		InviteTokens: inviteStates(r.Invites.tokens),
+	}
+}
+
+// SetState replaces the room's settings, without calling OnStateChange.
+func (r *Room) SetState(state RoomState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.topic = state.Topic
+	r.topicBy = state.TopicBy
+	r.topicAt = state.TopicAt
+	r.topicOpsOnly = state.TopicOpsOnly
+	r.moderated = state.Moderated
+	r.inviteOnly = state.InviteOnly
+	r.slowMode = state.SlowMode
+	setInviteStates(r.Invites.keys, state.Invited)
+	setInviteStates(r.Invites.tokens, state.InviteTokens)
+}
+
+// LoadState reads the room's settings as JSON.
+func (r *Room) LoadState(rd io.Reader) error {
+	var state RoomState
+	if err := json.NewDecoder(rd).Decode(&state); err != nil {
+		return err
+	}
+	r.SetState(state)
+	return nil
+}
+
+// SaveState writes the room's settings as JSON.
+func (r *Room) SaveState(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.State())
+}
+
+func (r *Room) stateChanged() {
+	if r.OnStateChange != nil {
+		r.OnStateChange()
+	}
+}
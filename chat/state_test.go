@@ -0,0 +1,72 @@
+package chat
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRoomState(t *testing.T) {
+	room := NewRoom()
+	changes := 0
+	room.OnStateChange = func() { changes++ }
+
+	room.SetTopicBy("hello", "foo")
+	room.SetTopicOpsOnly(true)
+	room.SetModerated(true)
+	room.SetSlowMode(time.Minute)
+	room.Invites.Invite("SHA256:alice", 0)
+	room.Invites.Invite("SHA256:bob", time.Hour)
+	token, err := room.Invites.NewToken(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes != 7 {
+		t.Errorf("OnStateChange called %d times, want 7", changes)
+	}
+
+	var buf bytes.Buffer
+	if err := room.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewRoom()
+	if err := loaded.LoadState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, want := loaded.State(), room.State()
+	if !got.TopicAt.Equal(want.TopicAt) {
+		t.Errorf("got topic time: %s; want: %s", got.TopicAt, want.TopicAt)
+	}
+	got.TopicAt, want.TopicAt = time.Time{}, time.Time{}
+	for i, invites := range [][2][]InviteState{{got.Invited, want.Invited}, {got.InviteTokens, want.InviteTokens}} {
+		if len(invites[0]) != len(invites[1]) {
+			t.Fatalf("%d: got invites: %v; want: %v", i, invites[0], invites[1])
+		}
+		for j := range invites[0] {
+			if invites[0][j].Key != invites[1][j].Key || !invites[0][j].Expires.Equal(invites[1][j].Expires) {
+				t.Errorf("%d: got invite: %v; want: %v", i, invites[0][j], invites[1][j])
+			}
+		}
+	}
+	got.Invited, want.Invited = nil, nil
+	got.InviteTokens, want.InviteTokens = nil, nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %+v; want: %+v", got, want)
+	}
+	if !loaded.Invites.Invited("SHA256:alice") || !loaded.Invites.Invited("SHA256:bob") {
+		t.Error("invited keys weren't loaded")
+	}
+	if !loaded.Invites.UseToken(token) {
+		t.Error("invite token wasn't loaded")
+	}
+
+	// Expired invites are dropped.
+	state := room.State()
+	state.Invited = []InviteState{{Key: "SHA256:carol", Expires: time.Now().Add(-time.Minute)}}
+	loaded.SetState(state)
+	if loaded.Invites.Invited("SHA256:carol") || loaded.Invites.Invited("SHA256:alice") {
+		t.Error("got invites which expired or weren't in the state")
+	}
+}
@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// zoneinfoDirs are where the system's time zone database may be installed.
+var zoneinfoDirs = []string{
+	"/usr/share/zoneinfo",
+	"/usr/share/lib/zoneinfo",
+	"/usr/lib/locale/TZ",
+}
+
+var (
+	timezonesOnce sync.Once
+	timezones     []string
+)
+
+// Timezones returns the sorted names of the time zones in the system's
+// database, like Europe/Berlin, which time.LoadLocation accepts. It's empty if
+// there's no database. The database is only read once.
+func Timezones() []string {
+	timezonesOnce.Do(func() {
+		for _, dir := range zoneinfoDirs {
+			timezones = readTimezones(dir)
+			if len(timezones) > 0 {
+				return
+			}
+		}
+	})
+	return timezones
+}
+
+// readTimezones lists the zone files under dir, skipping the posix and right
+// copies of the database.
+func readTimezones(dir string) []string {
+	var names []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if name == "posix" || name == "right" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if name != "posixrules" && isZoneFile(path) {
+			names = append(names, filepath.ToSlash(name))
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names
+}
+
+// isZoneFile returns whether the file at path is in the TZif format, rather
+// than one of the tables that come with the database.
+func isZoneFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte("TZif"))
+}
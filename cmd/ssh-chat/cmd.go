@@ -1,18 +1,24 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"os/user"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/alexcesaro/log"
 	"github.com/alexcesaro/log/golog"
 	flags "github.com/jessevdk/go-flags"
+	"github.com/shazow/rateio"
 	"golang.org/x/crypto/ssh"
 
 	sshchat "github.com/shazow/ssh-chat"
@@ -28,17 +34,46 @@ var Version string = "dev"
 
 // Options contains the flag options
 type Options struct {
-	Admin      string   `long:"admin" description:"File of public keys who are admins."`
-	Bind       string   `long:"bind" description:"Host and port to listen on." default:"0.0.0.0:2022"`
+	Admin      string   `long:"admin" description:"File of public keys who are admins. Can also be an http(s) URL, a directory of per-user key files, or a shell command prefixed with exec:."`
+	AuditLog   string   `long:"audit-log" description:"File to append moderation actions to, as JSON lines."`
+	Banner     string   `long:"banner" description:"Optional file with a message to show clients before they authenticate."`
+	Bind       []string `long:"bind" description:"Host and port to listen on, unix:PATH for a unix socket, or systemd for the sockets passed by systemd socket activation. Can be repeated." default:"0.0.0.0:2022"`
+	Bots       []string `long:"bot" description:"Built-in bot to add to the room, can be repeated: remind for !remind 10m MESSAGE, dice for !roll 2d6, or karma for thing++ and !karma THING." choice:"remind" choice:"dice" choice:"karma"`
+	CertAuth   string   `long:"cert-authority" description:"File of certificate authority public keys trusted to sign user certificates."`
 	Identity   []string `short:"i" long:"identity" description:"Private key to identify server with." default:"~/.ssh/id_rsa"`
+	Filters    string   `long:"filters" description:"File of content filters to load, changes are saved back to it."`
+	Lobby      bool     `long:"lobby" description:"Let keys which aren't on the allowlist connect to a lobby, where they can request access from the admins."`
 	Log        string   `long:"log" description:"Write chat log to this file."`
 	Motd       string   `long:"motd" description:"Optional Message of the Day file."`
+	Proxies    []string `long:"proxy-protocol" description:"Address or CIDR range of a load balancer trusted to send PROXY protocol headers with the client's address, can be repeated."`
 	Pprof      int      `long:"pprof" description:"Enable pprof http server for profiling."`
 	Verbose    []bool   `short:"v" long:"verbose" description:"Show verbose logging."`
 	Version    bool     `long:"version" description:"Print version and exit."`
-	Allowlist  string   `long:"allowlist" description:"Optional file of public keys who are allowed to connect."`
+	Allowlist  string   `long:"allowlist" description:"Optional file of public keys who are allowed to connect. Can be any source --admin can."`
 	Whitelist  string   `long:"whitelist" dexcription:"Old name for allowlist option"`
+	SaveKeys   bool     `long:"save-keys" description:"Write keys added to or removed from the admins and allowlist back to their files, keeping comments."`
+	State      string   `long:"state" description:"File to keep room state like the topic in, changes are saved back to it."`
+	Roles      string   `long:"roles" description:"File of public key fingerprints and their roles, changes are saved back to it. Without it, roles assigned with /op and /role only last until a restart."`
 	Passphrase string   `long:"unsafe-passphrase" description:"Require an interactive passphrase to connect. Allowlist feature is more secure."`
+	PasteLines int      `long:"paste-lines" description:"Maximum number of lines to accept as one message when pasting, 0 to disable." default:"20"`
+
+	MsgRate       int           `long:"msg-rate" description:"Number of messages a user can send per rate window." default:"3"`
+	MsgRateWindow time.Duration `long:"msg-rate-window" description:"Window for the message rate limit." default:"3s"`
+	RepeatLimit   int           `long:"repeat-limit" description:"Identical messages in a row before a user is muted, 0 to disable." default:"3"`
+	JoinLimit     int           `long:"join-limit" description:"Joins per minute before guests without a public key are restricted, 0 to disable." default:"20"`
+	FloodRestrict time.Duration `long:"flood-restrict" description:"How long flood mutes and guest restrictions last." default:"5m"`
+	KeyRefresh    time.Duration `long:"key-refresh" description:"How often to reload the admin, allowlist and certificate authority keys, 0 to disable." default:"0"`
+
+	KeyTypes      []string `long:"key-type" description:"Public key type to accept, like ssh-ed25519, can be repeated. Defaults to all types."`
+	MinRSABits    int      `long:"min-rsa-bits" description:"Minimum size of RSA keys, like 2048. Defaults to 0, which accepts RSA keys of any size." default:"0"`
+	OpSecurityKey bool     `long:"op-security-key" description:"Only give admins their role when they connect with a FIDO security key."`
+
+	OpTOTP      string        `long:"op-totp" description:"File of admin key fingerprints and their base32 TOTP secrets. Admins only get their role after giving a code with /elevate."`
+	OpTOTPLogin bool          `long:"op-totp-login" description:"Ask admins for their TOTP code when they connect."`
+	OpElevation time.Duration `long:"op-elevation" description:"How long elevating with a TOTP code lasts, 0 to never expire." default:"1h"`
+
+	OpPrincipals        []string `long:"op-principal" description:"Certificate principal who is an admin, can be repeated."`
+	AllowlistPrincipals []string `long:"allowlist-principal" description:"Certificate principal who is allowed to connect, can be repeated."`
 }
 
 const extraHelp = `There are hidden options and easter eggs in ssh-chat. The source code is a good
@@ -125,24 +160,66 @@ func main() {
 		fmt.Printf("Added server identity: %s\n", sshd.Fingerprint(signer.PublicKey()))
 	}
 
-	s, err := sshd.ListenSSH(options.Bind, config)
-	if err != nil {
-		fail(4, "Failed to listen on socket: %v\n", err)
+	var sockets []net.Listener
+	for _, bind := range options.Bind {
+		listeners, err := listen(bind)
+		if err != nil {
+			fail(4, "Failed to listen on socket %s: %v\n", bind, err)
+		}
+		sockets = append(sockets, listeners...)
 	}
+	s := sshd.NewSSHListener(sshd.MultiListener(sockets...), config)
 	defer s.Close()
 	s.RateLimit = sshd.NewInputLimiter
+	s.TrustedProxies, err = sshd.ParseTrustedProxies(options.Proxies)
+	if err != nil {
+		fail(16, "Failed to parse trusted proxies: %v\n", err)
+	}
 
-	fmt.Printf("Listening for connections on %v\n", s.Addr().String())
+	for _, socket := range sockets {
+		fmt.Printf("Listening for connections on %v\n", socket.Addr().String())
+	}
 
 	host := sshchat.NewHost(s, auth)
 	host.SetTheme(message.Themes[0])
 	host.Version = Version
+	host.PasteLines = options.PasteLines
+	host.RateLimit = func() rateio.Limiter {
+		return rateio.NewSimpleLimiter(options.MsgRate, options.MsgRateWindow)
+	}
+	host.SetFloodControl(chat.FloodControl{
+		RepeatLimit: options.RepeatLimit,
+		JoinLimit:   options.JoinLimit,
+		RestrictFor: options.FloodRestrict,
+	})
 
 	if options.Passphrase != "" {
 		auth.SetPassphrase(options.Passphrase)
 	}
+	auth.SetKeyPolicy(sshd.KeyPolicy{
+		Algorithms: options.KeyTypes,
+		MinRSABits: options.MinRSABits,
+	})
+	auth.SetOpsRequireSecurityKey(options.OpSecurityKey)
+
+	if options.OpTOTP != "" {
+		if err := loadFile(options.OpTOTP, auth.LoadTOTPSecrets); err != nil {
+			fail(15, "Failed to load TOTP secrets file: %v\n", err)
+		}
+		auth.SetOpsRequireTOTP(true)
+		auth.SetTOTPAtLogin(options.OpTOTPLogin)
+		auth.SetElevation(options.OpElevation)
+	}
+
+	if options.Banner != "" {
+		banner, err := ioutil.ReadFile(options.Banner)
+		if err != nil {
+			fail(14, "Failed to load banner file: %v\n", err)
+		}
+		auth.SetBanner(string(banner))
+	}
 
-	err = auth.LoadOps(loaderFromFile(options.Admin, logger))
+	err = auth.LoadOps(keyLoader(options.Admin, logger))
 	if err != nil {
 		fail(5, "Failed to load admins: %v\n", err)
 	}
@@ -151,11 +228,39 @@ func main() {
 		fmt.Println("--whitelist was renamed to --allowlist.")
 		options.Allowlist = options.Whitelist
 	}
-	err = auth.LoadAllowlist(loaderFromFile(options.Allowlist, logger))
+	err = auth.LoadAllowlist(keyLoader(options.Allowlist, logger))
 	if err != nil {
 		fail(6, "Failed to load allowlist: %v\n", err)
 	}
-	auth.SetAllowlistMode(options.Allowlist != "")
+	auth.SetAllowlistMode(options.Allowlist != "" || len(options.AllowlistPrincipals) != 0)
+	if options.SaveKeys {
+		if isKeyFile(options.Admin) {
+			auth.OnOpsChange = func() {
+				if err := rewriteFile(options.Admin, auth.SaveOps); err != nil {
+					logger.Errorf("Failed to save admin file: %v", err)
+				}
+			}
+		}
+		if isKeyFile(options.Allowlist) {
+			auth.OnAllowlistChange = func() {
+				if err := rewriteFile(options.Allowlist, auth.SaveAllowlist); err != nil {
+					logger.Errorf("Failed to save allowlist file: %v", err)
+				}
+			}
+		}
+	}
+	auth.SetLobby(options.Lobby)
+
+	err = auth.LoadCertAuthorities(keyLoader(options.CertAuth, logger))
+	if err != nil {
+		fail(13, "Failed to load certificate authorities: %v\n", err)
+	}
+	for _, principal := range options.OpPrincipals {
+		auth.OpPrincipal(principal, 0)
+	}
+	for _, principal := range options.AllowlistPrincipals {
+		auth.AllowlistPrincipal(principal, 0)
+	}
 
 	if options.Motd != "" {
 		host.GetMOTD = func() (string, error) {
@@ -176,6 +281,50 @@ func main() {
 		}
 	}
 
+	if options.Filters != "" {
+		if err := loadFile(options.Filters, host.Filters.Load); err != nil {
+			fail(9, "Failed to load filters file: %v\n", err)
+		}
+		host.Filters.OnChange = func() {
+			if err := saveFile(options.Filters, host.Filters.Save); err != nil {
+				logger.Errorf("Failed to save filters file: %v", err)
+			}
+		}
+	}
+
+	if options.State != "" {
+		if err := loadFile(options.State, host.LoadState); err != nil {
+			fail(12, "Failed to load state file: %v\n", err)
+		}
+		host.OnStateChange = func() {
+			if err := saveFile(options.State, host.SaveState); err != nil {
+				logger.Errorf("Failed to save state file: %v", err)
+			}
+		}
+	}
+
+	if options.Roles != "" {
+		if err := loadFile(options.Roles, auth.LoadRoles); err != nil {
+			fail(11, "Failed to load roles file: %v\n", err)
+		}
+		auth.OnRolesChange = func() {
+			if err := saveFile(options.Roles, auth.SaveRoles); err != nil {
+				logger.Errorf("Failed to save roles file: %v", err)
+			}
+		}
+	}
+
+	if options.AuditLog != "" {
+		fp, err := os.OpenFile(options.AuditLog, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+		if err != nil {
+			fail(10, "Failed to open audit log file: %v\n", err)
+		}
+		if err := host.Audit.Load(fp); err != nil {
+			fail(10, "Failed to read audit log file: %v\n", err)
+		}
+		host.Audit.Sink = fp
+	}
+
 	if options.Log == "-" {
 		host.SetLogging(os.Stdout)
 	} else if options.Log != "" {
@@ -186,6 +335,21 @@ func main() {
 		host.SetLogging(fp)
 	}
 
+	if options.KeyRefresh > 0 {
+		go auth.RefreshKeys(options.KeyRefresh, nil)
+	}
+
+	bots := map[string]func() chat.Bot{
+		"remind": chat.NewRemindBot,
+		"dice":   chat.NewDiceBot,
+		"karma":  chat.NewKarmaBot,
+	}
+	for _, name := range options.Bots {
+		if err := host.AddBot(bots[name]()); err != nil {
+			fail(17, "Failed to add bot %s: %v\n", name, err)
+		}
+	}
+
 	go host.Serve()
 
 	// Construct interrupt handler
@@ -196,6 +360,73 @@ func main() {
 	fmt.Fprintln(os.Stderr, "Interrupt signal detected, shutting down.")
 }
 
+// unixPrefix marks a bind address which is the path of a unix socket.
+const unixPrefix = "unix:"
+
+// listen returns the sockets for a bind address: a host and port, a unix
+// socket path prefixed with unix:, or systemd for the sockets passed by
+// systemd socket activation.
+func listen(bind string) ([]net.Listener, error) {
+	switch {
+	case bind == "systemd":
+		sockets, err := sshd.SystemdListeners()
+		if err == nil && len(sockets) == 0 {
+			err = errors.New("no sockets passed by systemd")
+		}
+		return sockets, err
+	case strings.HasPrefix(bind, unixPrefix):
+		socket, err := sshd.ListenUnix(strings.TrimPrefix(bind, unixPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{socket}, nil
+	}
+	socket, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{socket}, nil
+}
+
+// commandPrefix marks a key source which is a command to run, rather than a
+// file path.
+const commandPrefix = "exec:"
+
+// keyLoader returns a loader for the keys at source, which is an http(s) URL,
+// a directory of per-user key files, a shell command prefixed with exec:, or a
+// file.
+func keyLoader(source string, logger *golog.Logger) sshchat.KeyLoader {
+	switch {
+	case source == "":
+		return nil
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		return sshchat.URLKeyLoader(source, nil)
+	case strings.HasPrefix(source, commandPrefix):
+		command := strings.TrimSpace(strings.TrimPrefix(source, commandPrefix))
+		if command == "" {
+			return func() ([]ssh.PublicKey, error) {
+				return nil, fmt.Errorf("missing command: %q", source)
+			}
+		}
+		// Run by the shell, so arguments can be quoted.
+		return sshchat.CommandKeyLoader("sh", "-c", command)
+	}
+	if info, err := os.Stat(source); err == nil && info.IsDir() {
+		return sshchat.DirKeyLoader(source)
+	}
+	return loaderFromFile(source, logger)
+}
+
+// isKeyFile returns whether a key source is a file, which changes can be
+// written back to.
+func isKeyFile(source string) bool {
+	if source == "" || strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") || strings.HasPrefix(source, commandPrefix) {
+		return false
+	}
+	info, err := os.Stat(source)
+	return err != nil || !info.IsDir()
+}
+
 func loaderFromFile(path string, logger *golog.Logger) sshchat.KeyLoader {
 	if path == "" {
 		return nil
@@ -207,17 +438,9 @@ func loaderFromFile(path string, logger *golog.Logger) sshchat.KeyLoader {
 		}
 		defer file.Close()
 
-		var keys []ssh.PublicKey
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			key, _, _, _, err := ssh.ParseAuthorizedKey(scanner.Bytes())
-			if err != nil {
-				if err.Error() == "ssh: no key found" {
-					continue // Skip line
-				}
-				return nil, err
-			}
-			keys = append(keys, key)
+		keys, err := sshchat.ParseAuthorizedKeys(file)
+		if err != nil {
+			return nil, err
 		}
 		if keys == nil {
 			logger.Warning("file", path, "contained no keys")
@@ -225,3 +448,55 @@ func loaderFromFile(path string, logger *golog.Logger) sshchat.KeyLoader {
 		return keys, nil
 	}
 }
+
+// loadFile reads the file at path with load, if it exists.
+func loadFile(path string, load func(io.Reader) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Created on the first change.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	return load(file)
+}
+
+// rewriteFile replaces the file at path with the output of rewrite, which
+// reads its current contents, if it exists, atomically like saveFile.
+func rewriteFile(path string, rewrite func(io.Reader, io.Writer) error) error {
+	current, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return saveFile(path, func(w io.Writer) error {
+		return rewrite(bytes.NewReader(current), w)
+	})
+}
+
+// saveFile replaces the file at path with the output of save atomically, so
+// that a failed write doesn't lose the previous contents. The file keeps its
+// mode.
+func saveFile(path string, save func(io.Writer) error) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := save(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	// Keep the mode of the file being replaced, rather than the temporary
+	// file's 0600.
+	if info, err := os.Stat(path); err == nil {
+		if err := os.Chmod(file.Name(), info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return os.Rename(file.Name(), path)
+}
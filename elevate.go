@@ -0,0 +1,72 @@
+package sshchat
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shazow/ssh-chat/chat"
+	"github.com/shazow/ssh-chat/chat/message"
+	"github.com/shazow/ssh-chat/sshd"
+)
+
+// elevateAtLogin asks an op who needs a TOTP code for it before they join, and
+// returns when their elevation expires and whether they elevated. They can
+// skip it, and /elevate later.
+func (h *Host) elevateAtLogin(term *sshd.Terminal) (time.Time, bool, error) {
+	code, err := term.ReadPassword("TOTP code to become an op, or enter to skip: ")
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if strings.TrimSpace(code) == "" {
+		term.Write([]byte("Use /elevate CODE to become an op later." + message.Newline))
+		return time.Time{}, false, nil
+	}
+	until, err := h.auth.Elevate(term.Conn.PublicKey(), code)
+	if err != nil {
+		logger.Debugf("[%s] Failed to elevate: %s", term.Conn.RemoteAddr(), err)
+		term.Write([]byte(fmt.Sprintf("Not elevated: %s. Use /elevate CODE to try again.", err) + message.Newline))
+		return time.Time{}, false, nil
+	}
+	return until, true, nil
+}
+
+// elevate makes a member an op with a TOTP code, until their elevation
+// expires.
+func (h *Host) elevate(member *chat.Member, code string) (time.Time, error) {
+	key := member.Identifier.(*Identity).PublicKey()
+	if key == nil {
+		return time.Time{}, errors.New("must connect with a public key")
+	}
+	if !h.auth.NeedsElevation(key) {
+		return time.Time{}, errors.New("nothing to elevate to")
+	}
+	until, err := h.auth.Elevate(key, code)
+	if err != nil {
+		return time.Time{}, err
+	}
+	member.SetRole(h.auth.KeyRole(key))
+	h.demoteAfterElevation(member, until)
+	return until, nil
+}
+
+// demoteAfterElevation sets a member back to the role of their key when their
+// elevation expires at until, unless it's zero.
+func (h *Host) demoteAfterElevation(member *chat.Member, until time.Time) {
+	if until.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(until), func() {
+		if current, ok := h.MemberByID(member.ID()); !ok || current != member {
+			return
+		}
+		role := h.auth.KeyRole(member.Identifier.(*Identity).PublicKey())
+		if role >= member.Role() {
+			// Elevated again, or given a role since.
+			return
+		}
+		member.SetRole(role)
+		member.Send(message.NewSystemMsg("Your op elevation expired, use /elevate CODE to renew it.", member.User))
+	})
+}
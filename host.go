@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -18,10 +19,29 @@ import (
 	"github.com/shazow/ssh-chat/internal/sanitize"
 	"github.com/shazow/ssh-chat/set"
 	"github.com/shazow/ssh-chat/sshd"
+	"github.com/shazow/ssh-chat/sshd/terminal"
 )
 
 const maxInputLength int = 1024
 
+// inviteSeparator separates an invite token from the name in an SSH username,
+// like alice+TOKEN.
+const inviteSeparator = "+"
+
+// inviteToken returns the invite token given by a connection, either in the
+// SSHCHAT_INVITE env var or as a username suffix.
+func inviteToken(term *sshd.Terminal) string {
+	for _, e := range term.Env() {
+		if e.Key == "SSHCHAT_INVITE" && e.Value != "" {
+			return e.Value
+		}
+	}
+	if parts := strings.SplitN(term.Conn.Name(), inviteSeparator, 2); len(parts) == 2 {
+		return parts[1]
+	}
+	return ""
+}
+
 // GetPrompt will render the terminal prompt string based on the user.
 func GetPrompt(user *message.User) string {
 	name := user.Name()
@@ -39,10 +59,18 @@ type Host struct {
 	listener *sshd.SSHListener
 	commands chat.Commands
 	auth     *Auth
+	lobby    *lobby
 
 	// Version string to print on /version
 	Version string
 
+	// PasteLines is the maximum number of lines accepted as a single
+	// multi-line message when pasting, 0 disables multi-line pastes.
+	PasteLines int
+
+	// RateLimit creates the limiter for each connection's messages.
+	RateLimit func() rateio.Limiter
+
 	// Default theme
 	theme message.Theme
 
@@ -64,8 +92,14 @@ func NewHost(listener *sshd.SSHListener, auth *Auth) *Host {
 		listener: listener,
 		commands: chat.Commands{},
 		auth:     auth,
+		lobby:    newLobby(),
+		RateLimit: func() rateio.Limiter {
+			return rateio.NewSimpleLimiter(3, time.Second*3)
+		},
 	}
 
+	room.NameReserved = h.nameReserved
+
 	// Make our own commands registry instance.
 	chat.InitCommands(&h.commands)
 	h.InitCommands(&h.commands)
@@ -90,17 +124,33 @@ func (h *Host) SetMotd(motd string) {
 	h.mu.Unlock()
 }
 
-func (h *Host) isOp(conn sshd.Connection) bool {
-	key := conn.PublicKey()
-	if key == nil {
+// checkInvite returns whether a connection can join the room, which it can
+// unless the room is invite-only and it's not an op or invited. A valid
+// invite token is consumed, and invites the connection's key from then on.
+func (h *Host) checkInvite(term *sshd.Terminal) bool {
+	if !h.InviteOnly() {
+		return true
+	}
+	key := term.Conn.PublicKey()
+	fingerprint := newAuthKey(key)
+	if h.auth.IsOp(key) || h.Invites.Invited(fingerprint) {
+		return true
+	}
+	if !h.Invites.UseToken(inviteToken(term)) {
 		return false
 	}
-	return h.auth.IsOp(key)
+	if fingerprint != "" {
+		h.Invites.Invite(fingerprint, 0)
+	}
+	return true
 }
 
 // Connect a specific Terminal to this host and its room.
 func (h *Host) Connect(term *sshd.Terminal) {
 	id := NewIdentity(term.Conn)
+	if h.auth != nil {
+		id.SetAuthorizedKey(h.auth.AuthorizedKey(term.Conn.PublicKey()))
+	}
 	user := message.NewUserScreen(id, term)
 	user.OnChange = func() {
 		term.SetPrompt(GetPrompt(user))
@@ -125,26 +175,69 @@ func (h *Host) Connect(term *sshd.Terminal) {
 	defer user.Close()
 	defer term.Close()
 
+	if !h.checkInvite(term) {
+		logger.Debugf("[%s] Rejected without an invite: %s", term.Conn.RemoteAddr(), user.Name())
+		term.Write([]byte("This room is invite-only, ask an op for an invite." + message.Newline))
+		return
+	}
+
+	// Ops who need a TOTP code can give it now, or /elevate later.
+	var elevated bool
+	var elevatedUntil time.Time
+	if h.auth != nil && h.auth.TOTPAtLogin() && !apiMode && h.auth.NeedsElevation(term.Conn.PublicKey()) && h.auth.HasTOTPSecret(term.Conn.PublicKey()) {
+		var err error
+		if elevatedUntil, elevated, err = h.elevateAtLogin(term); err != nil {
+			return
+		}
+	}
+
+	// The room checks its bans and allowlist again on join, but checking
+	// first avoids sending the MOTD to someone who will be rejected.
+	role := h.auth.KeyRole(term.Conn.PublicKey())
+	if role < chat.RoleModerator {
+		if err := h.Access.Check(user); err != nil {
+			logger.Debugf("[%s] Rejected by room: %s", term.Conn.RemoteAddr(), err)
+			term.Write([]byte(fmt.Sprintf("Rejected: %s.", err) + message.Newline))
+			return
+		}
+	}
+
 	h.mu.Lock()
 	motd := h.motd
-	count := h.count
-	h.count++
 	h.mu.Unlock()
+	guestName := h.guestName()
 
-	// Send MOTD
+	pasteLines := h.PasteLines
+	if apiMode {
+		pasteLines = 0
+	}
+	if pasteLines > 0 {
+		term.SetBracketedPasteMode(true)
+		term.SetMultilinePaste(pasteLines)
+	}
+
+	// Send MOTD and topic
 	if motd != "" && !apiMode {
 		user.Send(message.NewAnnounceMsg(motd))
 	}
 
-	member, err := h.Join(user)
-	if err != nil {
-		// Try again...
-		id.SetName(fmt.Sprintf("Guest%d", count))
-		member, err = h.Join(user)
-	}
-	if err != nil {
-		logger.Errorf("[%s] Failed to join: %s", term.Conn.RemoteAddr(), err)
-		return
+	// Keys which aren't allowlisted wait in the lobby, outside the room, until
+	// an op approves them.
+	quarantined := h.auth != nil && h.auth.Quarantined(term.Conn.PublicKey())
+	if quarantined {
+		h.lobby.Add(user, apiMode)
+		defer h.lobby.Remove(user)
+		user.Send(message.NewSystemMsg(lobbyHelp, user))
+		logger.Debugf("[%s] Waiting in the lobby: %s", term.Conn.RemoteAddr(), user.Name())
+	} else {
+		member, err := h.join(user, role, apiMode, guestName)
+		if err != nil {
+			logger.Errorf("[%s] Failed to join: %s", term.Conn.RemoteAddr(), err)
+			return
+		}
+		if elevated {
+			h.demoteAfterElevation(member, elevatedUntil)
+		}
 	}
 
 	// Load user config overrides from ENV
@@ -179,16 +272,10 @@ func (h *Host) Connect(term *sshd.Terminal) {
 		user.SetHighlight(user.Name())
 	}
 
-	// Should the user be op'd on join?
-	if h.isOp(term.Conn) {
-		member.IsOp = true
-	}
-	ratelimit := rateio.NewSimpleLimiter(3, time.Second*3)
-
-	logger.Debugf("[%s] Joined: %s", term.Conn.RemoteAddr(), user.Name())
+	ratelimit := h.RateLimit()
 
-	if h.OnUserJoined != nil {
-		h.OnUserJoined(user)
+	if !quarantined {
+		h.joined(user)
 	}
 
 	for {
@@ -196,7 +283,10 @@ func (h *Host) Connect(term *sshd.Terminal) {
 		if err == io.EOF {
 			// Closed
 			break
-		} else if err != nil {
+		} else if err == terminal.ErrPasteTooLong {
+			user.Send(message.NewSystemMsg(fmt.Sprintf("Message rejected: Pasted more than %d lines.", pasteLines), user))
+			continue
+		} else if err != nil && err != terminal.ErrPasteIndicator {
 			logger.Errorf("[%s] Terminal reading error: %s", term.Conn.RemoteAddr(), err)
 			break
 		}
@@ -206,7 +296,7 @@ func (h *Host) Connect(term *sshd.Terminal) {
 			user.Send(message.NewSystemMsg("Message rejected: Rate limiting is in effect.", user))
 			continue
 		}
-		if len(line) > maxInputLength {
+		if inputTooLong(line) {
 			user.Send(message.NewSystemMsg("Message rejected: Input too long.", user))
 			continue
 		}
@@ -216,7 +306,13 @@ func (h *Host) Connect(term *sshd.Terminal) {
 			continue
 		}
 
-		m := message.ParseInput(line, user)
+		var m message.Message
+		if strings.Contains(line, "\n") {
+			// Multi-line pastes are sent as-is, never as commands.
+			m = message.NewPublicMsg(line, user)
+		} else {
+			m = message.ParseInput(line, user)
+		}
 
 		if !apiMode {
 			if m, ok := m.(*message.CommandMsg); ok {
@@ -226,6 +322,15 @@ func (h *Host) Connect(term *sshd.Terminal) {
 			}
 		}
 
+		if _, ok := h.Member(user); !ok && h.lobby.Waiting(user) {
+			h.handleLobbyInput(user, m)
+			continue
+		} else if !ok {
+			// Removed from the room, but still connected.
+			user.Send(message.NewSystemMsg("You are no longer in the room, disconnect to leave.", user))
+			continue
+		}
+
 		// FIXME: Any reason to use h.room.Send(m) instead?
 		h.HandleMsg(m)
 
@@ -235,98 +340,316 @@ func (h *Host) Connect(term *sshd.Terminal) {
 		}
 	}
 
-	err = h.Leave(user)
-	if err != nil {
+	if pasteLines > 0 {
+		term.SetBracketedPasteMode(false)
+	}
+
+	if _, ok := h.Member(user); !ok {
+		logger.Debugf("[%s] Disconnected outside the room: %s", term.Conn.RemoteAddr(), user.Name())
+		return
+	}
+	if err := h.Leave(user); err != nil {
 		logger.Errorf("[%s] Failed to leave: %s", term.Conn.RemoteAddr(), err)
 		return
 	}
 	logger.Debugf("[%s] Leaving: %s", term.Conn.RemoteAddr(), user.Name())
 }
 
+// join joins a connected user to the room with role, after sending them the
+// topic unless they're a bot. If their name is invalid, taken, or reserved for
+// another key, they're renamed to guestName. If their name is forced by their key, a
+// member who took it is renamed instead.
+func (h *Host) join(user *message.User, role chat.Role, apiMode bool, guestName string) (*chat.Member, error) {
+	id := user.Identifier.(*Identity)
+	if topic := h.TopicDescription(); topic != "" && !apiMode {
+		user.Send(message.NewAnnounceMsg(topic))
+	}
+	if id.ID() == "" {
+		// Sanitizing rejects names of only symbols, or which mix scripts.
+		id.SetName(guestName)
+		user.Send(message.NewSystemMsg(fmt.Sprintf("Your name was rejected as invalid or confusable with another, you joined as %s. Use /nick to pick another.", guestName), user))
+	} else if id.FixedName() {
+		h.renameSquatter(id.ID())
+	} else if h.nameReserved(id.ID(), user) {
+		id.SetName(guestName)
+	}
+	member, err := h.JoinAs(user, role)
+	if err == set.ErrCollision || err == chat.ErrInvalidName {
+		// Try again...
+		id.SetName(guestName)
+		member, err = h.JoinAs(user, role)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Connections without a public key are treated as guests by flood
+	// control.
+	member.Guest = id.PublicKey() == nil
+	return member, nil
+}
+
+// guestName returns a new name like Guest3, for users whose name is taken.
+func (h *Host) guestName() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	count := h.count
+	h.count++
+	return fmt.Sprintf("Guest%d", count)
+}
+
+// nameReserved returns whether a name is forced by the key of someone other
+// than u.
+func (h *Host) nameReserved(name string, u *message.User) bool {
+	if h.auth == nil {
+		return false
+	}
+	id, ok := u.Identifier.(*Identity)
+	if !ok {
+		return false
+	}
+	return h.auth.NameReserved(name, id.PublicKey())
+}
+
+// renameSquatter renames the member who took a name forced by someone else's
+// key to a guest name, unless their own key forces it too.
+func (h *Host) renameSquatter(name string) {
+	squatter, ok := h.MemberByID(name)
+	if !ok {
+		return
+	}
+	if id, ok := squatter.Identifier.(*Identity); ok && id.FixedName() {
+		return
+	}
+	newName := h.guestName()
+	squatter.SetID(newName)
+	if err := h.Rename(name, squatter); err != nil {
+		squatter.SetID(name)
+		logger.Errorf("Failed to rename %q from a reserved name: %s", name, err)
+		return
+	}
+	squatter.Send(message.NewSystemMsg(fmt.Sprintf("Your name is reserved for someone else, you were renamed to %s.", newName), squatter.User))
+}
+
+// joined logs a user joining the room, and notifies OnUserJoined.
+func (h *Host) joined(user *message.User) {
+	logger.Debugf("[%s] Joined: %s", user.Identifier.(*Identity).RemoteAddr(), user.Name())
+
+	if h.OnUserJoined != nil {
+		h.OnUserJoined(user)
+	}
+}
+
+// inputTooLong checks each line of the input against maxInputLength.
+func inputTooLong(input string) bool {
+	for _, line := range strings.Split(input, "\n") {
+		if len(line) > maxInputLength {
+			return true
+		}
+	}
+	return false
+}
+
+// AddCommand registers a command with the host's room, alongside the built-in
+// ones, which it replaces if it has the same prefix. Commands should be added
+// before Serve.
+func (h *Host) AddCommand(cmd chat.Command) error {
+	return h.commands.Add(cmd)
+}
+
+// AddBot joins a bot to the host's room, as a guest without a key. The bot
+// leaves when it's kicked or the host is closed.
+func (h *Host) AddBot(bot chat.Bot) error {
+	_, err := h.JoinBot(bot, NewIdentity(botConn{name: bot.Name()}))
+	return err
+}
+
 // Serve our chat room onto the listener
 func (h *Host) Serve() {
 	h.listener.HandlerFunc = h.Connect
 	h.listener.Serve()
 }
 
-func (h *Host) completeName(partial string, skipName string) string {
-	names := h.NamesPrefix(partial)
-	if len(names) == 0 {
-		// Didn't find anything
-		return ""
-	} else if name := names[0]; name != skipName {
-		// First name is not the skipName, great
-		return name
-	} else if len(names) > 1 {
-		// Next candidate
-		return names[1]
+// maxCompletionsListed is how many candidates are listed when tab completion
+// is ambiguous.
+const maxCompletionsListed = 20
+
+// completion is the state of tab completion between presses of tab, so that
+// pressing it again replaces the last completion with the next candidate.
+type completion struct {
+	line       string // The line after the last completion
+	pos        int
+	start      int      // Where the completed word starts
+	candidates []string // Including their suffix, like "alice: "
+	next       int
+}
+
+// completeName returns the names of members which start with partial, most
+// recently active first, without skipName.
+func (h *Host) completeName(partial string, skipName string) []string {
+	var names []string
+	for _, name := range h.NamesPrefix(partial) {
+		if name != skipName {
+			names = append(names, name)
+		}
 	}
-	return ""
+	return names
 }
 
-func (h *Host) completeCommand(partial string) string {
-	for cmd := range h.commands {
-		if strings.HasPrefix(cmd, partial) {
-			return cmd
+// completeCommand returns the sorted commands which start with partial, and
+// which u can run.
+func (h *Host) completeCommand(u *message.User, partial string) []string {
+	var prefixes []string
+	for prefix, cmd := range h.commands {
+		if strings.HasPrefix(prefix, partial) && h.Can(u, cmd.Capability) {
+			prefixes = append(prefixes, prefix)
 		}
 	}
-	return ""
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// completeArg returns the candidates to complete the last argument of a
+// command line split into fields, which start with the partial argument, and
+// whether the command knows how to complete it. Commands the user can't run
+// complete nothing.
+func (h *Host) completeArg(u *message.User, fields []string) ([]string, bool) {
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "/") {
+		return nil, false
+	}
+	cmd, ok := h.commands[fields[0]]
+	if !ok {
+		return nil, false
+	}
+	if !h.Can(u, cmd.Capability) {
+		// Nothing to complete, rather than falling back to names.
+		return nil, true
+	}
+	candidates, ok := cmd.Completions(h.Room, u, fields[1:])
+	partial := fields[len(fields)-1]
+	var matching []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, partial) {
+			matching = append(matching, candidate)
+		}
+	}
+	return matching, ok
+}
+
+// completions returns the candidates to complete the word before pos in line,
+// with the suffix to add after them.
+func (h *Host) completions(u *message.User, line string, fields []string) []string {
+	isFirst := len(fields) < 2
+	partial := ""
+	if len(fields) > 0 {
+		partial = fields[len(fields)-1]
+	}
+
+	var candidates []string
+	suffix := " "
+	if isFirst && strings.HasPrefix(line, "/") {
+		// Command
+		candidates = h.completeCommand(u, partial)
+		for i, completed := range candidates {
+			if completed != "/reply" {
+				continue
+			}
+			replyTo := u.ReplyTo()
+			if replyTo != nil {
+				name := replyTo.ID()
+				_, found := h.GetUser(name)
+				if found {
+					candidates[i] = "/msg " + name
+				} else {
+					u.SetReplyTo(nil)
+				}
+			}
+		}
+	} else if matching, known := h.completeArg(u, fields); known {
+		// Argument the command knows how to complete
+		candidates = matching
+	} else {
+		// Name
+		candidates = h.completeName(partial, u.Name())
+		if isFirst {
+			suffix = ": "
+		}
+	}
+
+	for i, completed := range candidates {
+		// Query keys like ip= are followed by their value.
+		if !strings.HasSuffix(completed, "=") {
+			candidates[i] = completed + suffix
+		}
+	}
+	return candidates
 }
 
-// AutoCompleteFunction returns a callback for terminal autocompletion
+// listCompletions shows u the candidates of an ambiguous completion.
+func listCompletions(u *message.User, candidates []string) {
+	listed := make([]string, 0, len(candidates))
+	for i, candidate := range candidates {
+		if i == maxCompletionsListed {
+			listed = append(listed, fmt.Sprintf("and %d more", len(candidates)-i))
+			break
+		}
+		listed = append(listed, strings.TrimRight(candidate, ": "))
+	}
+	u.Send(message.NewSystemMsg("Completions: "+strings.Join(listed, ", "), u))
+}
+
+// AutoCompleteFunction returns a callback for terminal autocompletion. When
+// there are several candidates, the first is completed and the others are
+// listed, and pressing tab again cycles through them.
 func (h *Host) AutoCompleteFunction(u *message.User) func(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
+	var last completion
 	return func(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
 		if key != 9 {
 			return
 		}
 
+		if len(last.candidates) > 1 && line == last.line && pos == last.pos {
+			// Tab again, replace the last completion with the next candidate
+			completed := last.candidates[last.next]
+			last.next = (last.next + 1) % len(last.candidates)
+			newLine = line[:last.start] + completed + line[pos:]
+			newPos = last.start + len(completed)
+			last.line, last.pos = newLine, newPos
+			return newLine, newPos, true
+		}
+		last = completion{}
+
 		if line == "" || strings.HasSuffix(line[:pos], " ") {
 			// Don't autocomplete spaces.
 			return
 		}
 
 		fields := strings.Fields(line[:pos])
-		isFirst := len(fields) < 2
 		partial := ""
 		if len(fields) > 0 {
 			partial = fields[len(fields)-1]
 		}
 		posPartial := pos - len(partial)
 
-		var completed string
-		if isFirst && strings.HasPrefix(line, "/") {
-			// Command
-			completed = h.completeCommand(partial)
-			if completed == "/reply" {
-				replyTo := u.ReplyTo()
-				if replyTo != nil {
-					name := replyTo.ID()
-					_, found := h.GetUser(name)
-					if found {
-						completed = "/msg " + name
-					} else {
-						u.SetReplyTo(nil)
-					}
-				}
-			}
-		} else {
-			// Name
-			completed = h.completeName(partial, u.Name())
-			if completed == "" {
-				return
-			}
-			if isFirst {
-				completed += ":"
-			}
+		candidates := h.completions(u, line, fields)
+		if len(candidates) == 0 {
+			return
+		}
+		if len(candidates) > 1 {
+			listCompletions(u, candidates)
 		}
-		completed += " "
+		completed := candidates[0]
 
 		// Reposition the cursor
-		newLine = strings.Replace(line[posPartial:], partial, completed, 1)
-		newLine = line[:posPartial] + newLine
-		newPos = pos + (len(completed) - len(partial))
-		ok = true
-		return
+		newLine = line[:posPartial] + completed + line[pos:]
+		newPos = posPartial + len(completed)
+		last = completion{
+			line:       newLine,
+			pos:        newPos,
+			start:      posPartial,
+			candidates: candidates,
+			next:       1 % len(candidates),
+		}
+		return newLine, newPos, true
 	}
 }
 
@@ -374,7 +697,7 @@ func (h *Host) InitCommands(c *chat.Commands) {
 				return errors.New("user not found")
 			}
 
-			return sendPM(room, strings.Join(args[1:], " "), msg.From(), target)
+			return sendPM(room, msg.Rest(1), msg.From(), target)
 		},
 	})
 
@@ -399,7 +722,7 @@ func (h *Host) InitCommands(c *chat.Commands) {
 				return errors.New("user not found")
 			}
 
-			return sendPM(room, strings.Join(args, " "), msg.From(), target)
+			return sendPM(room, msg.Rest(0), msg.From(), target)
 		},
 	})
 
@@ -451,15 +774,11 @@ func (h *Host) InitCommands(c *chat.Commands) {
 
 	// Op commands
 	c.Add(chat.Command{
-		Op:         true,
+		Capability: chat.CapModerate,
 		Prefix:     "/kick",
 		PrefixHelp: "USER",
 		Help:       "Kick USER from the server.",
 		Handler: func(room *chat.Room, msg message.CommandMsg) error {
-			if !room.IsOp(msg.From()) {
-				return errors.New("must be op")
-			}
-
 			args := msg.Args()
 			if len(args) == 0 {
 				return errors.New("must specify user")
@@ -470,6 +789,7 @@ func (h *Host) InitCommands(c *chat.Commands) {
 				return errors.New("user not found")
 			}
 
+			room.Audit.Record(msg.From(), "kick", target.ID())
 			body := fmt.Sprintf("%s was kicked by %s.", target.Name(), msg.From().Name())
 			room.Send(message.NewAnnounceMsg(body))
 			target.Close()
@@ -478,16 +798,12 @@ func (h *Host) InitCommands(c *chat.Commands) {
 	})
 
 	c.Add(chat.Command{
-		Op:         true,
+		Capability: chat.CapModerate,
 		Prefix:     "/ban",
 		PrefixHelp: "QUERY [DURATION]",
-		Help:       "Ban from the server. QUERY can be a username to ban the fingerprint and ip, or quoted \"key=value\" pairs with keys like ip, fingerprint, client.",
+		Help:       "Ban from the server. QUERY can be a username to ban the fingerprint and ip, or key=value pairs with keys like ip, fingerprint, client, with values quoted like client=\"foo bar\" if they have spaces.",
 		Handler: func(room *chat.Room, msg message.CommandMsg) error {
 			// TODO: Would be nice to specify what to ban. Key? Ip? etc.
-			if !room.IsOp(msg.From()) {
-				return errors.New("must be op")
-			}
-
 			args := msg.Args()
 			if len(args) == 0 {
 				return errors.New("must specify user")
@@ -496,9 +812,13 @@ func (h *Host) InitCommands(c *chat.Commands) {
 			query := args[0]
 			target, ok := h.GetUser(query)
 			if !ok {
-				query = strings.Join(args, " ")
+				query = msg.Rest(0)
 				if strings.Contains(query, "=") {
-					return h.auth.BanQuery(query)
+					if err := h.auth.BanQuery(query); err != nil {
+						return err
+					}
+					room.Audit.Record(msg.From(), "ban", "", args...)
+					return nil
 				}
 				return errors.New("user not found")
 			}
@@ -511,6 +831,7 @@ func (h *Host) InitCommands(c *chat.Commands) {
 			id := target.Identifier.(*Identity)
 			h.auth.Ban(id.PublicKey(), until)
 			h.auth.BanAddr(id.RemoteAddr(), until)
+			room.Audit.Record(msg.From(), "ban", target.ID(), args[1:]...)
 
 			body := fmt.Sprintf("%s was banned by %s.", target.Name(), msg.From().Name())
 			room.Send(message.NewAnnounceMsg(body))
@@ -520,17 +841,16 @@ func (h *Host) InitCommands(c *chat.Commands) {
 
 			return nil
 		},
+		Complete: func(room *chat.Room, from *message.User, args []string) []string {
+			return chat.CompleteQuery(room, args)
+		},
 	})
 
 	c.Add(chat.Command{
-		Op:     true,
-		Prefix: "/banned",
-		Help:   "List the current ban conditions.",
+		Capability: chat.CapModerate,
+		Prefix:     "/banned",
+		Help:       "List the current ban conditions.",
 		Handler: func(room *chat.Room, msg message.CommandMsg) error {
-			if !room.IsOp(msg.From()) {
-				return errors.New("must be op")
-			}
-
 			bannedIPs, bannedFingerprints, bannedClients := h.auth.Banned()
 
 			buf := bytes.Buffer{}
@@ -551,8 +871,172 @@ func (h *Host) InitCommands(c *chat.Commands) {
 		},
 	})
 
+	// roomQuery resolves a connected user's name, or a query like
+	// "ip=1.2.3.4 client=foo 10m", to the fields to match against.
+	roomQuery := func(room *chat.Room, args []string) ([]chat.QueryField, time.Duration, *chat.Member, error) {
+		if len(args) == 0 {
+			return nil, 0, nil, errors.New("must specify user or query")
+		}
+		target, ok := room.MemberByID(args[0])
+		if !ok {
+			if !strings.Contains(args[0], "=") {
+				return nil, 0, nil, errors.New("user not found")
+			}
+			fields, until, err := chat.ParseQueryArgs(args)
+			return fields, until, nil, err
+		}
+
+		var until time.Duration
+		if len(args) > 1 {
+			var err error
+			if until, err = time.ParseDuration(args[1]); err != nil {
+				return nil, 0, nil, err
+			}
+		}
+		id := target.Identifier.(*Identity)
+		var fields []chat.QueryField
+		// Everyone on a unix socket shares its address.
+		if ip := id.IP(); ip != unixAddr {
+			fields = append(fields, chat.QueryField{Key: "ip", Value: ip})
+		}
+		if fingerprint := id.Fingerprint(); fingerprint != "" {
+			fields = append(fields, chat.QueryField{Key: "fingerprint", Value: fingerprint})
+		}
+		if len(fields) == 0 {
+			return nil, 0, nil, errors.New("user has no IP or public key to match")
+		}
+		return fields, until, target, nil
+	}
+
+	roomHelptext := []string{
+		"Usage: /room ban {USER|QUERY} [DURATION] | unban QUERY | banned | allowlist {on | off | add {USER|QUERY} [DURATION] | remove QUERY | status}",
+		"ban: remove USER from the room and keep them or anyone matching QUERY from joining",
+		"unban: lift a room ban",
+		"banned: list the room's bans",
+		"allowlist on, off: only let users on the room's allowlist join (applies to new joins)",
+		"allowlist add, remove: add or remove users from the room's allowlist",
+		"allowlist status: show the room's allowlist",
+		"QUERY is space-separated key=value pairs with keys like ip, fingerprint, client.",
+	}
+
+	roomAllowlist := func(room *chat.Room, args []string) (msgs []string, err error) {
+		if len(args) == 0 {
+			return nil, errors.New("missing allowlist subcommand")
+		}
+		switch args[0] {
+		case "on":
+			room.Access.SetAllowlistMode(true)
+		case "off":
+			room.Access.SetAllowlistMode(false)
+		case "add":
+			fields, until, _, err := roomQuery(room, args[1:])
+			if err != nil {
+				return nil, err
+			}
+			room.Access.Allow(fields, until)
+		case "remove":
+			fields, _, _, err := roomQuery(room, args[1:])
+			if err != nil {
+				return nil, err
+			}
+			room.Access.Disallow(fields)
+		case "status":
+			if room.Access.AllowlistMode() {
+				msgs = []string{"Room allowlist enabled"}
+			} else {
+				msgs = []string{"Room allowlist disabled"}
+			}
+			for _, field := range room.Access.Allowed() {
+				msgs = append(msgs, fmt.Sprintf("   %q", field))
+			}
+		default:
+			return nil, errors.New("invalid allowlist subcommand: " + args[0])
+		}
+		return msgs, nil
+	}
+
+	c.Add(chat.Command{
+		Capability: chat.CapModerate,
+		Prefix:     "/room",
+		PrefixHelp: "COMMAND [ARGS...]",
+		Help:       "Manage the room's own bans and allowlist, which keep users out of the room without disconnecting them. See /room help for subcommands",
+		Handler: func(room *chat.Room, msg message.CommandMsg) (err error) {
+			args := msg.Args()
+			if len(args) == 0 {
+				args = []string{"help"}
+			}
+
+			var replyLines []string
+			switch args[0] {
+			case "help":
+				replyLines = roomHelptext
+			case "ban":
+				fields, until, target, err := roomQuery(room, args[1:])
+				if err != nil {
+					return err
+				}
+				if target != nil && target.IsOp() {
+					return errors.New("cannot ban an op from the room")
+				}
+				room.Access.Ban(fields, until)
+				if target == nil {
+					room.Audit.Record(msg.From(), "room ban", "", args[1:]...)
+					replyLines = []string{"Banned from the room."}
+					break
+				}
+				room.Audit.Record(msg.From(), "room ban", target.ID(), args[2:]...)
+				target.Send(message.NewSystemMsg(fmt.Sprintf("You were banned from the room by %s.", msg.From().Name()), target.User))
+				// Announced as a ban rather than with Leave's message.
+				if err := room.Members.Remove(target.ID()); err != nil {
+					return err
+				}
+				room.Send(message.NewAnnounceMsg(fmt.Sprintf("%s was banned from the room by %s.", target.Name(), msg.From().Name())))
+			case "unban":
+				fields, _, _, err := roomQuery(room, args[1:])
+				if err != nil {
+					return err
+				}
+				room.Access.Unban(fields)
+				room.Audit.Record(msg.From(), "room unban", "", args[1:]...)
+				replyLines = []string{"Unbanned from the room."}
+			case "banned":
+				replyLines = []string{"Banned from the room:"}
+				for _, field := range room.Access.Banned() {
+					replyLines = append(replyLines, fmt.Sprintf("   %q", field))
+				}
+			case "allowlist":
+				replyLines, err = roomAllowlist(room, args[1:])
+				if err == nil && len(args) > 1 && args[1] != "status" {
+					room.Audit.Record(msg.From(), "room allowlist", "", args[1:]...)
+				}
+			default:
+				err = errors.New("invalid subcommand: " + args[0])
+			}
+			if err == nil && replyLines != nil {
+				room.Send(message.NewSystemMsg(strings.Join(replyLines, "\r\n"), msg.From()))
+			}
+			return
+		},
+		Complete: func(room *chat.Room, from *message.User, args []string) []string {
+			if len(args) == 1 {
+				return []string{"help", "ban", "unban", "banned", "allowlist"}
+			}
+			switch args[0] {
+			case "ban", "unban":
+				return chat.CompleteQuery(room, args[1:])
+			case "allowlist":
+				if len(args) == 2 {
+					return []string{"on", "off", "add", "remove", "status"}
+				}
+				if args[1] == "add" || args[1] == "remove" {
+					return chat.CompleteQuery(room, args[2:])
+				}
+			}
+			return nil
+		},
+	})
+
 	c.Add(chat.Command{
-		Op:         true,
 		Prefix:     "/motd",
 		PrefixHelp: "[MESSAGE]",
 		Help:       "Set a new MESSAGE of the day, or print the motd if no MESSAGE.",
@@ -568,12 +1052,12 @@ func (h *Host) InitCommands(c *chat.Commands) {
 				room.Send(message.NewSystemMsg(motd, user))
 				return nil
 			}
-			if !room.IsOp(user) {
+			if !room.Can(user, chat.CapModerate) {
 				return errors.New("must be OP to modify the MOTD")
 			}
 
 			var err error
-			var s string = strings.Join(args, " ")
+			var s string = msg.Rest(0)
 
 			if s == "@" {
 				if h.GetMOTD == nil {
@@ -585,6 +1069,7 @@ func (h *Host) InitCommands(c *chat.Commands) {
 			}
 
 			h.SetMotd(s)
+			room.Audit.Record(msg.From(), "motd", "", s)
 			fromMsg := fmt.Sprintf("New message of the day set by %s:", msg.From().Name())
 			room.Send(message.NewAnnounceMsg(fromMsg + message.Newline + "-> " + s))
 
@@ -593,15 +1078,11 @@ func (h *Host) InitCommands(c *chat.Commands) {
 	})
 
 	c.Add(chat.Command{
-		Op:         true,
+		Capability: chat.CapAdmin,
 		Prefix:     "/op",
 		PrefixHelp: "USER [DURATION|remove]",
 		Help:       "Set USER as admin. Duration only applies to pubkey reconnects.",
 		Handler: func(room *chat.Room, msg message.CommandMsg) error {
-			if !room.IsOp(msg.From()) {
-				return errors.New("must be op")
-			}
-
 			args := msg.Args()
 			if len(args) == 0 {
 				return errors.New("must specify user")
@@ -611,8 +1092,6 @@ func (h *Host) InitCommands(c *chat.Commands) {
 			var until time.Duration
 			if len(args) > 1 {
 				if args[1] == "remove" {
-					// Expire instantly
-					until = time.Duration(1)
 					opValue = false
 				} else {
 					until, _ = time.ParseDuration(args[1])
@@ -623,13 +1102,32 @@ func (h *Host) InitCommands(c *chat.Commands) {
 			if !ok {
 				return errors.New("user not found")
 			}
-			member.IsOp = opValue
-
 			id := member.Identifier.(*Identity)
-			h.auth.Op(id.PublicKey(), until)
+			if opValue && h.auth.OpsRequireSecurityKey() && !sshd.IsSecurityKey(id.PublicKey()) {
+				return ErrSecurityKeyRequired
+			}
 
-			var body string
+			// The key is added to or removed from the ops, rather than given a
+			// role, so that --save-keys writes it to the admin file. A role
+			// assigned to it would take precedence, so it's removed.
+			h.auth.RemoveRole(id.Fingerprint())
 			if opValue {
+				h.auth.Op(id.PublicKey(), until)
+			} else {
+				h.auth.Deop(id.PublicKey())
+			}
+			role := h.auth.KeyRole(id.PublicKey())
+			if id.PublicKey() == nil && opValue {
+				// Without a key, they're only op until they disconnect.
+				role = chat.RoleModerator
+			}
+			member.SetRole(role)
+			room.Audit.Record(msg.From(), "op", member.ID(), args[1:]...)
+
+			var body string
+			if opValue && h.auth.NeedsElevation(id.PublicKey()) {
+				body = fmt.Sprintf("Made op by %s, use /elevate CODE to become an op.", msg.From().Name())
+			} else if opValue {
 				body = fmt.Sprintf("Made op by %s.", msg.From().Name())
 			} else {
 				body = fmt.Sprintf("Removed op by %s.", msg.From().Name())
@@ -641,15 +1139,182 @@ func (h *Host) InitCommands(c *chat.Commands) {
 	})
 
 	c.Add(chat.Command{
-		Op:         true,
+		Prefix:     "/elevate",
+		PrefixHelp: "CODE",
+		Help:       "Become an op with a TOTP code, if your key needs one to.",
+		Handler: func(room *chat.Room, msg message.CommandMsg) error {
+			args := msg.Args()
+			if len(args) != 1 {
+				return errors.New("must specify TOTP code")
+			}
+			member, ok := room.MemberByID(msg.From().ID())
+			if !ok {
+				return errors.New("must be in the room")
+			}
+			until, err := h.elevate(member, args[0])
+			if err != nil {
+				return err
+			}
+			room.Audit.Record(msg.From(), "elevate", member.ID())
+
+			body := "Elevated to op."
+			if !until.IsZero() {
+				body = fmt.Sprintf("Elevated to op for %s.", time.Until(until).Round(time.Minute))
+			}
+			room.Send(message.NewSystemMsg(body, msg.From()))
+			return nil
+		},
+	})
+
+	c.Add(chat.Command{
+		Capability: chat.CapModerate,
+		Prefix:     "/invite",
+		PrefixHelp: "[USER|FINGERPRINT] [DURATION]",
+		Help:       "Invite USER or a public key FINGERPRINT to the invite-only room, or generate a one-time invite token if neither is given.",
+		Handler: func(room *chat.Room, msg message.CommandMsg) error {
+			args := msg.Args()
+
+			var fingerprint, name string
+			if len(args) > 0 {
+				if member, ok := room.MemberByID(args[0]); ok {
+					fingerprint = member.Identifier.(*Identity).Fingerprint()
+					if fingerprint == "" {
+						return errors.New("user does not have a public key")
+					}
+					name = member.Name()
+					args = args[1:]
+				} else if strings.HasPrefix(args[0], "SHA256:") {
+					fingerprint = args[0]
+					name = fingerprint
+					args = args[1:]
+				}
+			}
+			if len(args) > 1 {
+				return errors.New("user not found")
+			}
+
+			var until time.Duration
+			if len(args) == 1 {
+				var err error
+				if until, err = time.ParseDuration(args[0]); err != nil {
+					if fingerprint == "" {
+						return errors.New("user not found")
+					}
+					return err
+				}
+			}
+
+			if fingerprint != "" {
+				room.Invites.Invite(fingerprint, until)
+				room.Audit.Record(msg.From(), "invite", name, msg.Args()[1:]...)
+				room.Send(message.NewSystemMsg("Invited: "+name, msg.From()))
+				return nil
+			}
+
+			if until == 0 {
+				until = chat.DefaultTokenDuration
+			}
+			token, err := room.Invites.NewToken(until)
+			if err != nil {
+				return err
+			}
+			room.Audit.Record(msg.From(), "invite", "", msg.Args()...)
+			body := fmt.Sprintf("Invite token, valid once for %s: %s"+message.Newline+
+				"-> Connect with SSHCHAT_INVITE=%s set, or as USER%s%s@host.", until, token, token, inviteSeparator, token)
+			room.Send(message.NewSystemMsg(body, msg.From()))
+			return nil
+		},
+	})
+
+	c.Add(chat.Command{
+		Capability: chat.CapAdmin,
+		Prefix:     "/role",
+		PrefixHelp: "USER|FINGERPRINT|principal:NAME [ROLE [DURATION]]",
+		Help:       "Show or set the role of USER, a public key FINGERPRINT or a certificate principal. ROLE is one of guest, voice, moderator or owner.",
+		Handler: func(room *chat.Room, msg message.CommandMsg) error {
+			args := msg.Args()
+			if len(args) == 0 {
+				return errors.New("must specify user or fingerprint")
+			}
+
+			var fingerprint string
+			member, ok := room.MemberByID(args[0])
+			if ok {
+				fingerprint = member.Identifier.(*Identity).Fingerprint()
+			} else if strings.HasPrefix(args[0], "SHA256:") || strings.HasPrefix(args[0], principalPrefix) {
+				fingerprint = args[0]
+			} else {
+				return errors.New("user not found")
+			}
+
+			if len(args) == 1 {
+				role := h.auth.Role(fingerprint)
+				if member != nil {
+					role = member.Role()
+				}
+				room.Send(message.NewSystemMsg(fmt.Sprintf("%s is %s.", args[0], role), msg.From()))
+				return nil
+			}
+
+			role, err := chat.ParseRole(args[1])
+			if err != nil {
+				return err
+			}
+			if member != nil && role >= chat.RoleModerator && h.auth.OpsRequireSecurityKey() &&
+				!sshd.IsSecurityKey(member.Identifier.(*Identity).PublicKey()) {
+				return ErrSecurityKeyRequired
+			}
+			var until time.Duration
+			if len(args) > 2 {
+				if until, err = time.ParseDuration(args[2]); err != nil {
+					return err
+				}
+			}
+			h.auth.SetRole(fingerprint, role, until)
+
+			// Update everyone connected with the key or principal, or just
+			// the user if they don't have a key.
+			var members []*chat.Member
+			if fingerprint == "" {
+				members = append(members, member)
+			} else {
+				h.Members.Each(func(_ string, item set.Item) error {
+					m, ok := item.Value().(*chat.Member)
+					if !ok {
+						return nil
+					}
+					for _, authkey := range h.auth.authKeys(m.Identifier.(*Identity).PublicKey()) {
+						if strings.EqualFold(authkey, fingerprint) {
+							members = append(members, m)
+							break
+						}
+					}
+					return nil
+				})
+			}
+			for _, m := range members {
+				// A key's other entries may still grant a higher role.
+				memberRole := role
+				if fingerprint != "" {
+					memberRole = h.auth.KeyRole(m.Identifier.(*Identity).PublicKey())
+				}
+				m.SetRole(memberRole)
+				body := fmt.Sprintf("Role set to %s by %s.", memberRole, msg.From().Name())
+				room.Send(message.NewSystemMsg(body, m.User))
+			}
+
+			room.Audit.Record(msg.From(), "role", args[0], args[1:]...)
+			room.Send(message.NewSystemMsg(fmt.Sprintf("%s is now %s.", args[0], role), msg.From()))
+			return nil
+		},
+	})
+
+	c.Add(chat.Command{
+		Capability: chat.CapModerate,
 		Prefix:     "/rename",
 		PrefixHelp: "USER NEW_NAME [SYMBOL]",
 		Help:       "Rename USER to NEW_NAME, add optional SYMBOL prefix",
 		Handler: func(room *chat.Room, msg message.CommandMsg) error {
-			if !room.IsOp(msg.From()) {
-				return errors.New("must be op")
-			}
-
 			args := msg.Args()
 			if len(args) < 2 {
 				return errors.New("must specify user and new name")
@@ -682,6 +1347,7 @@ func (h *Host) InitCommands(c *chat.Commands) {
 				if member.User.OnChange != nil {
 					member.User.OnChange()
 				}
+				room.Audit.Record(msg.From(), "rename", oldID, args[1:]...)
 				return nil
 			}
 
@@ -692,6 +1358,7 @@ func (h *Host) InitCommands(c *chat.Commands) {
 				return err
 			}
 
+			room.Audit.Record(msg.From(), "rename", oldID, args[1:]...)
 			body := fmt.Sprintf("%s was renamed by %s.", oldID, msg.From().Name())
 			room.Send(message.NewAnnounceMsg(body))
 
@@ -755,13 +1422,14 @@ func (h *Host) InitCommands(c *chat.Commands) {
 	}
 
 	allowlistHelptext := []string{
-		"Usage: /allowlist help | on | off | add {PUBKEY|USER}... | remove {PUBKEY|USER}... | import [AGE] | reload {keep|flush} | reverify | status",
+		"Usage: /allowlist help | on | off | add {PUBKEY|USER}... | remove {PUBKEY|USER}... | import [AGE] | reload {keep|flush} | reverify | approve {FINGERPRINT|USER} | deny {FINGERPRINT|USER} | status",
 		"help: this help message",
 		"on, off: set allowlist mode (applies to new connections)",
 		"add, remove: add or remove keys from the allowlist",
 		"import: add all keys of users connected since AGE (default 0) ago to the allowlist",
 		"reload: re-read the allowlist file and keep or discard entries in the current allowlist but not in the file",
 		"reverify: kick all users not in the allowlist if allowlisting is enabled",
+		"approve, deny: add a key waiting in the lobby to the allowlist and let them in, or disconnect them",
 		"status: show status information",
 	}
 
@@ -798,7 +1466,7 @@ func (h *Host) InitCommands(c *chat.Commands) {
 		if args[0] == "flush" {
 			h.auth.allowlist.Clear()
 		}
-		return h.auth.ReloadAllowlist()
+		return h.auth.reloadAllowlist(args[0] == "flush")
 	}
 
 	allowlistReverify := func(room *chat.Room) []string {
@@ -807,7 +1475,7 @@ func (h *Host) InitCommands(c *chat.Commands) {
 		}
 		var kicked []string
 		forConnectedUsers(func(user *chat.Member, pk ssh.PublicKey) error {
-			if h.auth.CheckPublicKey(pk) != nil && !user.IsOp { // we do this check here as well for ops without keys
+			if !h.auth.allowlisted(pk) && !h.auth.IsOp(pk) && !user.IsOp() { // we do this check here as well for ops without keys
 				kicked = append(kicked, user.Name())
 				user.Close()
 			}
@@ -829,15 +1497,20 @@ func (h *Host) InitCommands(c *chat.Commands) {
 		allowlistedKeys := []string{}
 		h.auth.allowlist.Each(func(key string, item set.Item) error {
 			keyFP := item.Key()
+			// Keys loaded with a comment are labelled with it.
+			var label string
+			if authorized, ok := item.Value().(*AuthorizedKey); ok && authorized.Comment != "" {
+				label = " (" + sanitize.Data(authorized.Comment, 64) + ")"
+			}
 			if forConnectedUsers(func(user *chat.Member, pk ssh.PublicKey) error {
 				if pk != nil && sshd.Fingerprint(pk) == keyFP {
-					allowlistedUsers = append(allowlistedUsers, user.Name())
+					allowlistedUsers = append(allowlistedUsers, user.Name()+label)
 					return io.EOF
 				}
 				return nil
 			}) == nil {
 				// if we land here, the key matches no users
-				allowlistedKeys = append(allowlistedKeys, keyFP)
+				allowlistedKeys = append(allowlistedKeys, keyFP+label)
 			}
 			return nil
 		})
@@ -847,19 +1520,60 @@ func (h *Host) InitCommands(c *chat.Commands) {
 		if len(allowlistedKeys) != 0 {
 			msgs = append(msgs, "Keys on the allowlist without connected user: "+strings.Join(allowlistedKeys, ", "))
 		}
+		if requests := h.lobby.Requests(); len(requests) != 0 {
+			msgs = append(msgs, "Requesting access from the lobby:")
+			for _, req := range requests {
+				msgs = append(msgs, "   "+req)
+			}
+		}
 		return
 	}
 
+	allowlistApprove := func(from *message.User, args []string) error {
+		if len(args) != 1 {
+			return errors.New("must specify one fingerprint or user")
+		}
+		reqs, err := h.lobby.Take(args[0])
+		if err != nil {
+			return err
+		}
+		var failed []string
+		for _, req := range reqs {
+			h.auth.Allowlist(req.user.Identifier.(*Identity).PublicKey(), 0)
+			if err := h.admit(req, from); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", req.user.Name(), err))
+			}
+		}
+		if len(failed) > 0 {
+			return errors.New("failed to admit " + strings.Join(failed, ", "))
+		}
+		return nil
+	}
+
+	allowlistDeny := func(from *message.User, args []string) ([]string, error) {
+		if len(args) != 1 {
+			return nil, errors.New("must specify one fingerprint or user")
+		}
+		reqs, err := h.lobby.Take(args[0])
+		if err != nil {
+			return nil, err
+		}
+		var denied []string
+		for _, req := range reqs {
+			u := req.user
+			u.Send(message.NewSystemMsg(fmt.Sprintf("Access denied by %s.", from.Name()), u))
+			u.Close()
+			denied = append(denied, u.Name())
+		}
+		return []string{"Denied access: " + strings.Join(denied, ", ")}, nil
+	}
+
 	c.Add(chat.Command{
-		Op:         true,
+		Capability: chat.CapAdmin,
 		Prefix:     "/allowlist",
 		PrefixHelp: "COMMAND [ARGS...]",
 		Help:       "Modify the allowlist or allowlist state. See /allowlist help for subcommands",
 		Handler: func(room *chat.Room, msg message.CommandMsg) (err error) {
-			if !room.IsOp(msg.From()) {
-				return errors.New("must be op")
-			}
-
 			args := msg.Args()
 			if len(args) == 0 {
 				args = []string{"help"}
@@ -885,15 +1599,44 @@ func (h *Host) InitCommands(c *chat.Commands) {
 				err = allowlistReload(args[1:])
 			case "reverify":
 				replyLines = allowlistReverify(room)
+			case "approve":
+				err = allowlistApprove(msg.From(), args[1:])
+			case "deny":
+				replyLines, err = allowlistDeny(msg.From(), args[1:])
 			case "status":
 				replyLines = allowlistStatus()
 			default:
 				err = errors.New("invalid subcommand: " + args[0])
 			}
+			switch args[0] {
+			case "help", "status":
+			default:
+				if err == nil {
+					room.Audit.Record(msg.From(), "allowlist", "", args...)
+				}
+			}
 			if err == nil && replyLines != nil {
 				room.Send(message.NewSystemMsg(strings.Join(replyLines, "\r\n"), msg.From()))
 			}
 			return
 		},
+		Complete: func(room *chat.Room, from *message.User, args []string) []string {
+			if len(args) == 1 {
+				return []string{"help", "on", "off", "add", "remove", "import", "reload", "reverify", "approve", "deny", "status"}
+			}
+			switch args[0] {
+			case "add", "remove":
+				return room.NamesPrefix(args[len(args)-1])
+			case "reload":
+				if len(args) == 2 {
+					return []string{"keep", "flush"}
+				}
+			case "approve", "deny":
+				if len(args) == 2 {
+					return h.lobby.Names()
+				}
+			}
+			return nil
+		},
 	})
 }
@@ -2,13 +2,17 @@ package sshchat
 
 import (
 	"bufio"
+	"encoding/base32"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	mathRand "math/rand"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/shazow/ssh-chat/chat"
 	"github.com/shazow/ssh-chat/chat/message"
 	"github.com/shazow/ssh-chat/sshd"
 	"golang.org/x/crypto/ssh"
@@ -250,9 +254,9 @@ func TestHostAllowlistCommand(t *testing.T) {
 
 		sendCmd("/allowlist")
 		assertLineEq("Err: must be op\r")
-		m.IsOp = true
+		m.SetRole(chat.RoleOwner)
 		sendCmd("/allowlist")
-		for _, expected := range [...]string{"Usage", "help", "on, off", "add, remove", "import", "reload", "reverify", "status"} {
+		for _, expected := range [...]string{"Usage", "help", "on, off", "add, remove", "import", "reload", "reverify", "approve, deny", "status"} {
 			if !scanner.Scan() {
 				t.Error("no line available")
 			}
@@ -356,7 +360,7 @@ func TestHostKick(t *testing.T) {
 			if member == nil {
 				return errors.New("failed to load MemberByID")
 			}
-			member.IsOp = true
+			member.SetRole(chat.RoleModerator)
 
 			// Change nicks, make sure op sticks
 			w.Write([]byte("/nick quux\r\n"))
@@ -406,6 +410,14 @@ func TestHostKick(t *testing.T) {
 	if err := g.Wait(); err != nil {
 		t.Error(err)
 	}
+
+	entries := host.Audit.Query(1, "bar")
+	if len(entries) != 1 {
+		t.Fatalf("expected kick to be audited, got: %v", entries)
+	}
+	if e := entries[0]; e.Actor != "quux" || e.Action != "kick" || e.IP != "127.0.0.1" {
+		t.Errorf("unexpected audit entry: %s", e)
+	}
 }
 
 func TestTimestampEnvConfig(t *testing.T) {
@@ -476,3 +488,784 @@ func connectUserWithConfig(t *testing.T, name string, envConfig map[string]strin
 	t.Fatalf("user %s not found in the host", name)
 	return nil
 }
+
+func TestHostMultilinePaste(t *testing.T) {
+	s, host := getHost(t, nil)
+	defer s.Close()
+	host.PasteLines = 3
+	go host.Serve()
+
+	err := sshd.ConnectShell(s.Addr().String(), "foo", func(r io.Reader, w io.WriteCloser) error {
+		scanner := bufio.NewScanner(r)
+		scanner.Scan() // Joined
+
+		w.Write([]byte("\x1b[200~/not a command\r\tindented\r\x1b[201~"))
+
+		want := []string{"[foo] \r", "  /not a command\r", "      indented\r"}
+		for _, line := range want {
+			if !scanner.Scan() {
+				return errors.New("no line available")
+			}
+			if got := scanner.Text(); !strings.HasSuffix(got, line) {
+				t.Errorf("got: %q; want suffix: %q", got, line)
+			}
+		}
+
+		w.Write([]byte("\x1b[200~a\rb\rc\rd\r\x1b[201~"))
+		scanner.Scan()
+		if got, want := stripPrompt(scanner.Text()), "Message rejected: Pasted more than 3 lines.\r"; got != want {
+			t.Errorf("got: %q; want: %q", got, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHostTopicOnJoin(t *testing.T) {
+	s, host := getHost(t, nil)
+	defer s.Close()
+	go host.Serve()
+
+	host.SetMotd("welcome")
+	host.SetTopicBy("testing", "op")
+
+	err := sshd.ConnectShell(s.Addr().String(), "foo", func(r io.Reader, w io.WriteCloser) error {
+		scanner := bufio.NewScanner(r)
+
+		scanner.Scan()
+		if got, want := stripPrompt(scanner.Text()), " * welcome\r"; got != want {
+			t.Errorf("got: %q; want: %q", got, want)
+		}
+		scanner.Scan()
+		if got, want := stripPrompt(scanner.Text()), " * Topic: testing (set by op at "; !strings.HasPrefix(got, want) {
+			t.Errorf("got: %q; want prefix: %q", got, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// firstLine connects as name and returns the first line of output. Rejected
+// connections are closed right away, so this reads the output without
+// ConnectShell's ping.
+func firstLine(t *testing.T, addr, name string) string {
+	conn, err := ssh.Dial("tcp", addr, sshd.NewClientConfig(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	out, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(out)
+	scanner.Scan()
+	return stripPrompt(scanner.Text())
+}
+
+func TestHostInviteOnly(t *testing.T) {
+	s, host := getHost(t, nil)
+	defer s.Close()
+	go host.Serve()
+
+	host.SetInviteOnly(true)
+	token, err := host.Invites.NewToken(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := "This room is invite-only, ask an op for an invite.\r"
+	if got := firstLine(t, s.Addr().String(), "foo"); got != rejected {
+		t.Errorf("got: %q; want: %q", got, rejected)
+	}
+	if got, want := firstLine(t, s.Addr().String(), "foo+"+token), " * foo joined. (Connected: 1)\r"; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+	// Tokens can only be used once.
+	if got := firstLine(t, s.Addr().String(), "bar+"+token); got != rejected {
+		t.Errorf("got: %q; want: %q", got, rejected)
+	}
+}
+
+func TestHostRoomBan(t *testing.T) {
+	s, host := getHost(t, nil)
+	defer s.Close()
+	go host.Serve()
+
+	host.Access.Ban([]chat.QueryField{{Key: "ip", Value: "127.0.0.1"}}, 0)
+	if got, want := firstLine(t, s.Addr().String(), "foo"), "Rejected: banned from room.\r"; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+
+	host.Access.Unban([]chat.QueryField{{Key: "ip", Value: "127.0.0.1"}})
+	host.Access.SetAllowlistMode(true)
+	host.Access.Allow([]chat.QueryField{{Key: "client", Value: "SSH-2.0-Go"}}, 0)
+	if got, want := firstLine(t, s.Addr().String(), "foo"), " * foo joined. (Connected: 1)\r"; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+}
+
+func TestHostRoomBanMember(t *testing.T) {
+	s, host := getHost(t, NewAuth())
+	defer s.Close()
+	go host.Serve()
+
+	g := errgroup.Group{}
+	connected := make(chan struct{})
+	banned := make(chan struct{})
+
+	g.Go(func() error {
+		return sshd.ConnectShell(s.Addr().String(), "foo", func(r io.Reader, w io.WriteCloser) error {
+			scanner := bufio.NewScanner(r)
+			if err := scanUntil(scanner, "foo joined"); err != nil {
+				return err
+			}
+			member, ok := host.Room.MemberByID("foo")
+			if !ok {
+				return errors.New("failed to load MemberByID")
+			}
+			member.SetRole(chat.RoleModerator)
+
+			<-connected
+			w.Write([]byte("/room ban bar\r\n"))
+			if err := scanUntil(scanner, "bar was banned from the room by foo."); err != nil {
+				return err
+			}
+			close(banned)
+			return nil
+		})
+	})
+
+	g.Go(func() error {
+		return sshd.ConnectShell(s.Addr().String(), "bar", func(r io.Reader, w io.WriteCloser) error {
+			scanner := bufio.NewScanner(r)
+			if err := scanUntil(scanner, "bar joined"); err != nil {
+				return err
+			}
+			close(connected)
+			if err := scanUntil(scanner, "You were banned from the room by foo."); err != nil {
+				return err
+			}
+			<-banned
+			// Still connected, outside the room.
+			w.Write([]byte("am I still here?\r\n"))
+			return scanUntil(scanner, "You are no longer in the room")
+		})
+	})
+
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := host.MemberByID("bar"); ok {
+		t.Error("bar is still in the room")
+	}
+	if got, want := firstLine(t, s.Addr().String(), "bar"), "Rejected: banned from room.\r"; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+}
+
+func TestHostReservedName(t *testing.T) {
+	auth := NewAuth()
+	aliceKey, err := sshd.NewRandomSigner(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, host := getHost(t, auth)
+	defer s.Close()
+	joined := make(chan string, 3)
+	host.OnUserJoined = func(u *message.User) {
+		joined <- u.Name()
+	}
+	go host.Serve()
+
+	g := errgroup.Group{}
+	squatted := make(chan struct{})
+	renamed := make(chan struct{})
+
+	g.Go(func() error {
+		// Takes the name before it's reserved.
+		return sshd.ConnectShell(s.Addr().String(), "alice", func(r io.Reader, w io.WriteCloser) error {
+			scanner := bufio.NewScanner(r)
+			if err := scanUntil(scanner, "alice joined"); err != nil {
+				return err
+			}
+			close(squatted)
+			if err := scanUntil(scanner, "Your name is reserved for someone else, you were renamed to Guest"); err != nil {
+				return err
+			}
+			w.Write([]byte("/nick alice\r\n"))
+			if err := scanUntil(scanner, chat.ErrNameReserved.Error()); err != nil {
+				return err
+			}
+			close(renamed)
+			return nil
+		})
+	})
+
+	g.Go(func() error {
+		<-squatted
+		auth.Allowlist(&AuthorizedKey{PublicKey: aliceKey.PublicKey(), Name: "alice"}, 0)
+		return sshd.ConnectShellWithKey(s.Addr().String(), "bob", aliceKey, func(r io.Reader, w io.WriteCloser) error {
+			scanner := bufio.NewScanner(r)
+			if err := scanUntil(scanner, " * alice joined."); err != nil {
+				return err
+			}
+			<-renamed
+			return nil
+		})
+	})
+
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other keys can't take it, even when alice isn't connected.
+	firstLine(t, s.Addr().String(), "alice")
+	names := []string{<-joined, <-joined, <-joined}
+	if names[1] != "alice" || !strings.HasPrefix(names[2], "Guest") {
+		t.Errorf("got joined: %q; want alice, then a guest", names)
+	}
+}
+
+func TestHostConfusableName(t *testing.T) {
+	s, host := getHost(t, nil)
+	defer s.Close()
+	go host.Serve()
+
+	// With a Cyrillic а, which could pass for admin.
+	err := sshd.ConnectShell(s.Addr().String(), "аdmin", func(r io.Reader, w io.WriteCloser) error {
+		scanner := bufio.NewScanner(r)
+		if err := scanUntil(scanner, "Your name was rejected as invalid or confusable with another, you joined as Guest"); err != nil {
+			return err
+		}
+		return scanUntil(scanner, " * Guest0 joined.")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostCertificate(t *testing.T) {
+	auth := NewAuth()
+	ca := newTestCA(t)
+	auth.AddCertAuthority(ca.PublicKey())
+	auth.OpPrincipal("admins", 0)
+
+	s, host := getHost(t, auth)
+	defer s.Close()
+	go host.Serve()
+
+	_, signer := newTestCert(t, ca, []string{"alice", "admins"}, time.Hour)
+	err := sshd.ConnectShellWithKey(s.Addr().String(), "mallory", signer, func(r io.Reader, w io.WriteCloser) error {
+		scanner := bufio.NewScanner(r)
+		scanner.Scan()
+		if got, want := stripPrompt(scanner.Text()), " * alice joined. (Connected: 1)\r"; got != want {
+			t.Errorf("got: %q; want: %q", got, want)
+		}
+		member, ok := host.MemberByID("alice")
+		if !ok {
+			return errors.New("failed to load MemberByID")
+		}
+		if role := member.Role(); role != chat.RoleOwner {
+			t.Errorf("got: %s; want: %s", role, chat.RoleOwner)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, untrusted := newTestCert(t, newTestCA(t), []string{"alice"}, time.Hour)
+	err = sshd.ConnectShellWithKey(s.Addr().String(), "alice", untrusted, func(r io.Reader, w io.WriteCloser) error {
+		return nil
+	})
+	if err == nil {
+		t.Error("untrusted certificate was accepted")
+	}
+}
+
+func TestHostRejectionReasons(t *testing.T) {
+	auth := NewAuth()
+	auth.SetBanner("Welcome to the test server.\n")
+	auth.SetAllowlistMode(true)
+
+	s, host := getHost(t, auth)
+	defer s.Close()
+	go host.Serve()
+
+	signer, err := sshd.NewRandomSigner(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var banner, instruction string
+	config := sshd.NewClientConfigWithKey("foo", signer)
+	config.BannerCallback = func(message string) error {
+		banner = message
+		return nil
+	}
+	config.Auth = append(config.Auth, ssh.KeyboardInteractive(func(user, inst string, questions []string, echos []bool) ([]string, error) {
+		instruction = inst
+		return nil, nil
+	}))
+
+	if conn, err := ssh.Dial("tcp", s.Addr().String(), config); err == nil {
+		conn.Close()
+		t.Fatal("connection was not rejected")
+	}
+	if want := "Welcome to the test server.\n"; banner != want {
+		t.Errorf("got: %q; want: %q", banner, want)
+	}
+	want := "Public key rejected: not on the allowlist. Your key's fingerprint is " + sshd.Fingerprint(signer.PublicKey()) +
+		"\nRejected: public key authentication required, connect with an SSH key."
+	if instruction != want {
+		t.Errorf("got: %q; want: %q", instruction, want)
+	}
+}
+
+func TestHostLobby(t *testing.T) {
+	auth := NewAuth()
+	auth.SetAllowlistMode(true)
+	auth.SetLobby(true)
+	opKey, err := sshd.NewRandomSigner(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Op(opKey.PublicKey(), 0)
+	newbieKey, err := sshd.NewRandomSigner(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, host := getHost(t, auth)
+	defer s.Close()
+	joined := make(chan string, 2)
+	host.OnUserJoined = func(u *message.User) {
+		joined <- u.Name()
+	}
+	go host.Serve()
+
+	g := errgroup.Group{}
+	opJoined := make(chan struct{})
+	requested := make(chan struct{})
+
+	g.Go(func() error {
+		return sshd.ConnectShellWithKey(s.Addr().String(), "op", opKey, func(r io.Reader, w io.WriteCloser) error {
+			scanner := bufio.NewScanner(r)
+			if err := scanUntil(scanner, "op joined"); err != nil {
+				return err
+			}
+			close(opJoined)
+
+			if err := scanUntil(scanner, "newbie ("+sshd.Fingerprint(newbieKey.PublicKey())+") requests access: let me in"); err != nil {
+				return err
+			}
+			close(requested)
+			w.Write([]byte("/allowlist approve newbie\r\n"))
+			return scanUntil(scanner, "newbie joined")
+		})
+	})
+
+	g.Go(func() error {
+		<-opJoined
+		return sshd.ConnectShellWithKey(s.Addr().String(), "newbie", newbieKey, func(r io.Reader, w io.WriteCloser) error {
+			scanner := bufio.NewScanner(r)
+			if err := scanUntil(scanner, lobbyHelp); err != nil {
+				return err
+			}
+			if _, ok := host.MemberByID("newbie"); ok {
+				return errors.New("newbie joined the room from the lobby")
+			}
+
+			w.Write([]byte("hello?\r\n"))
+			if err := scanUntil(scanner, lobbyHelp); err != nil {
+				return err
+			}
+			w.Write([]byte("/request-access let me in\r\n"))
+			if err := scanUntil(scanner, "Your request was sent to the ops."); err != nil {
+				return err
+			}
+			<-requested
+			return scanUntil(scanner, "Access approved by op, welcome!")
+		})
+	})
+
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !auth.allowlisted(newbieKey.PublicKey()) {
+		t.Error("approved key was not allowlisted")
+	}
+	if names := []string{<-joined, <-joined}; names[1] != "newbie" {
+		t.Errorf("got joined: %q; want newbie after op", names)
+	}
+}
+
+func TestHostLobbyAdmitFails(t *testing.T) {
+	auth := NewAuth()
+	auth.SetAllowlistMode(true)
+	auth.SetLobby(true)
+	newbieKey, err := sshd.NewRandomSigner(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, host := getHost(t, auth)
+	defer s.Close()
+	go host.Serve()
+
+	err = sshd.ConnectShellWithKey(s.Addr().String(), "newbie", newbieKey, func(r io.Reader, w io.WriteCloser) error {
+		scanner := bufio.NewScanner(r)
+		if err := scanUntil(scanner, lobbyHelp); err != nil {
+			return err
+		}
+		// Banned while waiting, so the room refuses them once approved.
+		host.Access.Ban([]chat.QueryField{{Key: "fingerprint", Value: sshd.Fingerprint(newbieKey.PublicKey())}}, 0)
+		reqs, err := host.lobby.Take("newbie")
+		if err != nil {
+			return err
+		}
+		if len(reqs) != 1 {
+			return fmt.Errorf("got %d lobby requests; want 1", len(reqs))
+		}
+		if err := host.admit(reqs[0], message.NewUser(message.SimpleID("op"))); err == nil {
+			return errors.New("admitted a banned user")
+		}
+		if err := scanUntil(scanner, "Access approved by op, but failed to join"); err != nil {
+			return err
+		}
+		// Disconnected, rather than left outside both the lobby and room.
+		for scanner.Scan() {
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := host.MemberByID("newbie"); ok {
+		t.Error("banned user joined the room")
+	}
+}
+
+// keyConn is an in-process connection with a public key.
+type keyConn struct {
+	botConn
+	key ssh.PublicKey
+}
+
+func (c keyConn) PublicKey() ssh.PublicKey { return c.key }
+
+func TestLobbyTakeImpostor(t *testing.T) {
+	l := newLobby()
+	var keys []ssh.PublicKey
+	for i := 0; i < 2; i++ {
+		key, err := NewRandomPublicKey(512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		l.Add(message.NewUser(NewIdentity(keyConn{botConn{"newbie"}, key})), false)
+	}
+
+	if reqs, err := l.Take("newbie"); err == nil {
+		t.Errorf("took %d requests for a name two keys are waiting as", len(reqs))
+	}
+	reqs, err := l.Take(sshd.Fingerprint(keys[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].user.Identifier.(*Identity).PublicKey() != keys[0] {
+		t.Errorf("got requests: %v; want the first key's", reqs)
+	}
+	// Only one key is waiting as newbie now.
+	if reqs, err := l.Take("newbie"); err != nil || len(reqs) != 1 {
+		t.Errorf("got: %v, %v; want the second key's request", reqs, err)
+	}
+}
+
+// scanUntil reads lines until one contains substr.
+func scanUntil(scanner *bufio.Scanner, substr string) error {
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), substr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("never got %q", substr)
+}
+
+func TestHostElevate(t *testing.T) {
+	signer, err := sshd.NewRandomSigner(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("12345678901234567890")
+	auth := NewAuth()
+	auth.Op(signer.PublicKey(), 0)
+	auth.SetOpsRequireTOTP(true)
+	auth.SetTOTPAtLogin(true)
+	auth.SetElevation(time.Hour)
+	err = auth.LoadTOTPSecrets(strings.NewReader(sshd.Fingerprint(signer.PublicKey()) + " " + base32.StdEncoding.EncodeToString(secret)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, host := getHost(t, auth)
+	defer s.Close()
+	go host.Serve()
+
+	err = sshd.ConnectShellWithKey(s.Addr().String(), "alice", signer, func(r io.Reader, w io.WriteCloser) error {
+		scanner := bufio.NewScanner(r)
+		// Skip the code at login.
+		w.Write([]byte("\r\n"))
+		if err := scanUntil(scanner, "Use /elevate CODE to become an op later."); err != nil {
+			return err
+		}
+		if err := scanUntil(scanner, "alice joined"); err != nil {
+			return err
+		}
+		if member, ok := host.MemberByID("alice"); !ok || member.IsOp() {
+			return errors.New("alice is an op without elevating")
+		}
+
+		w.Write([]byte("/elevate " + totpCode(secret, uint64(time.Now().Unix()/30)) + "\r\n"))
+		if err := scanUntil(scanner, "Elevated to op for 1h0m0s."); err != nil {
+			return err
+		}
+		if member, ok := host.MemberByID("alice"); !ok || member.Role() != chat.RoleOwner {
+			return errors.New("alice isn't an owner after elevating")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostAddCommand(t *testing.T) {
+	s, host := getHost(t, nil)
+	defer s.Close()
+
+	u := message.NewUser(message.SimpleID("alice"))
+	if _, err := host.Join(u); err != nil {
+		t.Fatal(err)
+	}
+	err := host.AddCommand(chat.Command{
+		Prefix: "/poke",
+		Help:   "Poke USER.",
+		Args:   []chat.Arg{{Name: "USER", Type: chat.ArgUser}, {Name: "HOW", Type: chat.ArgString}},
+		Complete: func(room *chat.Room, from *message.User, args []string) []string {
+			if len(args) == 2 {
+				return []string{"gently", "firmly"}
+			}
+			return room.NamesPrefix(args[0])
+		},
+		Run: func(room *chat.Room, msg message.CommandMsg, args chat.Args) error {
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	complete := host.AutoCompleteFunction(u)
+	for line, want := range map[string]string{
+		"/po":           "/poke ",
+		"/poke al":      "/poke alice ",
+		"/poke alice f": "/poke alice firmly ",
+	} {
+		got, _, ok := complete(line, len(line), '\t')
+		if !ok || got != want {
+			t.Errorf("%q: got: %q, %v; want: %q", line, got, ok, want)
+		}
+	}
+	if _, _, ok := complete("/poke alice x", 13, '\t'); ok {
+		t.Error("completed an argument without candidates")
+	}
+}
+
+func TestHostAutoComplete(t *testing.T) {
+	s, host := getHost(t, nil)
+	defer s.Close()
+
+	u := message.NewUser(message.SimpleID("alice"))
+	if _, err := host.JoinAs(u, chat.RoleOwner); err != nil {
+		t.Fatal(err)
+	}
+	complete := host.AutoCompleteFunction(u)
+	for line, want := range map[string]string{
+		"/theme s":              "/theme solarized ",
+		"/timestamp d":          "/timestamp datetime ",
+		"/allowlist rel":        "/allowlist reload ",
+		"/allowlist reload f":   "/allowlist reload flush ",
+		"/ban i":                "/ban ip=",
+		"/ban ip=1.2.3.4 f":     "/ban ip=1.2.3.4 fingerprint=",
+		"/room allowlist a":     "/room allowlist add ",
+		"/room allowlist add a": "/room allowlist add alice ",
+	} {
+		got, _, ok := complete(line, len(line), '\t')
+		if !ok || got != want {
+			t.Errorf("%q: got: %q, %v; want: %q", line, got, ok, want)
+		}
+	}
+
+	// Drain the messages from joining.
+	for u.HasMessages() {
+		u.ConsumeOne()
+	}
+
+	// Ambiguous prefixes are listed, and cycled through by pressing tab again.
+	line, pos := "/ban", 4
+	for _, want := range []string{"/ban ", "/banned ", "/ban "} {
+		var ok bool
+		line, pos, ok = complete(line, pos, '\t')
+		if !ok || line != want || pos != len(want) {
+			t.Errorf("got: %q, %d, %v; want: %q", line, pos, ok, want)
+		}
+	}
+	if !u.HasMessages() {
+		t.Fatal("ambiguous completion wasn't listed")
+	}
+	if got, want := u.ConsumeOne().String(), "-> Completions: /ban, /banned"; got != want {
+		t.Errorf("got: %q; want: %q", got, want)
+	}
+	if u.HasMessages() {
+		t.Error("cycling listed the completions again")
+	}
+
+	// Editing the line starts a new completion.
+	if line, _, _ := complete("/ban ali", 8, '\t'); line != "/ban alice " {
+		t.Errorf("got: %q; want: %q", line, "/ban alice ")
+	}
+
+	// Guests can't complete the arguments of commands they can't run.
+	guest := message.NewUser(message.SimpleID("bob"))
+	if _, err := host.Join(guest); err != nil {
+		t.Fatal(err)
+	}
+	completeGuest := host.AutoCompleteFunction(guest)
+	for _, line := range []string{"/allowlist a", "/allowlist approve al"} {
+		if got, _, ok := completeGuest(line, len(line), '\t'); ok {
+			t.Errorf("%q: guest completed: %q", line, got)
+		}
+	}
+}
+
+func TestHostAddBot(t *testing.T) {
+	s, host := getHost(t, nil)
+	defer s.Close()
+
+	if err := host.AddBot(chat.NewDiceBot()); err != nil {
+		t.Fatal(err)
+	}
+	member, ok := host.MemberByID("dicebot")
+	if !ok {
+		t.Fatal("dicebot didn't join")
+	}
+	id, ok := member.Identifier.(*Identity)
+	if !ok {
+		t.Fatalf("got identity %T; want *Identity", member.Identifier)
+	}
+	if whois := id.WhoisAdmin(host.Room); !strings.Contains(whois, "(no public key)") {
+		t.Errorf("unexpected whois: %q", whois)
+	}
+	if err := host.AddBot(chat.NewDiceBot()); err == nil {
+		t.Error("added a bot with a name that's taken")
+	}
+}
+
+func TestHostOpSavesKeys(t *testing.T) {
+	alice, err := sshd.NewRandomSigner(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := sshd.NewRandomSigner(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobKey := base64.StdEncoding.EncodeToString(bob.PublicKey().Marshal())
+
+	// Saved like --save-keys does, rewriting an admin file with a comment.
+	const adminFile = "# Admins\n"
+	auth := NewAuth()
+	auth.Op(alice.PublicKey(), 0)
+	saved := make(chan string, 4)
+	auth.OnOpsChange = func() {
+		var out strings.Builder
+		if err := auth.SaveOps(strings.NewReader(adminFile), &out); err != nil {
+			t.Error(err)
+		}
+		saved <- out.String()
+	}
+
+	s, host := getHost(t, auth)
+	defer s.Close()
+	go host.Serve()
+
+	nextSave := func() (string, error) {
+		select {
+		case file := <-saved:
+			return file, nil
+		case <-time.After(5 * time.Second):
+			return "", errors.New("admin file wasn't saved")
+		}
+	}
+
+	bobJoined := make(chan struct{})
+	done := make(chan struct{})
+	g := errgroup.Group{}
+	g.Go(func() error {
+		return sshd.ConnectShellWithKey(s.Addr().String(), "bob", bob, func(r io.Reader, w io.WriteCloser) error {
+			if err := scanUntil(bufio.NewScanner(r), "bob joined"); err != nil {
+				close(bobJoined)
+				return err
+			}
+			close(bobJoined)
+			<-done
+			return nil
+		})
+	})
+	g.Go(func() error {
+		defer close(done)
+		return sshd.ConnectShellWithKey(s.Addr().String(), "alice", alice, func(r io.Reader, w io.WriteCloser) error {
+			<-bobJoined
+			w.Write([]byte("/op bob\r\n"))
+			file, err := nextSave()
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(file, adminFile) || !strings.Contains(file, bobKey) {
+				return fmt.Errorf("bob's key wasn't added to the admin file: %q", file)
+			}
+			if member, ok := host.MemberByID("bob"); !ok || !member.IsOp() {
+				return errors.New("bob isn't an op")
+			}
+
+			w.Write([]byte("/op bob remove\r\n"))
+			if file, err = nextSave(); err != nil {
+				return err
+			}
+			if !strings.HasPrefix(file, adminFile) || strings.Contains(file, bobKey) {
+				return fmt.Errorf("bob's key wasn't removed from the admin file: %q", file)
+			}
+			if member, ok := host.MemberByID("bob"); !ok || member.IsOp() {
+				return errors.New("bob is still an op")
+			}
+			return nil
+		})
+	})
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"strings"
 	"time"
 
+	"golang.org/x/crypto/ssh"
+
 	"github.com/shazow/ssh-chat/chat"
 	"github.com/shazow/ssh-chat/chat/message"
 	"github.com/shazow/ssh-chat/internal/humantime"
@@ -16,20 +18,45 @@ import (
 // Identity is a container for everything that identifies a client.
 type Identity struct {
 	sshd.Connection
-	id      string
-	symbol  string // symbol is displayed as a prefix to the name
-	created time.Time
+	id         string
+	symbol     string // symbol is displayed as a prefix to the name
+	created    time.Time
+	authorized *AuthorizedKey // Options and comment of the key, if loaded with them.
 }
 
-// NewIdentity returns a new identity object from an sshd.Connection.
+// NewIdentity returns a new identity object from an sshd.Connection. The name
+// is the connection's certificate principal if it has one.
 func NewIdentity(conn sshd.Connection) *Identity {
+	name := conn.Principal()
+	if name == "" {
+		name = strings.SplitN(conn.Name(), inviteSeparator, 2)[0]
+	}
 	return &Identity{
 		Connection: conn,
-		id:         sanitize.Name(conn.Name()),
+		id:         sanitize.Name(name),
 		created:    time.Now(),
 	}
 }
 
+// botConn is the connection of a bot's Identity, which runs in-process: it has
+// no key, and its address is the bot's name.
+type botConn struct {
+	name string
+}
+
+func (c botConn) PublicKey() ssh.PublicKey { return nil }
+func (c botConn) RemoteAddr() net.Addr     { return botAddr(c.name) }
+func (c botConn) Name() string             { return c.name }
+func (c botConn) Principal() string        { return "" }
+func (c botConn) ClientVersion() []byte    { return []byte("ssh-chat-bot") }
+func (c botConn) Close() error             { return nil }
+
+// botAddr is the address of a bot, like "remindbot:0", which isn't an IP.
+type botAddr string
+
+func (a botAddr) Network() string { return "bot" }
+func (a botAddr) String() string  { return net.JoinHostPort(string(a), "0") }
+
 // ID returns the name for the Identity
 func (i Identity) ID() string {
 	return i.id
@@ -45,6 +72,29 @@ func (i *Identity) SetName(name string) {
 	i.SetID(name)
 }
 
+// SetAuthorizedKey keeps the options and comment the Identity's key was loaded
+// with, and sets the name forced by its name= option.
+func (i *Identity) SetAuthorizedKey(key *AuthorizedKey) {
+	i.authorized = key
+	if key != nil && key.Name != "" {
+		i.SetName(sanitize.Name(key.Name))
+	}
+}
+
+// FixedName returns whether the Identity's name is forced by its key, so
+// the user can't change it.
+func (i Identity) FixedName() bool {
+	return i.authorized != nil && i.authorized.Name != ""
+}
+
+// KeyComment returns the comment the Identity's key was loaded with.
+func (i Identity) KeyComment() string {
+	if i.authorized == nil {
+		return ""
+	}
+	return i.authorized.Comment
+}
+
 func (i *Identity) SetSymbol(symbol string) {
 	i.symbol = symbol
 }
@@ -57,11 +107,30 @@ func (i Identity) Name() string {
 	return i.id
 }
 
+// Fingerprint returns the fingerprint of the Identity's public key, or an
+// empty string if it has none.
+func (i Identity) Fingerprint() string {
+	if i.PublicKey() == nil {
+		return ""
+	}
+	return sshd.Fingerprint(i.PublicKey())
+}
+
+// IP returns the address the Identity connected from, without the port.
+func (i Identity) IP() string {
+	return newAuthAddr(i.RemoteAddr())
+}
+
+// Client returns the SSH client version string the Identity connected with.
+func (i Identity) Client() string {
+	return string(i.ClientVersion())
+}
+
 // Whois returns a whois description for non-admin users.
 func (i Identity) Whois(room *chat.Room) string {
-	fingerprint := "(no public key)"
-	if i.PublicKey() != nil {
-		fingerprint = sshd.Fingerprint(i.PublicKey())
+	fingerprint := i.Fingerprint()
+	if fingerprint == "" {
+		fingerprint = "(no public key)"
 	}
 	// TODO: Rewrite this using strings.Builder like WhoisAdmin
 
@@ -81,10 +150,10 @@ func (i Identity) Whois(room *chat.Room) string {
 
 // WhoisAdmin returns a whois description for admin users.
 func (i Identity) WhoisAdmin(room *chat.Room) string {
-	ip, _, _ := net.SplitHostPort(i.RemoteAddr().String())
-	fingerprint := "(no public key)"
-	if i.PublicKey() != nil {
-		fingerprint = sshd.Fingerprint(i.PublicKey())
+	ip := i.IP()
+	fingerprint := i.Fingerprint()
+	if fingerprint == "" {
+		fingerprint = "(no public key)"
 	}
 
 	out := strings.Builder{}
@@ -93,6 +162,12 @@ func (i Identity) WhoisAdmin(room *chat.Room) string {
 		" > fingerprint: " + fingerprint + message.Newline +
 		" > client: " + sanitize.Data(string(i.ClientVersion()), 64) + message.Newline +
 		" > joined: " + humantime.Since(i.created) + " ago")
+	if principal := i.Principal(); principal != "" {
+		out.WriteString(message.Newline + " > principal: " + principal)
+	}
+	if comment := i.KeyComment(); comment != "" {
+		out.WriteString(message.Newline + " > key comment: " + sanitize.Data(comment, 64))
+	}
 
 	if member, ok := room.MemberByID(i.ID()); ok {
 		// Add room-specific whois
@@ -107,6 +182,9 @@ func (i Identity) WhoisAdmin(room *chat.Room) string {
 		if room.IsOp(member.User) {
 			out.WriteString(message.Newline + " > room/op: true")
 		}
+		if role := member.Role(); role != chat.RoleGuest {
+			out.WriteString(message.Newline + " > room/role: " + role.String())
+		}
 	}
 
 	return out.String()
@@ -1,23 +1,132 @@
 package sanitize
 
-import "regexp"
+import (
+	"regexp"
+	"strings"
+	"unicode"
 
-var (
-	reStripName = regexp.MustCompile("[^\\w.-]")
-	reStripData = regexp.MustCompile("[^[:ascii:]]|[[:cntrl:]]")
+	"golang.org/x/text/unicode/norm"
 )
 
+var reStripData = regexp.MustCompile("[^[:ascii:]]|[[:cntrl:]]")
+
 const maxLength = 16
 
-// Name returns a name with only allowed characters and a reasonable length
+// maxMarks is the number of consecutive combining marks allowed in a name,
+// to prevent stacking them into something unreadable.
+const maxMarks = 2
+
+// nameScripts are the scripts whose letters are allowed in names.
+var nameScripts = []*unicode.RangeTable{
+	unicode.Latin,
+	unicode.Greek,
+	unicode.Cyrillic,
+	unicode.Armenian,
+	unicode.Georgian,
+	unicode.Hebrew,
+	unicode.Arabic,
+	unicode.Devanagari,
+	unicode.Bengali,
+	unicode.Tamil,
+	unicode.Thai,
+	unicode.Hangul,
+	unicode.Han,
+	unicode.Hiragana,
+	unicode.Katakana,
+}
+
+// mixedScripts are the combinations of scripts that are commonly used
+// together in one language, so a name can mix them without being
+// considered a confusable.
+var mixedScripts = [][]*unicode.RangeTable{
+	{unicode.Latin, unicode.Han, unicode.Hiragana, unicode.Katakana},
+	{unicode.Latin, unicode.Han, unicode.Hangul},
+}
+
+// Name returns a name with only allowed characters and a reasonable length.
+// Names are NFC normalized and may contain letters from the scripts in
+// nameScripts. Names that mix scripts in a way that could impersonate
+// another name, like a Cyrillic "а" in "аdmin", are rejected with an empty
+// string.
 func Name(s string) string {
-	s = reStripName.ReplaceAllString(s, "")
-	nameLength := maxLength
-	if len(s) <= maxLength {
-		nameLength = len(s)
+	var out strings.Builder
+	length, marks := 0, 0
+	for _, r := range norm.NFC.String(s) {
+		if length >= maxLength {
+			break
+		}
+		if unicode.Is(unicode.Mn, r) {
+			if length == 0 || marks >= maxMarks {
+				continue
+			}
+			marks++
+		} else if allowedNameRune(r) {
+			marks = 0
+		} else {
+			continue
+		}
+		out.WriteRune(r)
+		length++
+	}
+	name := out.String()
+	if isMixedScript(name) {
+		return ""
+	}
+	return name
+}
+
+func allowedNameRune(r rune) bool {
+	if r <= unicode.MaxASCII {
+		return r == '_' || r == '.' || r == '-' ||
+			('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+	}
+	return unicode.IsLetter(r) && nameScript(r) != nil
+}
+
+// nameScript returns the script of a letter, or nil if it's not a letter
+// from an allowed script.
+func nameScript(r rune) *unicode.RangeTable {
+	for _, script := range nameScripts {
+		if unicode.Is(script, r) {
+			return script
+		}
+	}
+	return nil
+}
+
+// isMixedScript returns whether the letters in a name come from more than one
+// script, other than the combinations in mixedScripts.
+func isMixedScript(name string) bool {
+	var scripts []*unicode.RangeTable
+	for _, r := range name {
+		script := nameScript(r)
+		if script == nil || containsScript(scripts, script) {
+			continue
+		}
+		scripts = append(scripts, script)
+	}
+	if len(scripts) <= 1 {
+		return false
+	}
+	for _, allowed := range mixedScripts {
+		ok := true
+		for _, script := range scripts {
+			ok = ok && containsScript(allowed, script)
+		}
+		if ok {
+			return false
+		}
+	}
+	return true
+}
+
+func containsScript(scripts []*unicode.RangeTable, script *unicode.RangeTable) bool {
+	for _, s := range scripts {
+		if s == script {
+			return true
+		}
 	}
-	s = s[:nameLength]
-	return s
+	return false
 }
 
 // Data returns a string with only allowed characters for client-provided metadata inputs.
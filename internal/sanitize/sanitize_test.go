@@ -0,0 +1,36 @@
+package sanitize
+
+import "testing"
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		Input string
+		Want  string
+	}{
+		{"foo", "foo"},
+		{"foo bar!", "foobar"},
+		{"some.name-1_2", "some.name-1_2"},
+		{"abcdefghijklmnopqrstuvwxyz", "abcdefghijklmnop"},
+		{"José", "José"},
+		{"Jose\u0301", "José"}, // NFC normalized
+		{"Иван", "Иван"},
+		{"Ελένη", "Ελένη"},
+		{"山田たろう", "山田たろう"},
+		{"김민준", "김민준"},
+		{"yuki雪", "yuki雪"},
+		{"ааааааааааааааааааа", "аааааааааааааааа"}, // Truncated by runes
+		{"\u0430dmin", ""},       // Cyrillic а
+		{"p\u0430yp\u0430l", ""}, // Cyrillic а
+		{"\u03b1dmin", ""},       // Greek α
+		{"Иван김", ""},
+		{"a\u0300\u0301\u0302\u0303", "à\u0301\u0302"}, // Stacked marks are capped
+		{"\u0301foo", "foo"},
+		{"💩", ""},
+	}
+
+	for i, tc := range tests {
+		if got, want := Name(tc.Input), tc.Want; got != want {
+			t.Errorf("case #%d:\n got: %q\nwant: %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package sshchat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keyLoaderTimeout is how long fetching keys from a URL or command can take.
+const keyLoaderTimeout = 10 * time.Second
+
+// errNotModified is returned by loaders when the keys haven't changed since
+// their last successful load.
+var errNotModified = errors.New("not modified")
+
+// CachedKeyLoader wraps a loader to return the keys from its last successful
+// load when it fails, so that a temporary failure doesn't empty the list. It
+// only fails if the loader has never succeeded.
+func CachedKeyLoader(loader KeyLoader) KeyLoader {
+	var mu sync.Mutex
+	var cached []ssh.PublicKey
+	loaded := false
+	return func() ([]ssh.PublicKey, error) {
+		// Loads are serialized, so loaders can keep state between them.
+		mu.Lock()
+		defer mu.Unlock()
+
+		keys, err := loader()
+		if err == nil {
+			cached, loaded = keys, true
+			return keys, nil
+		}
+		if !loaded {
+			return nil, err
+		}
+		if err != errNotModified {
+			logger.Errorf("Failed to load keys, keeping the last loaded: %s", err)
+		}
+		return cached, nil
+	}
+}
+
+// URLKeyLoader loads keys in the authorized_keys format from an HTTP(S) URL,
+// like https://github.com/USER.keys. The keys are cached, and only fetched
+// again if the server says they changed. A nil client uses a default with a
+// timeout.
+func URLKeyLoader(url string, client *http.Client) KeyLoader {
+	if client == nil {
+		client = &http.Client{Timeout: keyLoaderTimeout}
+	}
+	var etag, lastModified string
+	return CachedKeyLoader(func() ([]ssh.PublicKey, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotModified:
+			return nil, errNotModified
+		default:
+			return nil, fmt.Errorf("failed to fetch %s: %s", url, resp.Status)
+		}
+		keys, err := ParseAuthorizedKeys(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		etag, lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		return keys, nil
+	})
+}
+
+// DirKeyLoader loads keys from a directory with a file of keys in the
+// authorized_keys format per user, like alice.pub. Keys without a comment
+// are given the file's name without its extension. Hidden files are skipped.
+func DirKeyLoader(dir string) KeyLoader {
+	return CachedKeyLoader(func() ([]ssh.PublicKey, error) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		var keys []ssh.PublicKey
+		for _, info := range files {
+			if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+				continue
+			}
+			file, err := os.Open(filepath.Join(dir, info.Name()))
+			if err != nil {
+				return nil, err
+			}
+			fileKeys, err := ParseAuthorizedKeys(file)
+			file.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", info.Name(), err)
+			}
+			user := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+			for _, key := range fileKeys {
+				if authorized, ok := key.(*AuthorizedKey); ok && authorized.Comment == "" {
+					authorized.Comment = user
+				}
+			}
+			keys = append(keys, fileKeys...)
+		}
+		return keys, nil
+	})
+}
+
+// CommandKeyLoader loads keys in the authorized_keys format from the output
+// of a command, like sshd's AuthorizedKeysCommand.
+func CommandKeyLoader(name string, args ...string) KeyLoader {
+	return CachedKeyLoader(func() ([]ssh.PublicKey, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), keyLoaderTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, name, args...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		return ParseAuthorizedKeys(bytes.NewReader(out))
+	})
+}
+
+// RefreshKeys reloads the ops, allowlist and certificate authorities from
+// their loaders every interval, until stop is closed. Keys which disappear
+// from a loader are removed from its list, unless the loader fails.
+func (a *Auth) RefreshKeys(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if err := a.ReloadOps(); err != nil {
+			logger.Errorf("Failed to refresh ops: %s", err)
+		}
+		if err := a.ReloadAllowlist(); err != nil {
+			logger.Errorf("Failed to refresh allowlist: %s", err)
+		}
+		if err := a.ReloadCertAuthorities(); err != nil {
+			logger.Errorf("Failed to refresh certificate authorities: %s", err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package sshchat
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCachedKeyLoader(t *testing.T) {
+	key, err := NewRandomPublicKey(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fail bool
+	loader := CachedKeyLoader(func() ([]ssh.PublicKey, error) {
+		if fail {
+			return nil, errors.New("unavailable")
+		}
+		return []ssh.PublicKey{key}, nil
+	})
+
+	fail = true
+	if _, err := loader(); err == nil {
+		t.Error("expected error before the first successful load")
+	}
+	fail = false
+	if keys, err := loader(); err != nil || len(keys) != 1 {
+		t.Errorf("got: %v, %v; want 1 key", keys, err)
+	}
+	fail = true
+	if keys, err := loader(); err != nil || len(keys) != 1 {
+		t.Errorf("failed load: got: %v, %v; want the cached key", keys, err)
+	}
+}
+
+func TestURLKeyLoader(t *testing.T) {
+	var requests int
+	var fail bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case fail:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case r.Header.Get("If-None-Match") == `"v1"`:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("ssh-ed25519 " + testAuthorizedKey + "\n"))
+		}
+	}))
+	defer server.Close()
+
+	loader := URLKeyLoader(server.URL+"/alice.keys", server.Client())
+	for i := 0; i < 2; i++ {
+		keys, err := loader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 {
+			t.Errorf("load %d: got %d keys; want 1", i, len(keys))
+		}
+	}
+	fail = true
+	if keys, err := loader(); err != nil || len(keys) != 1 {
+		t.Errorf("failed fetch: got: %v, %v; want the cached key", keys, err)
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests; want 3", requests)
+	}
+}
+
+func TestDirKeyLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh-chat-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"alice.pub":  "ssh-ed25519 " + testAuthorizedKey + "\n",
+		".ignored":   "not a key\n",
+		"bob.pub":    "# no keys yet\n",
+		"carol.keys": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHz7l5wmTC8cEMK5AKU8wpgsEDM3Jo6gGAsBZGgkZ3u+ work\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := DirKeyLoader(dir)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var comments []string
+	for _, key := range keys {
+		comments = append(comments, key.(*AuthorizedKey).Comment)
+	}
+	if len(comments) != 2 || comments[0] != "alice" || comments[1] != "work" {
+		t.Errorf("got comments: %q; want: [alice work]", comments)
+	}
+}
+
+func TestCommandKeyLoader(t *testing.T) {
+	file, err := ioutil.TempFile("", "ssh-chat-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("ssh-ed25519 " + testAuthorizedKey + " alice\n")
+	file.Close()
+
+	keys, err := CommandKeyLoader("cat", file.Name())()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("got %d keys; want 1", len(keys))
+	}
+
+	if _, err := CommandKeyLoader("false")(); err == nil {
+		t.Error("expected error from a failing command")
+	}
+}
+
+func TestReloadRevokesKeys(t *testing.T) {
+	alice, err := NewRandomPublicKey(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRandomPublicKey(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, err := NewRandomPublicKey(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []ssh.PublicKey{alice, bob}
+	var fail bool
+	auth := NewAuth()
+	err = auth.LoadOps(func() ([]ssh.PublicKey, error) {
+		if fail {
+			return nil, errors.New("unavailable")
+		}
+		return keys, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Added at runtime, rather than by the loader.
+	auth.Op(carol, 0)
+
+	keys = []ssh.PublicKey{alice}
+	fail = true
+	if err := auth.ReloadOps(); err == nil {
+		t.Error("expected error from a failing loader")
+	}
+	if !auth.IsOp(bob) {
+		t.Error("bob was removed by a failed load")
+	}
+
+	fail = false
+	if err := auth.ReloadOps(); err != nil {
+		t.Fatal(err)
+	}
+	if !auth.IsOp(alice) || !auth.IsOp(carol) {
+		t.Error("alice or carol was removed")
+	}
+	if auth.IsOp(bob) {
+		t.Error("bob is still an op after being removed from the loader")
+	}
+}
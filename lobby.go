@@ -0,0 +1,194 @@
+package sshchat
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shazow/ssh-chat/chat"
+	"github.com/shazow/ssh-chat/chat/message"
+	"github.com/shazow/ssh-chat/set"
+)
+
+// lobbyHelp is sent to users waiting in the lobby.
+const lobbyHelp = "Your key is not on the allowlist yet. Use /request-access REASON to ask the ops to let you in."
+
+// lobbyRequest is a user waiting in the lobby, and their request for access.
+type lobbyRequest struct {
+	user      *message.User
+	apiMode   bool // Whether the user's terminal is a bot's.
+	reason    string
+	requested time.Time
+}
+
+// lobby holds users whose key isn't on the allowlist, until an op approves
+// or denies their request for access. They're connected, but not in the room.
+type lobby struct {
+	mu      sync.Mutex
+	waiting map[*message.User]*lobbyRequest
+}
+
+func newLobby() *lobby {
+	return &lobby{waiting: map[*message.User]*lobbyRequest{}}
+}
+
+// Add puts a user in the lobby.
+func (l *lobby) Add(u *message.User, apiMode bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.waiting[u] = &lobbyRequest{user: u, apiMode: apiMode}
+}
+
+// Remove takes a user out of the lobby, and returns whether they were in it.
+func (l *lobby) Remove(u *message.User) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.waiting[u]
+	delete(l.waiting, u)
+	return ok
+}
+
+// Waiting returns whether a user is in the lobby.
+func (l *lobby) Waiting(u *message.User) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.waiting[u]
+	return ok
+}
+
+// Request records a user's reason for requesting access, and returns whether
+// it's their first request.
+func (l *lobby) Request(u *message.User, reason string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	req, ok := l.waiting[u]
+	if !ok {
+		return false
+	}
+	first := req.requested.IsZero()
+	req.reason, req.requested = reason, time.Now()
+	return first
+}
+
+// Take removes and returns the requests of the users in the lobby with a key
+// fingerprint, or a name. Since users in the lobby pick their own names, a
+// name only matches if all its users have the same key.
+func (l *lobby) Take(query string) ([]*lobbyRequest, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var reqs []*lobbyRequest
+	for u, req := range l.waiting {
+		if u.Identifier.(*Identity).Fingerprint() == query {
+			reqs = append(reqs, req)
+		}
+	}
+	if len(reqs) == 0 {
+		fingerprints := map[string]bool{}
+		for u, req := range l.waiting {
+			if u.ID() == query {
+				reqs = append(reqs, req)
+				fingerprints[u.Identifier.(*Identity).Fingerprint()] = true
+			}
+		}
+		if len(fingerprints) > 1 {
+			return nil, fmt.Errorf("%d keys are waiting as %s, use a fingerprint", len(fingerprints), query)
+		}
+	}
+	if len(reqs) == 0 {
+		return nil, errors.New("nobody is waiting in the lobby with that fingerprint or name")
+	}
+	for _, req := range reqs {
+		delete(l.waiting, req.user)
+	}
+	return reqs, nil
+}
+
+// Names returns the sorted names of the users in the lobby.
+func (l *lobby) Names() []string {
+	l.mu.Lock()
+	names := make([]string, 0, len(l.waiting))
+	for u := range l.waiting {
+		names = append(names, u.ID())
+	}
+	l.mu.Unlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// Requests describes the users who requested access, oldest first.
+func (l *lobby) Requests() []string {
+	l.mu.Lock()
+	var reqs []*lobbyRequest
+	for _, req := range l.waiting {
+		if !req.requested.IsZero() {
+			reqs = append(reqs, req)
+		}
+	}
+	l.mu.Unlock()
+
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].requested.Before(reqs[j].requested) })
+	lines := make([]string, 0, len(reqs))
+	for _, req := range reqs {
+		lines = append(lines, fmt.Sprintf("%s (%s): %s", req.user.Name(), req.user.Identifier.(*Identity).Fingerprint(), req.reason))
+	}
+	return lines
+}
+
+// handleLobbyInput handles a message from a user waiting in the lobby, who
+// can only request access.
+func (h *Host) handleLobbyInput(u *message.User, m message.Message) {
+	cmd, ok := m.(*message.CommandMsg)
+	if !ok || cmd.Command() != "/request-access" {
+		u.Send(message.NewSystemMsg(lobbyHelp, u))
+		return
+	}
+	reason := cmd.Rest(0)
+	if reason == "" {
+		u.Send(message.NewSystemMsg("Missing reason: /request-access REASON", u))
+		return
+	}
+	if !h.lobby.Request(u, reason) {
+		u.Send(message.NewSystemMsg("Your request was already sent, wait for an op to respond.", u))
+		return
+	}
+
+	fingerprint := u.Identifier.(*Identity).Fingerprint()
+	body := fmt.Sprintf("%s (%s) requests access: %s"+message.Newline+
+		"-> Use /allowlist approve|deny %s", u.Name(), fingerprint, reason, fingerprint)
+	for _, op := range h.ops() {
+		op.Send(message.NewSystemMsg(body, op.User))
+	}
+	u.Send(message.NewSystemMsg("Your request was sent to the ops.", u))
+}
+
+// admit moves a user from the lobby into the room, as Connect joins users
+// who don't wait in it. If they can't join, they're disconnected.
+func (h *Host) admit(req *lobbyRequest, by *message.User) error {
+	u := req.user
+	role := h.auth.KeyRole(u.Identifier.(*Identity).PublicKey())
+	// The name may have been taken while they waited.
+	if _, err := h.join(u, role, req.apiMode, h.guestName()); err != nil {
+		// Written directly, since closing them drops what's queued.
+		u.HandleMsg(message.NewSystemMsg(fmt.Sprintf("Access approved by %s, but failed to join: %s", by.Name(), err), u))
+		u.Close()
+		return err
+	}
+	u.Send(message.NewSystemMsg(fmt.Sprintf("Access approved by %s, welcome!", by.Name()), u))
+	h.joined(u)
+	return nil
+}
+
+// ops returns the members who are ops.
+func (h *Host) ops() []*chat.Member {
+	var ops []*chat.Member
+	h.Members.Each(func(_ string, item set.Item) error {
+		if m, ok := item.Value().(*chat.Member); ok && m.IsOp() {
+			ops = append(ops, m)
+		}
+		return nil
+	})
+	return ops
+}
@@ -4,6 +4,10 @@ import (
 	"errors"
 	"strings"
 	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
 // Returned when an added key already exists in the set.
@@ -210,6 +214,13 @@ func (s *Set) ListPrefix(prefix string) []Item {
 	return r
 }
 
+// normalize folds the case of keys, so that non-ASCII keys like "Ελένη" and
+// "ΕΛΈΝΗ" are also treated as the same key.
 func normalize(key string) string {
+	for _, r := range key {
+		if r >= utf8.RuneSelf {
+			return norm.NFC.String(cases.Fold().String(key))
+		}
+	}
 	return strings.ToLower(key)
 }
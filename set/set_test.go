@@ -110,3 +110,24 @@ func anyItemPresentWithKey(items []Item, key string) bool {
 
 	return false
 }
+
+func TestSetNormalize(t *testing.T) {
+	s := New()
+	if err := s.Add(StringItem("Ελένη")); err != nil {
+		t.Fatalf("failed to add: %s", err)
+	}
+	for _, key := range []string{"ελένη", "ΕΛΈΝΗ", "Ελένη"} {
+		if !s.In(key) {
+			t.Errorf("%q not matched", key)
+		}
+	}
+	if err := s.Add(StringItem("ελένη")); err != ErrCollision {
+		t.Errorf("expected collision, got: %v", err)
+	}
+	if s.In("Ελενη") {
+		t.Error("matched without the accent")
+	}
+	if got := s.ListPrefix("ελ"); len(got) != 1 {
+		t.Errorf("prefix not matched: %q", got)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/shazow/ssh-chat/internal/sanitize"
@@ -27,55 +29,126 @@ type Auth interface {
 	BanAddr(net.Addr, time.Duration)
 }
 
+// CertAuth is implemented by Auths which accept SSH user certificates. Other
+// Auths treat certificates like plain public keys.
+type CertAuth interface {
+	// Given the requested user name and a certificate, returns the principal
+	// the connection is authenticated as, or an error if the certificate is
+	// invalid, untrusted or not allowed.
+	CheckCertificate(user string, cert *ssh.Certificate) (string, error)
+}
+
+// PolicyAuth is implemented by Auths which restrict the public keys they
+// accept by type and strength.
+type PolicyAuth interface {
+	KeyPolicy() KeyPolicy
+}
+
+// BannerAuth is implemented by Auths which show a banner to clients before
+// they authenticate.
+type BannerAuth interface {
+	Banner() string
+}
+
 // MakeAuth makes an ssh.ServerConfig which performs authentication against an Auth implementation.
+// Clients whose public key is rejected are told why during keyboard-interactive
+// authentication, which they fall back to, as are clients rejected by it.
 // TODO: Switch to using ssh.AuthMethod instead?
 func MakeAuth(auth Auth) *ssh.ServerConfig {
-	config := ssh.ServerConfig{
-		NoClientAuth: false,
-		// Auth-related things should be constant-time to avoid timing attacks.
-		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			err := auth.CheckBans(conn.RemoteAddr(), key, sanitize.Data(string(conn.ClientVersion()), 64))
-			if err != nil {
+	rejected := &rejections{}
+
+	checkKey := func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if policyAuth, ok := auth.(PolicyAuth); ok {
+			if err := policyAuth.KeyPolicy().Check(key); err != nil {
 				return nil, err
 			}
+		}
+		err := auth.CheckBans(conn.RemoteAddr(), key, sanitize.Data(string(conn.ClientVersion()), 64))
+		if err != nil {
+			return nil, err
+		}
+		perm := &ssh.Permissions{Extensions: map[string]string{
+			"pubkey": string(key.Marshal()),
+		}}
+		cert, isCert := key.(*ssh.Certificate)
+		certAuth, acceptsCert := auth.(CertAuth)
+		if !isCert || !acceptsCert {
 			err = auth.CheckPublicKey(key)
 			if err != nil {
 				return nil, err
 			}
-			perm := &ssh.Permissions{Extensions: map[string]string{
-				"pubkey": string(key.Marshal()),
-			}}
 			return perm, nil
+		}
+		principal, err := certAuth.CheckCertificate(conn.User(), cert)
+		if err != nil {
+			return nil, err
+		}
+		if principal != "" {
+			perm.Extensions["principal"] = principal
+			// The ssh package enforces source-address restrictions.
+			perm.CriticalOptions = cert.CriticalOptions
+		}
+		return perm, nil
+	}
+
+	config := ssh.ServerConfig{
+		NoClientAuth: false,
+		// Auth-related things should be constant-time to avoid timing attacks.
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			perm, err := checkKey(conn, key)
+			if err != nil {
+				logger.Printf("[%s] Rejected public key %s: %s", conn.RemoteAddr(), Fingerprint(key), err)
+				rejected.Add(conn, fmt.Sprintf("Public key rejected: %s. Your key's fingerprint is %s", err, Fingerprint(key)))
+			}
+			return perm, err
 		},
 
 		// We use KeyboardInteractiveCallback instead of PasswordCallback to
 		// avoid preventing the client from including a pubkey in the user
 		// identification.
 		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			// Shown with the next challenge, or on its own.
+			instruction := rejected.Take(conn)
+
 			err := auth.CheckBans(conn.RemoteAddr(), nil, sanitize.Data(string(conn.ClientVersion()), 64))
-			if err != nil {
-				return nil, err
-			}
-			if auth.AcceptPassphrase() {
+			if err == nil && auth.AcceptPassphrase() {
 				var answers []string
-				answers, err = challenge("", "", []string{"Passphrase required to connect: "}, []bool{true})
-				if err == nil {
-					if len(answers) != 1 {
-						err = errors.New("didn't get passphrase")
-					} else {
-						err = auth.CheckPassphrase(answers[0])
-						if err != nil {
-							auth.BanAddr(conn.RemoteAddr(), time.Second*2)
-						}
+				answers, err = challenge("", instruction, []string{"Passphrase required to connect: "}, []bool{true})
+				instruction = ""
+				if err != nil {
+					return nil, err
+				}
+				if len(answers) != 1 {
+					err = errors.New("didn't get passphrase")
+				} else {
+					err = auth.CheckPassphrase(answers[0])
+					if err != nil {
+						auth.BanAddr(conn.RemoteAddr(), time.Second*2)
 					}
 				}
-			} else if !auth.AllowAnonymous() {
-				err = errors.New("public key authentication required")
+			} else if err == nil && !auth.AllowAnonymous() {
+				err = errors.New("public key authentication required, connect with an SSH key")
+			}
+
+			if err != nil {
+				logger.Printf("[%s] Rejected keyboard-interactive: %s", conn.RemoteAddr(), err)
+				instruction = strings.TrimSpace(instruction + "\n" + fmt.Sprintf("Rejected: %s.", err))
+			}
+			if instruction != "" {
+				if _, challengeErr := challenge("", instruction, nil, nil); challengeErr != nil {
+					return nil, challengeErr
+				}
 			}
 			return nil, err
 		},
 	}
 
+	if bannerAuth, ok := auth.(BannerAuth); ok {
+		config.BannerCallback = func(ssh.ConnMetadata) string {
+			return bannerAuth.Banner()
+		}
+	}
+
 	return &config
 }
 
@@ -52,3 +52,73 @@ func TestClientReject(t *testing.T) {
 		t.Error("Failed to reject conncetion")
 	}
 }
+
+type policyAuth struct {
+	RejectAuth
+	policy KeyPolicy
+}
+
+func (a policyAuth) CheckBans(net.Addr, ssh.PublicKey, string) error {
+	return nil
+}
+func (a policyAuth) CheckPublicKey(ssh.PublicKey) error {
+	return nil
+}
+func (a policyAuth) KeyPolicy() KeyPolicy {
+	return a.policy
+}
+
+func TestClientKeyPolicy(t *testing.T) {
+	signer, err := NewRandomSigner(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := MakeAuth(policyAuth{policy: KeyPolicy{MinRSABits: 2048}})
+	config.AddHostKey(signer)
+
+	s, err := ListenSSH("localhost:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	go s.Serve()
+
+	var instruction string
+	clientConfig := NewClientConfigWithKey("foo", signer)
+	clientConfig.Auth = append(clientConfig.Auth, ssh.KeyboardInteractive(func(user, inst string, questions []string, echos []bool) ([]string, error) {
+		instruction = inst
+		return nil, nil
+	}))
+	conn, err := ssh.Dial("tcp", s.Addr().String(), clientConfig)
+	if err == nil {
+		defer conn.Close()
+		t.Error("Failed to reject weak key")
+	}
+	want := "Public key rejected: RSA key is 1024 bits, at least 2048 are required. Your key's fingerprint is " + Fingerprint(signer.PublicKey()) +
+		"\nRejected: public key authentication required, connect with an SSH key."
+	if instruction != want {
+		t.Errorf("got: %q; want: %q", instruction, want)
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	signer, err := NewRandomSigner(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := signer.PublicKey()
+
+	if err := (KeyPolicy{}).Check(key); err != nil {
+		t.Errorf("zero policy rejected key: %v", err)
+	}
+	if err := (KeyPolicy{MinRSABits: 1024}).Check(key); err != nil {
+		t.Errorf("got: %v; want: nil", err)
+	}
+	if err := (KeyPolicy{Algorithms: []string{ssh.KeyAlgoED25519}}).Check(key); err == nil {
+		t.Error("expected ssh-rsa key to be rejected")
+	}
+	if IsSecurityKey(key) {
+		t.Error("RSA key is not a security key")
+	}
+}
@@ -0,0 +1,140 @@
+package sshd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// errListenerClosed is returned by Accept after a MultiListener is closed.
+var errListenerClosed = errors.New("listener closed")
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// ListenUnix listens on a unix socket at path, which only its owner can
+// connect to. A socket left at path by a previous run is replaced.
+func ListenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	socket, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	return socket, nil
+}
+
+// SystemdListeners returns the sockets passed to the process by systemd socket
+// activation, in the order of the socket unit's listen directives, or nil if
+// there aren't any. The environment variables which pass them are unset, so
+// child processes don't use them too.
+func SystemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		socket, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, socket)
+	}
+	return listeners, nil
+}
+
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+// multiListener accepts connections from several listeners.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan accepted
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// MultiListener returns a listener which accepts connections from all of
+// listeners, and closes them all when it's closed. Its address is the first
+// listener's. An error accepting from one of them is returned by Accept, and
+// stops accepting from that listener.
+func MultiListener(listeners ...net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+	m := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan accepted),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.serve(l)
+	}
+	return m
+}
+
+func (m *multiListener) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case m.accepted <- accepted{conn, err}:
+		case <-m.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-m.accepted:
+		return a.conn, a.err
+	case <-m.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, l := range m.listeners {
+			if closeErr := l.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
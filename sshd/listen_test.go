@@ -0,0 +1,97 @@
+package sshd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMultiListener(t *testing.T) {
+	signer, err := NewRandomSigner(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := MakeNoAuth()
+	config.AddHostKey(signer)
+
+	dir, err := ioutil.TempDir("", "ssh-chat-sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "chat.sock")
+
+	tcp, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix, err := ListenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("unix socket mode: %v, %v; want 0600", info.Mode(), err)
+	}
+
+	s := NewSSHListener(MultiListener(tcp, unix), config)
+	defer s.Close()
+	if s.Addr() != tcp.Addr() {
+		t.Errorf("got address %s; want the first listener's", s.Addr())
+	}
+	terminals := make(chan *Terminal, 2)
+	s.HandlerFunc = func(term *Terminal) {
+		terminals <- term
+	}
+	go s.Serve()
+
+	for _, addr := range []net.Addr{tcp.Addr(), unix.Addr()} {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		sshConn, channels, requests, err := ssh.NewClientConn(conn, addr.String(), NewClientConfig("foo"))
+		if err != nil {
+			t.Fatalf("%s: %s", addr.Network(), err)
+		}
+		client := ssh.NewClient(sshConn, channels, requests)
+		defer client.Close()
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.Close()
+		if err := session.Shell(); err != nil {
+			t.Fatal(err)
+		}
+		term := <-terminals
+		term.Close()
+	}
+
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := net.Dial("tcp", tcp.Addr().String()); err == nil {
+		t.Error("listener still accepting after the multi listener closed")
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	listeners, err := SystemdListeners()
+	if err != nil || listeners != nil {
+		t.Errorf("sockets for another process: got: %v, %v; want none", listeners, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "1" {
+		t.Error("unset the environment of sockets for another process")
+	}
+}
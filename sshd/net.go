@@ -15,6 +15,9 @@ type SSHListener struct {
 
 	RateLimit   func() rateio.Limiter
 	HandlerFunc func(term *Terminal)
+	// TrustedProxies are the networks of proxies whose connections start
+	// with a PROXY protocol header, which gives the client's address.
+	TrustedProxies []*net.IPNet
 }
 
 // ListenSSH makes an SSH listener socket
@@ -23,8 +26,13 @@ func ListenSSH(laddr string, config *ssh.ServerConfig) (*SSHListener, error) {
 	if err != nil {
 		return nil, err
 	}
-	l := SSHListener{Listener: socket, config: config}
-	return &l, nil
+	return NewSSHListener(socket, config), nil
+}
+
+// NewSSHListener makes an SSH listener on an existing socket, like a unix
+// socket, one passed by systemd, or a MultiListener.
+func NewSSHListener(socket net.Listener, config *ssh.ServerConfig) *SSHListener {
+	return &SSHListener{Listener: socket, config: config}
 }
 
 func (l *SSHListener) handleConn(conn net.Conn) (*Terminal, error) {
@@ -39,6 +47,14 @@ func (l *SSHListener) handleConn(conn net.Conn) (*Terminal, error) {
 	conn.SetReadDeadline(time.Now().Add(handleTimeout))
 	defer conn.SetReadDeadline(time.Time{})
 
+	if trustedProxy(l.TrustedProxies, conn.RemoteAddr()) {
+		proxied, err := acceptProxy(conn)
+		if err != nil {
+			return nil, err
+		}
+		conn = proxied
+	}
+
 	// Upgrade TCP connection to SSH connection
 	sshConn, channels, requests, err := ssh.NewServerConn(conn, l.config)
 	if err != nil {
@@ -0,0 +1,112 @@
+package sshd
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyPolicy restricts the public keys accepted by MakeAuth. The zero value
+// accepts any key.
+type KeyPolicy struct {
+	// Algorithms are the key types accepted, like ssh.KeyAlgoED25519, or
+	// all of them if empty. Certificates are checked by the type of the key
+	// they certify.
+	Algorithms []string
+	// MinRSABits is the minimum size of RSA keys, or 0 for any size.
+	MinRSABits int
+}
+
+// Check returns an error with the reason a key isn't accepted by the policy.
+func (p KeyPolicy) Check(key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	if len(p.Algorithms) > 0 {
+		allowed := false
+		for _, algo := range p.Algorithms {
+			allowed = allowed || algo == key.Type()
+		}
+		if !allowed {
+			return fmt.Errorf("%s keys are not allowed", key.Type())
+		}
+	}
+	if p.MinRSABits > 0 && key.Type() == ssh.KeyAlgoRSA {
+		if bits := rsaBits(key); bits < p.MinRSABits {
+			return fmt.Errorf("RSA key is %d bits, at least %d are required", bits, p.MinRSABits)
+		}
+	}
+	return nil
+}
+
+func rsaBits(key ssh.PublicKey) int {
+	cryptoKey, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return 0
+	}
+	return rsaKey.N.BitLen()
+}
+
+// IsSecurityKey returns whether a key, or the key a certificate certifies, is
+// held by a FIDO security key.
+func IsSecurityKey(key ssh.PublicKey) bool {
+	if key == nil {
+		return false
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	switch key.Type() {
+	case ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoSKED25519:
+		return true
+	}
+	return false
+}
+
+// rejectionTTL is how long the reason a connection's key was rejected is kept
+// to show it during keyboard-interactive authentication.
+const rejectionTTL = time.Minute
+
+type rejection struct {
+	reason string
+	at     time.Time
+}
+
+// rejections are the reasons keys were rejected, by session ID.
+type rejections struct {
+	mu      sync.Mutex
+	reasons map[string]rejection
+}
+
+func (r *rejections) Add(conn ssh.ConnMetadata, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reasons == nil {
+		r.reasons = map[string]rejection{}
+	}
+	now := time.Now()
+	for id, old := range r.reasons {
+		if now.Sub(old.at) > rejectionTTL {
+			delete(r.reasons, id)
+		}
+	}
+	r.reasons[string(conn.SessionID())] = rejection{reason, now}
+}
+
+// Take removes and returns the reason a connection's key was rejected, or an
+// empty string if it wasn't.
+func (r *rejections) Take(conn ssh.ConnMetadata) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := string(conn.SessionID())
+	reason := r.reasons[id].reason
+	delete(r.reasons, id)
+	return reason
+}
@@ -0,0 +1,111 @@
+package sshd
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, family byte, body []byte) string {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|cmd, family, byte(len(body)>>8), byte(len(body)))
+		return string(append(header, body...))
+	}
+	v4Body := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xd4, 0x31, 0x07, 0xe6, 0x01, 0x02} // With a TLV byte.
+
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 54321 2022\r\n", "203.0.113.7:54321"},
+		{"PROXY TCP6 2001:db8::7 2001:db8::1 54321 2022\r\n", "[2001:db8::7]:54321"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{v2(0x1, 0x11, v4Body), "203.0.113.7:54321"},
+		{v2(0x0, 0x00, nil), ""},
+	}
+	for _, tc := range tests {
+		r := bufio.NewReader(strings.NewReader(tc.header + "SSH-2.0-rest"))
+		addr, err := readProxyHeader(r)
+		if err != nil {
+			t.Errorf("%q: %s", tc.header, err)
+			continue
+		}
+		var got string
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tc.want {
+			t.Errorf("%q: got: %q; want: %q", tc.header, got, tc.want)
+		}
+		if rest, _ := r.ReadString('\n'); rest != "SSH-2.0-rest" {
+			t.Errorf("%q: header wasn't consumed exactly, left: %q", tc.header, rest)
+		}
+	}
+
+	for _, header := range []string{
+		"SSH-2.0-OpenSSH_9.0\r\n",
+		"PROXY TCP4 nope 10.0.0.1 1 2\r\n",
+		"PROXY " + strings.Repeat("x", proxyV1MaxLength) + "\r\n",
+	} {
+		if _, err := readProxyHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("%q: expected error", header)
+		}
+	}
+}
+
+func TestServeProxied(t *testing.T) {
+	signer, err := NewRandomSigner(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := MakeNoAuth()
+	config.AddHostKey(signer)
+
+	s, err := ListenSSH("localhost:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.TrustedProxies, err = ParseTrustedProxies([]string{"127.0.0.1", "::1/128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	terminals := make(chan *Terminal, 1)
+	s.HandlerFunc = func(term *Terminal) {
+		terminals <- term
+	}
+	go s.Serve()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 54321 2022\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, s.Addr().String(), NewClientConfig("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ssh.NewClient(sshConn, channels, requests)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+
+	term := <-terminals
+	defer term.Close()
+	if got := term.Conn.RemoteAddr().String(); got != "203.0.113.7:54321" {
+		t.Errorf("got remote address %q; want the proxied client's", got)
+	}
+}
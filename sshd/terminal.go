@@ -25,6 +25,9 @@ type Connection interface {
 	PublicKey() ssh.PublicKey
 	RemoteAddr() net.Addr
 	Name() string
+	// Principal returns the certificate principal the connection
+	// authenticated as, or an empty string if it didn't use a certificate.
+	Principal() string
 	ClientVersion() []byte
 	Close() error
 }
@@ -55,6 +58,13 @@ func (c sshConn) Name() string {
 	return c.User()
 }
 
+func (c sshConn) Principal() string {
+	if c.Permissions == nil {
+		return ""
+	}
+	return c.Permissions.Extensions["principal"]
+}
+
 // EnvVar is an environment variable key-value pair
 type EnvVar struct {
 	Key   string
@@ -6,8 +6,10 @@ package terminal
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"strconv"
+	"strings"
 	"sync"
 	"unicode/utf8"
 
@@ -68,6 +70,12 @@ type Terminal struct {
 	// pasteActive is true iff there is a bracketed paste operation in
 	// progress.
 	pasteActive bool
+	// pasteLines holds the completed lines of a multi-line paste in
+	// progress, up to maxPasteLines. pasteOverflow is set if more lines
+	// were pasted than that.
+	pasteLines    []string
+	maxPasteLines int
+	pasteOverflow bool
 
 	// cursorX contains the current X value of the cursor where the left
 	// edge is 0. cursorY contains the row number where the first row of
@@ -802,12 +810,28 @@ func (t *Terminal) readLine() (line string, err error) {
 				}
 			} else if key == keyPasteEnd {
 				t.pasteActive = false
+				if t.pasteLines != nil {
+					// Finish the multi-line paste, including any
+					// trailing partial line.
+					if len(t.line) > 0 {
+						partial, _ := t.handleKey(keyEnter)
+						t.addPasteLine(partial)
+					}
+					line, lineOk = strings.Join(t.pasteLines, "\n"), true
+					lineIsPasted = true
+					t.pasteLines = nil
+				}
 				continue
 			}
 			if !t.pasteActive {
 				lineIsPasted = false
 			}
 			line, lineOk = t.handleKey(key)
+			if lineOk && t.pasteActive && t.maxPasteLines > 0 {
+				// Collect the line until the paste is over.
+				t.addPasteLine(line)
+				line, lineOk = "", false
+			}
 		}
 		if len(rest) > 0 {
 			n := copy(t.inBuf[:], rest)
@@ -818,13 +842,17 @@ func (t *Terminal) readLine() (line string, err error) {
 		t.c.Write(t.outBuf)
 		t.outBuf = t.outBuf[:0]
 		if lineOk {
-			if t.echo {
+			if t.echo && !strings.Contains(line, "\n") {
 				t.historyIndex = -1
 				t.history.Add(line)
 			}
 			if lineIsPasted {
 				err = ErrPasteIndicator
 			}
+			if t.pasteOverflow {
+				t.pasteOverflow = false
+				err = ErrPasteTooLong
+			}
 			return
 		}
 
@@ -948,6 +976,32 @@ func (pasteIndicatorError) Error() string {
 // interpret pasted data more literally than typed data.
 var ErrPasteIndicator = pasteIndicatorError{}
 
+// ErrPasteTooLong is returned from ReadLine, along with the truncated
+// paste, when a multi-line paste exceeded the limit set by SetMultilinePaste.
+var ErrPasteTooLong = errors.New("terminal: too many pasted lines")
+
+// SetMultilinePaste sets the maximum number of lines that a bracketed paste
+// may contain to be returned from ReadLine as a single line joined by "\n".
+// If maxLines is 0, each pasted line is returned separately.
+func (t *Terminal) SetMultilinePaste(maxLines int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.maxPasteLines = maxLines
+}
+
+// addPasteLine adds a completed line to the multi-line paste in progress.
+func (t *Terminal) addPasteLine(line string) {
+	if t.pasteLines == nil {
+		t.pasteLines = []string{}
+	}
+	if len(t.pasteLines) >= t.maxPasteLines {
+		t.pasteOverflow = true
+		return
+	}
+	t.pasteLines = append(t.pasteLines, line)
+}
+
 // SetBracketedPasteMode requests that the terminal bracket paste operations
 // with markers. Not all terminals support this but, if it is supported, then
 // enabling this mode will stop any autocomplete callback from running due to
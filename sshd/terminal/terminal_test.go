@@ -239,6 +239,65 @@ func TestKeyPresses(t *testing.T) {
 	}
 }
 
+var multilinePasteTests = []struct {
+	in   string
+	line string
+	err  error
+}{
+	{
+		// Pasted lines are joined until the paste is over.
+		in:   "\x1b[200~a\rb\r\x1b[201~",
+		line: "a\nb",
+		err:  ErrPasteIndicator,
+	},
+	{
+		// A trailing partial line is included.
+		in:   "\x1b[200~a\rb\x1b[201~",
+		line: "a\nb",
+		err:  ErrPasteIndicator,
+	},
+	{
+		// Typed input before the paste is part of the first line.
+		in:   "x\x1b[200~a\rb\r\x1b[201~",
+		line: "xa\nb",
+		err:  ErrPasteIndicator,
+	},
+	{
+		// A single pasted line is returned as usual.
+		in:   "\x1b[200~a\r\x1b[201~",
+		line: "a",
+		err:  ErrPasteIndicator,
+	},
+	{
+		// Lines beyond the limit are dropped.
+		in:   "\x1b[200~a\rb\rc\rd\r\x1b[201~",
+		line: "a\nb\nc",
+		err:  ErrPasteTooLong,
+	},
+}
+
+func TestMultilinePaste(t *testing.T) {
+	for i, test := range multilinePasteTests {
+		for j := 1; j < len(test.in); j++ {
+			c := &MockTerminal{
+				toSend:       []byte(test.in),
+				bytesPerRead: j,
+			}
+			ss := NewTerminal(c, "> ")
+			ss.SetMultilinePaste(3)
+			line, err := ss.ReadLine()
+			if line != test.line {
+				t.Errorf("Line resulting from test %d (%d bytes per read) was %q, expected %q", i, j, line, test.line)
+				break
+			}
+			if err != test.err {
+				t.Errorf("Error resulting from test %d (%d bytes per read) was '%v', expected '%v'", i, j, err, test.err)
+				break
+			}
+		}
+	}
+}
+
 var renderTests = []struct {
 	in       string
 	received string
@@ -0,0 +1,186 @@
+package sshchat
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/shazow/ssh-chat/set"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNoTOTPSecret is the error returned when elevating a key without a TOTP
+// secret.
+var ErrNoTOTPSecret = errors.New("no TOTP secret for this key")
+
+// ErrIncorrectTOTP is the error returned when a TOTP code is incorrect, or was
+// already used.
+var ErrIncorrectTOTP = errors.New("incorrect TOTP code")
+
+// ErrTOTPThrottled is the error returned when trying another TOTP code too
+// soon after an incorrect one.
+var ErrTOTPThrottled = errors.New("too many attempts, try again later")
+
+const (
+	// totpStep is how long each TOTP code is valid for, as in RFC 6238.
+	totpStep = 30 * time.Second
+	// totpSkew is how many steps before or after the current one are
+	// accepted, for clocks which are a little off.
+	totpSkew = 1
+	// totpThrottle is how long after an incorrect code another is refused. It
+	// doubles with each incorrect code in a row, up to totpMaxThrottle.
+	totpThrottle    = 2 * time.Second
+	totpMaxThrottle = time.Hour
+)
+
+// ParseTOTPSecret decodes a base32 TOTP secret, as shown by authenticator
+// apps, ignoring case, spaces and padding.
+func ParseTOTPSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Replace(s, " ", "", -1))
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOTP secret: %s", err)
+	}
+	return secret, nil
+}
+
+// totpCode returns the six digit HOTP code of a counter, as in RFC 4226.
+func totpCode(secret []byte, counter uint64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// checkTOTP returns the counter of the step a code is valid for at now, and
+// whether it's valid.
+func checkTOTP(secret []byte, code string, now time.Time) (uint64, bool) {
+	current := uint64(now.Unix() / int64(totpStep/time.Second))
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// totpSecret is a key's TOTP secret, and the counter of the last code used
+// with it so that codes can't be replayed.
+type totpSecret struct {
+	secret []byte
+	used   uint64
+}
+
+// LoadTOTPSecrets replaces the TOTP secrets of ops with ones read from r, one
+// per line as a public key fingerprint, or "principal:NAME", and a base32
+// secret. Empty lines and lines starting with # are skipped.
+func (a *Auth) LoadTOTPSecrets(r io.Reader) error {
+	var items []set.Item
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid TOTP secret line: %q", fields[0])
+		}
+		secret, err := ParseTOTPSecret(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s: %s", fields[0], err)
+		}
+		items = append(items, set.Itemize(fields[0], &totpSecret{secret: secret}))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.totpSecrets.Clear()
+	for _, item := range items {
+		a.totpSecrets.Set(item)
+	}
+	return nil
+}
+
+// HasTOTPSecret returns whether a public key, or one of its certificate's
+// principals, has a TOTP secret to elevate with.
+func (a *Auth) HasTOTPSecret(key ssh.PublicKey) bool {
+	return a.totpSecret(key) != nil
+}
+
+func (a *Auth) totpSecret(key ssh.PublicKey) *totpSecret {
+	for _, authkey := range a.authKeys(key) {
+		if item := activeItem(a.totpSecrets, authkey); item != nil {
+			return item.Value().(*totpSecret)
+		}
+	}
+	return nil
+}
+
+// Elevate checks a TOTP code for a public key, and lets it have its op role
+// until the returned time, or indefinitely if it's zero. Each code can only be
+// used once, and codes are refused for a while after an incorrect one, longer
+// the more incorrect ones there were in a row.
+func (a *Auth) Elevate(key ssh.PublicKey, code string) (time.Time, error) {
+	secret := a.totpSecret(key)
+	if secret == nil {
+		return time.Time{}, ErrNoTOTPSecret
+	}
+	authkey := newAuthKey(key)
+
+	a.totpMu.Lock()
+	defer a.totpMu.Unlock()
+	if a.totpThrottled.In(authkey) {
+		return time.Time{}, ErrTOTPThrottled
+	}
+	counter, ok := checkTOTP(secret.secret, strings.TrimSpace(code), time.Now())
+	if !ok || counter <= secret.used {
+		a.totpFailures[authkey]++
+		d := totpBackoff(a.totpFailures[authkey])
+		a.totpThrottled.Set(set.Expire(set.StringItem(authkey), d))
+		logger.Errorf("Incorrect TOTP code for %q, %d in a row, refusing codes for %s", authkey, a.totpFailures[authkey], d)
+		return time.Time{}, ErrIncorrectTOTP
+	}
+	secret.used = counter
+	delete(a.totpFailures, authkey)
+
+	var until time.Time
+	item := set.Item(set.StringItem(authkey))
+	if d := a.Elevation(); d != 0 {
+		item = set.Expire(item, d)
+		until = item.(*set.ExpiringItem).Time
+	}
+	a.elevated.Set(item)
+	logger.Debugf("Elevated: %q (for %s)", authkey, a.Elevation())
+	return until, nil
+}
+
+// totpBackoff returns how long codes are refused after a number of incorrect
+// ones in a row.
+func totpBackoff(failures int) time.Duration {
+	d := totpThrottle
+	for i := 1; i < failures && d < totpMaxThrottle; i++ {
+		d *= 2
+	}
+	if d > totpMaxThrottle {
+		d = totpMaxThrottle
+	}
+	return d
+}
+
+// isElevated returns whether a public key was elevated with a TOTP code, and
+// the elevation hasn't expired.
+func (a *Auth) isElevated(key ssh.PublicKey) bool {
+	return key != nil && a.elevated.In(newAuthKey(key))
+}
@@ -0,0 +1,107 @@
+package sshchat
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shazow/ssh-chat/chat"
+	"github.com/shazow/ssh-chat/set"
+	"github.com/shazow/ssh-chat/sshd"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		counter, ok := checkTOTP(secret, want, time.Unix(unix, 0))
+		if !ok {
+			t.Errorf("%d: code %s was rejected", unix, want)
+		} else if got := totpCode(secret, counter); got != want {
+			t.Errorf("%d: got: %s; want: %s", unix, got, want)
+		}
+	}
+
+	if _, ok := checkTOTP(secret, "287082", time.Unix(59+90, 0)); ok {
+		t.Error("accepted a code from three steps ago")
+	}
+}
+
+func TestAuthElevate(t *testing.T) {
+	key, err := NewRandomPublicKey(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRandomPublicKey(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("12345678901234567890")
+
+	auth := NewAuth()
+	auth.Op(key, 0)
+	auth.Op(other, 0)
+	auth.SetOpsRequireTOTP(true)
+	auth.SetElevation(time.Hour)
+	err = auth.LoadTOTPSecrets(strings.NewReader("# ops\n" + sshd.Fingerprint(key) + " " + base32.StdEncoding.EncodeToString(secret) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if role := auth.KeyRole(key); role != chat.RoleVoice {
+		t.Errorf("got role %s before elevating; want voice", role)
+	}
+	if !auth.NeedsElevation(key) {
+		t.Error("op key doesn't need elevation")
+	}
+	if _, err := auth.Elevate(other, "123456"); err != ErrNoTOTPSecret {
+		t.Errorf("key without a secret: got: %v; want: %v", err, ErrNoTOTPSecret)
+	}
+
+	code := totpCode(secret, uint64(time.Now().Unix()/30))
+	until, err := auth.Elevate(key, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(until); d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("elevated for %s; want an hour", d)
+	}
+	if role := auth.KeyRole(key); role != chat.RoleOwner {
+		t.Errorf("got role %s after elevating; want owner", role)
+	}
+
+	if _, err := auth.Elevate(key, code); err != ErrIncorrectTOTP {
+		t.Errorf("replayed code: got: %v; want: %v", err, ErrIncorrectTOTP)
+	}
+	if _, err := auth.Elevate(key, code); err != ErrTOTPThrottled {
+		t.Errorf("after an incorrect code: got: %v; want: %v", err, ErrTOTPThrottled)
+	}
+
+	// Each incorrect code in a row doubles how long codes are refused.
+	throttled := func() time.Duration {
+		item, err := auth.totpThrottled.Get(sshd.Fingerprint(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Until(item.(*set.ExpiringItem).Time)
+	}
+	if d := throttled(); d > totpThrottle {
+		t.Errorf("throttled for %s after one incorrect code; want %s", d, totpThrottle)
+	}
+	auth.totpThrottled.Clear()
+	if _, err := auth.Elevate(key, "000000"); err != ErrIncorrectTOTP {
+		t.Errorf("incorrect code: got: %v; want: %v", err, ErrIncorrectTOTP)
+	}
+	if d := throttled(); d <= totpThrottle || d > 2*totpThrottle {
+		t.Errorf("throttled for %s after two incorrect codes; want %s", d, 2*totpThrottle)
+	}
+	if d := totpBackoff(100); d != totpMaxThrottle {
+		t.Errorf("throttled for %s after many incorrect codes; want %s", d, totpMaxThrottle)
+	}
+}